@@ -0,0 +1,351 @@
+package cloudprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	AWS_VERSION_STAGE_CURRENT        = "AWSCURRENT"
+	AWS_VERSION_STAGE_EXPIRES_PREFIX = "bootstraptoken-expires-"
+)
+
+type (
+	CloudProviderAws struct {
+		CloudProvider
+
+		opts *awsOptions
+
+		logger *slogger.Logger
+
+		secretsManagerClient *secretsmanager.Client
+	}
+
+	// options of AWS cloud providers (Secrets Manager and SSM Parameter Store, region and endpoint are also used by S3)
+	awsOptions struct {
+		Region                   *string `long:"aws.region"                   env:"AWS_REGION"                   description:"AWS region (defaults to AWS SDK configuration)"`
+		Endpoint                 *string `long:"aws.endpoint"                 env:"AWS_ENDPOINT_URL"             description:"Custom AWS endpoint URL (eg. for local mock endpoints)"`
+		SecretsManagerSecretName *string `long:"aws.secretsmanager.secret"    env:"AWS_SECRETSMANAGER_SECRET"    description:"Name of Secrets Manager secret to sync token" default:"kube-bootstrap-token"`
+		SsmParameterName         *string `long:"aws.ssm.parameter"            env:"AWS_SSM_PARAMETER"            description:"Name of SSM parameter to sync token" default:"/kube-bootstrap-token"`
+		SsmKmsKeyId              *string `long:"aws.ssm.kms-key"              env:"AWS_SSM_KMS_KEY"              description:"KMS key ID for SSM SecureString parameter (defaults to AWS managed key)"`
+		SsmExpirationPolicy      bool    `long:"aws.ssm.expiration-policy"    env:"AWS_SSM_EXPIRATION_POLICY"    description:"Attach expiration policy to SSM parameter (requires advanced tier, SSM deletes the whole parameter including all previous versions after expiration, can't be used with --sync.full)"`
+	}
+)
+
+var (
+	awsOpts = &awsOptions{}
+)
+
+func init() {
+	Register("aws", func() CloudProvider {
+		return &CloudProviderAws{opts: awsOpts}
+	})
+	RegisterOptions("aws", awsOpts)
+}
+
+func (m *CloudProviderAws) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "aws"),
+	)
+
+	if m.opts.SecretsManagerSecretName == nil || *m.opts.SecretsManagerSecretName == "" {
+		return errors.New("no AWS Secrets Manager secret name specified")
+	}
+
+	awsConfig, err := newAwsConfig(ctx, m.opts, userAgent)
+	if err != nil {
+		return err
+	}
+
+	m.secretsManagerClient = secretsmanager.NewFromConfig(awsConfig)
+
+	return nil
+}
+
+func (m *CloudProviderAws) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	secretName := *m.opts.SecretsManagerSecretName
+
+	contextLogger := m.logger.With(slog.String("secretName", secretName))
+
+	contextLogger.Info("fetching current token from AWS Secrets Manager")
+	secret, err := m.secretsManagerClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(secretName),
+		VersionStage: aws.String(AWS_VERSION_STAGE_CURRENT),
+	})
+	if err != nil {
+		return nil, m.handleSecretsManagerError(contextLogger, err)
+	}
+
+	if secret.SecretString != nil {
+		token = bootstraptoken.ParseFromString(*secret.SecretString)
+		if token != nil {
+			m.updateTokenMeta(token, secret)
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderAws) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+	secretName := *m.opts.SecretsManagerSecretName
+
+	contextLogger := m.logger.With(slog.String("secretName", secretName))
+	contextLogger.Info("fetching all tokens from AWS Secrets Manager")
+
+	// get versions first
+	secretCandidateList := []types.SecretVersionsListEntry{}
+	pager := secretsmanager.NewListSecretVersionIdsPaginator(m.secretsManagerClient, &secretsmanager.ListSecretVersionIdsInput{
+		SecretId:          aws.String(secretName),
+		IncludeDeprecated: aws.Bool(false),
+	})
+	for pager.HasMorePages() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, m.handleSecretsManagerError(contextLogger, err)
+		}
+
+		for _, secretVersion := range result.Versions {
+			if secretVersion.CreatedDate == nil {
+				continue
+			}
+
+			if expires := awsVersionStageExpiration(secretVersion.VersionStages); expires != nil && time.Now().After(*expires) {
+				// expired
+				continue
+			}
+
+			secretCandidateList = append(secretCandidateList, secretVersion)
+		}
+	}
+
+	// sort results
+	sort.Slice(secretCandidateList, func(i, j int) bool {
+		return secretCandidateList[i].CreatedDate.UTC().After(secretCandidateList[j].CreatedDate.UTC())
+	})
+
+	// process list
+	for _, secretVersion := range secretCandidateList {
+		secretLogger := contextLogger.With(slog.String("secretVersion", *secretVersion.VersionId))
+
+		secret, err := m.secretsManagerClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId:  aws.String(secretName),
+			VersionId: secretVersion.VersionId,
+		})
+		if err != nil {
+			secretLogger.Warn(`unable to fetch secret`, slog.Any("error", err))
+			continue
+		}
+
+		if secret.SecretString != nil {
+			token := bootstraptoken.ParseFromString(*secret.SecretString)
+			if token != nil {
+				secretLogger.Info("found valid secret")
+				m.updateTokenMeta(token, secret)
+				tokens = append(tokens, token)
+			}
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderAws) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	secretName := *m.opts.SecretsManagerSecretName
+
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("secretName", secretName),
+	)
+	contextLogger.Info("storing token to AWS Secrets Manager", slog.String("expiration", token.ExpirationString()))
+
+	// Secrets Manager has no per version expiry, so it's tracked as custom version stage
+	versionStages := []string{AWS_VERSION_STAGE_CURRENT}
+	if token.ExpirationTime() != nil {
+		versionStages = append(versionStages, awsVersionStageForExpiration(*token.ExpirationTime()))
+	}
+
+	secretParameters := secretsmanager.PutSecretValueInput{
+		SecretId:      aws.String(secretName),
+		SecretString:  aws.String(token.FullToken()),
+		VersionStages: versionStages,
+	}
+
+	_, err := m.secretsManagerClient.PutSecretValue(ctx, &secretParameters)
+	if err != nil {
+		var notFoundErr *types.ResourceNotFoundException
+		if !errors.As(err, &notFoundErr) {
+			return err
+		}
+
+		// secret doesn't exist yet, create it without value and retry
+		contextLogger.Info("creating new AWS Secrets Manager secret")
+		_, err = m.secretsManagerClient.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+			Name:        aws.String(secretName),
+			Description: aws.String("kube-bootstrap-token"),
+			Tags: []types.Tag{
+				{Key: aws.String("managed-by"), Value: aws.String("kube-bootstrap-token-manager")},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := m.secretsManagerClient.PutSecretValue(ctx, &secretParameters); err != nil {
+			return err
+		}
+	}
+
+	m.cleanupVersionStages(ctx, contextLogger)
+
+	return nil
+}
+
+// removes expiry version stages from expired and superseded versions
+// so they count neither against the staging label quota nor keep old versions from being deprecated
+func (m *CloudProviderAws) cleanupVersionStages(ctx context.Context, logger *slogger.Logger) {
+	secretName := *m.opts.SecretsManagerSecretName
+
+	versionList := []types.SecretVersionsListEntry{}
+	pager := secretsmanager.NewListSecretVersionIdsPaginator(m.secretsManagerClient, &secretsmanager.ListSecretVersionIdsInput{
+		SecretId: aws.String(secretName),
+	})
+	for pager.HasMorePages() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			logger.Warn(`unable to list secret versions for cleanup`, slog.Any("error", err))
+			return
+		}
+
+		for _, secretVersion := range result.Versions {
+			if secretVersion.CreatedDate != nil {
+				versionList = append(versionList, secretVersion)
+			}
+		}
+	}
+
+	sort.Slice(versionList, func(i, j int) bool {
+		return versionList[i].CreatedDate.UTC().After(versionList[j].CreatedDate.UTC())
+	})
+
+	for num, secretVersion := range versionList {
+		expires := awsVersionStageExpiration(secretVersion.VersionStages)
+		if expires == nil {
+			continue
+		}
+
+		if retainVersion(num, expires) {
+			continue
+		}
+
+		versionStage := awsVersionStageForExpiration(*expires)
+		logger.Debug("removing version stage from secret version", slog.String("secretVersion", *secretVersion.VersionId), slog.String("versionStage", versionStage))
+		_, err := m.secretsManagerClient.UpdateSecretVersionStage(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+			SecretId:            aws.String(secretName),
+			VersionStage:        aws.String(versionStage),
+			RemoveFromVersionId: secretVersion.VersionId,
+		})
+		if err != nil {
+			logger.Warn(`unable to remove version stage from secret version`, slog.Any("error", err))
+		}
+	}
+}
+
+func (m *CloudProviderAws) updateTokenMeta(token *bootstraptoken.BootstrapToken, secret *secretsmanager.GetSecretValueOutput) {
+	if secret.CreatedDate != nil {
+		token.SetCreationTime(*secret.CreatedDate)
+	}
+
+	expires := awsVersionStageExpiration(secret.VersionStages)
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "aws")
+	token.SetAnnotation("bootstraptoken.webdevops.io/secret", aws.ToString(secret.Name))
+	token.SetAnnotation("bootstraptoken.webdevops.io/secretVersion", aws.ToString(secret.VersionId))
+
+	if secret.CreatedDate != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", secret.CreatedDate.Format(time.RFC3339))
+	}
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+}
+
+func (m *CloudProviderAws) handleSecretsManagerError(logger *slogger.Logger, err error) error {
+	code := awsErrorCode(err)
+	return handleFetchError(logger, err, code == "ResourceNotFoundException", code == "AccessDeniedException", "secret", "unable to access AWS Secrets Manager, please check access")
+}
+
+// builds AWS SDK configuration from environment and options
+func newAwsConfig(ctx context.Context, opts *awsOptions, userAgent string) (aws.Config, error) {
+	configOpts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithAPIOptions([]func(*middleware.Stack) error{
+			awsmiddleware.AddUserAgentKey(userAgent),
+		}),
+	}
+
+	if opts.Region != nil && *opts.Region != "" {
+		configOpts = append(configOpts, awsconfig.WithRegion(*opts.Region))
+	}
+
+	if opts.Endpoint != nil && *opts.Endpoint != "" {
+		configOpts = append(configOpts, awsconfig.WithBaseEndpoint(*opts.Endpoint))
+	}
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, configOpts...)
+	if err != nil {
+		return awsConfig, fmt.Errorf(`unable to load AWS configuration: %w`, err)
+	}
+
+	return awsConfig, nil
+}
+
+// returns error code of AWS API errors (empty if not an API error)
+func awsErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func awsVersionStageForExpiration(val time.Time) string {
+	return fmt.Sprintf("%s%d", AWS_VERSION_STAGE_EXPIRES_PREFIX, val.Unix())
+}
+
+func awsVersionStageExpiration(versionStages []string) *time.Time {
+	for _, versionStage := range versionStages {
+		if timestamp, ok := strings.CutPrefix(versionStage, AWS_VERSION_STAGE_EXPIRES_PREFIX); ok {
+			if val, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+				expires := time.Unix(val, 0).UTC()
+				return &expires
+			}
+		}
+	}
+	return nil
+}
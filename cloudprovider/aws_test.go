@@ -0,0 +1,286 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+type (
+	// fakeSecretsManager is a minimal in-memory AWS Secrets Manager (JSON protocol) for one secret
+	fakeSecretsManager struct {
+		server *httptest.Server
+
+		lock     sync.Mutex
+		exists   bool
+		versions []*fakeSecretsManagerVersion
+		clock    time.Time
+
+		// optional error type returned for all requests
+		fail string
+	}
+
+	fakeSecretsManagerVersion struct {
+		VersionId     string
+		SecretString  string
+		VersionStages []string
+		CreatedDate   time.Time
+	}
+)
+
+// setTestAwsEnvironment sets static credentials and disables shared configuration files
+func setTestAwsEnvironment(t *testing.T) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func newFakeSecretsManager(t *testing.T) *fakeSecretsManager {
+	t.Helper()
+	sm := &fakeSecretsManager{
+		clock: time.Now().Add(-time.Hour).Truncate(time.Second),
+	}
+	sm.server = httptest.NewServer(http.HandlerFunc(sm.serveHTTP))
+	t.Cleanup(sm.server.Close)
+	return sm
+}
+
+func (sm *fakeSecretsManager) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.")
+	input := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		sm.writeError(w, "InvalidRequestException")
+		return
+	}
+
+	if sm.fail != "" {
+		sm.writeError(w, sm.fail)
+		return
+	}
+
+	if operation != "CreateSecret" && !sm.exists {
+		sm.writeError(w, "ResourceNotFoundException")
+		return
+	}
+
+	switch operation {
+	case "CreateSecret":
+		if sm.exists {
+			sm.writeError(w, "ResourceExistsException")
+			return
+		}
+		sm.exists = true
+		sm.writeJSON(w, map[string]interface{}{"Name": input["Name"]})
+	case "PutSecretValue":
+		sm.clock = sm.clock.Add(time.Second)
+		version := &fakeSecretsManagerVersion{
+			VersionId:    fmt.Sprintf("v%d", len(sm.versions)+1),
+			SecretString: input["SecretString"].(string),
+			CreatedDate:  sm.clock,
+		}
+		for _, stage := range input["VersionStages"].([]interface{}) {
+			sm.moveStage(stage.(string), version)
+		}
+		sm.versions = append(sm.versions, version)
+		sm.writeJSON(w, map[string]interface{}{"Name": input["SecretId"], "VersionId": version.VersionId, "VersionStages": version.VersionStages})
+	case "GetSecretValue":
+		for _, version := range sm.versions {
+			if version.VersionId == input["VersionId"] || (input["VersionStage"] != nil && slices.Contains(version.VersionStages, input["VersionStage"].(string))) {
+				sm.writeJSON(w, map[string]interface{}{
+					"Name":          input["SecretId"],
+					"VersionId":     version.VersionId,
+					"SecretString":  version.SecretString,
+					"VersionStages": version.VersionStages,
+					"CreatedDate":   version.CreatedDate.Unix(),
+				})
+				return
+			}
+		}
+		sm.writeError(w, "ResourceNotFoundException")
+	case "ListSecretVersionIds":
+		versions := []map[string]interface{}{}
+		for _, version := range sm.versions {
+			// versions without stage are deprecated
+			if len(version.VersionStages) == 0 && input["IncludeDeprecated"] != true {
+				continue
+			}
+			versions = append(versions, map[string]interface{}{
+				"VersionId":     version.VersionId,
+				"VersionStages": version.VersionStages,
+				"CreatedDate":   version.CreatedDate.Unix(),
+			})
+		}
+		sm.writeJSON(w, map[string]interface{}{"Name": input["SecretId"], "Versions": versions})
+	case "UpdateSecretVersionStage":
+		for _, version := range sm.versions {
+			if version.VersionId == input["RemoveFromVersionId"] {
+				version.VersionStages = slices.DeleteFunc(version.VersionStages, func(stage string) bool {
+					return stage == input["VersionStage"]
+				})
+			}
+		}
+		sm.writeJSON(w, map[string]interface{}{"Name": input["SecretId"]})
+	default:
+		sm.writeError(w, "InvalidRequestException")
+	}
+}
+
+// moveStage moves version stage to version, AWSCURRENT moves previous current version to AWSPREVIOUS
+func (sm *fakeSecretsManager) moveStage(stage string, target *fakeSecretsManagerVersion) {
+	for _, version := range sm.versions {
+		if !slices.Contains(version.VersionStages, stage) {
+			continue
+		}
+		version.VersionStages = slices.DeleteFunc(version.VersionStages, func(val string) bool { return val == stage })
+		if stage == AWS_VERSION_STAGE_CURRENT {
+			sm.moveStage("AWSPREVIOUS", version)
+		}
+	}
+	target.VersionStages = append(target.VersionStages, stage)
+}
+
+func (sm *fakeSecretsManager) stagedVersions(prefix string) int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	count := 0
+	for _, version := range sm.versions {
+		for _, stage := range version.VersionStages {
+			if strings.HasPrefix(stage, prefix) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (sm *fakeSecretsManager) writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (sm *fakeSecretsManager) writeError(w http.ResponseWriter, errorType string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-ErrorType", errorType)
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"__type": errorType, "message": "fake error"})
+}
+
+func newTestAwsProvider(t *testing.T, sm *fakeSecretsManager) *CloudProviderAws {
+	t.Helper()
+	setTestAwsEnvironment(t)
+
+	m := &CloudProviderAws{
+		opts: &awsOptions{
+			Region:                   stringPtr("eu-central-1"),
+			Endpoint:                 stringPtr(sm.server.URL),
+			SecretsManagerSecretName: stringPtr("kube-bootstrap-token"),
+		},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAwsStoreTokenCreatesSecret(t *testing.T) {
+	ctx := context.Background()
+	sm := newFakeSecretsManager(t)
+	m := newTestAwsProvider(t, sm)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing secret must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if token.ExpirationTime() == nil || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected expiration %v (from version stage), got %v", stored.ExpirationTime(), token.ExpirationTime())
+	}
+}
+
+func TestAwsStoreTokenCleansUpVersionStages(t *testing.T) {
+	ctx := context.Background()
+	sm := newFakeSecretsManager(t)
+	m := newTestAwsProvider(t, sm)
+
+	// expired token, its expiry stage is removed on next rotation
+	expired := bootstraptoken.NewBootstrapToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		// version stages are unique per secret, so every token needs its own expiration
+		token := newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")
+		token.SetExpirationTime(token.ExpirationTime().Add(time.Duration(num) * time.Minute))
+		if err := m.StoreToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the latest SECRET_SYNC_COUNT_MAX valid versions keep their expiry stage
+	if count := sm.stagedVersions(AWS_VERSION_STAGE_EXPIRES_PREFIX); count != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d versions with expiry stage, got %d", SECRET_SYNC_COUNT_MAX, count)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.Id() == "expire" {
+			t.Fatal("expired token must not be fetched")
+		}
+	}
+}
+
+func TestAwsFetchTokenAccessDenied(t *testing.T) {
+	sm := newFakeSecretsManager(t)
+	sm.fail = "AccessDeniedException"
+	m := newTestAwsProvider(t, sm)
+
+	if _, err := m.FetchToken(context.Background()); err == nil || awsErrorCode(err) != "AccessDeniedException" {
+		t.Fatalf("expected AccessDeniedException, got %v", err)
+	}
+
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
@@ -0,0 +1,379 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	AWS_SSM_LABEL_EXPIRES_PREFIX = "bootstraptoken-expires-"
+	AWS_SSM_LABEL_CREATED_PREFIX = "bootstraptoken-created-"
+)
+
+type (
+	CloudProviderAwsSsm struct {
+		CloudProvider
+
+		opts *awsOptions
+
+		logger *slogger.Logger
+
+		ssmClient *ssm.Client
+	}
+
+	awsSsmParameterPolicy struct {
+		Type       string            `json:"Type"`
+		Version    string            `json:"Version"`
+		Attributes map[string]string `json:"Attributes"`
+	}
+)
+
+func init() {
+	Register("aws-ssm", func() CloudProvider {
+		return &CloudProviderAwsSsm{opts: awsOpts}
+	})
+	RegisterOptions("aws-ssm", awsOpts)
+}
+
+func (m *CloudProviderAwsSsm) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "aws-ssm"),
+	)
+
+	if m.opts.SsmParameterName == nil || *m.opts.SsmParameterName == "" {
+		return errors.New("no AWS SSM parameter name specified")
+	}
+
+	// expiration policy deletes the parameter with its whole history, previous tokens would be lost
+	if m.opts.SsmExpirationPolicy && opts.Sync.Full {
+		return errors.New("AWS SSM expiration policy can't be used with full sync (--sync.full), SSM deletes the parameter including all previous versions")
+	}
+
+	awsConfig, err := newAwsConfig(ctx, m.opts, userAgent)
+	if err != nil {
+		return err
+	}
+
+	m.ssmClient = ssm.NewFromConfig(awsConfig)
+
+	return nil
+}
+
+func (m *CloudProviderAwsSsm) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	parameterName := *m.opts.SsmParameterName
+
+	contextLogger := m.logger.With(slog.String("parameterName", parameterName))
+
+	contextLogger.Info("fetching current token from AWS SSM Parameter Store")
+	result, err := m.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(parameterName),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, m.handleSsmError(contextLogger, err)
+	}
+
+	if result.Parameter == nil || result.Parameter.Value == nil {
+		return
+	}
+
+	token = bootstraptoken.ParseFromString(*result.Parameter.Value)
+	if token == nil {
+		return
+	}
+
+	parameter, err := m.fetchParameterVersion(ctx, contextLogger, result.Parameter)
+	if err != nil {
+		return nil, err
+	}
+	m.updateTokenMeta(token, parameter)
+
+	return
+}
+
+func (m *CloudProviderAwsSsm) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+	parameterName := *m.opts.SsmParameterName
+
+	contextLogger := m.logger.With(slog.String("parameterName", parameterName))
+	contextLogger.Info("fetching all tokens from AWS SSM Parameter Store")
+
+	parameterHistory, err := m.fetchParameterHistory(ctx, contextLogger, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, parameter := range parameterHistory {
+		parameterLogger := contextLogger.With(slog.Int64("parameterVersion", parameter.Version))
+
+		if expires := awsSsmParameterExpiration(parameter); expires != nil && time.Now().After(*expires) {
+			// expired
+			continue
+		}
+
+		if parameter.Value != nil {
+			token := bootstraptoken.ParseFromString(*parameter.Value)
+			if token != nil {
+				parameterLogger.Info("found valid parameter")
+				m.updateTokenMeta(token, parameter)
+				tokens = append(tokens, token)
+			}
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderAwsSsm) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	parameterName := *m.opts.SsmParameterName
+
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("parameterName", parameterName),
+	)
+	contextLogger.Info("storing token to AWS SSM Parameter Store", slog.String("expiration", token.ExpirationString()))
+
+	parameterInput := ssm.PutParameterInput{
+		Name:        aws.String(parameterName),
+		Value:       aws.String(token.FullToken()),
+		Type:        types.ParameterTypeSecureString,
+		Description: aws.String("kube-bootstrap-token"),
+		Tags: []types.Tag{
+			{Key: aws.String("managed-by"), Value: aws.String("kube-bootstrap-token-manager")},
+		},
+	}
+
+	if m.opts.SsmKmsKeyId != nil && *m.opts.SsmKmsKeyId != "" {
+		parameterInput.KeyId = m.opts.SsmKmsKeyId
+	}
+
+	if m.opts.SsmExpirationPolicy && token.ExpirationTime() != nil {
+		policies, err := json.Marshal([]awsSsmParameterPolicy{
+			{
+				Type:    "Expiration",
+				Version: "1.0",
+				Attributes: map[string]string{
+					"Timestamp": token.ExpirationTime().UTC().Format(time.RFC3339),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		// parameter policies are only available for advanced parameters
+		parameterInput.Policies = aws.String(string(policies))
+		parameterInput.Tier = types.ParameterTierAdvanced
+	}
+
+	// try to create the parameter first (tags can only be set on creation)
+	result, err := m.ssmClient.PutParameter(ctx, &parameterInput)
+	if err != nil {
+		var alreadyExistsErr *types.ParameterAlreadyExists
+		if !errors.As(err, &alreadyExistsErr) {
+			return err
+		}
+
+		parameterInput.Tags = nil
+		parameterInput.Overwrite = aws.Bool(true)
+		result, err = m.ssmClient.PutParameter(ctx, &parameterInput)
+		if err != nil {
+			return err
+		}
+	}
+
+	// SSM has no per version metadata, so it's tracked as parameter labels
+	labels := []string{}
+	if token.CreationTime() != nil {
+		labels = append(labels, awsSsmLabelForTime(AWS_SSM_LABEL_CREATED_PREFIX, *token.CreationTime()))
+	}
+	if token.ExpirationTime() != nil {
+		labels = append(labels, awsSsmLabelForTime(AWS_SSM_LABEL_EXPIRES_PREFIX, *token.ExpirationTime()))
+	}
+
+	if len(labels) > 0 {
+		_, err = m.ssmClient.LabelParameterVersion(ctx, &ssm.LabelParameterVersionInput{
+			Name:             aws.String(parameterName),
+			ParameterVersion: aws.Int64(result.Version),
+			Labels:           labels,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	m.cleanupLabels(ctx, contextLogger)
+
+	return nil
+}
+
+// removes labels from expired and superseded versions, labeled versions are never removed by SSM
+// and would block new versions once the parameter history limit is reached
+func (m *CloudProviderAwsSsm) cleanupLabels(ctx context.Context, logger *slogger.Logger) {
+	parameterName := *m.opts.SsmParameterName
+
+	parameterHistory, err := m.fetchParameterHistory(ctx, logger, false)
+	if err != nil {
+		logger.Warn(`unable to fetch parameter history for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, parameter := range parameterHistory {
+		if len(parameter.Labels) == 0 {
+			continue
+		}
+
+		if retainVersion(num, awsSsmParameterExpiration(parameter)) {
+			continue
+		}
+
+		logger.Debug("removing labels from parameter version", slog.Int64("parameterVersion", parameter.Version))
+		_, err := m.ssmClient.UnlabelParameterVersion(ctx, &ssm.UnlabelParameterVersionInput{
+			Name:             aws.String(parameterName),
+			ParameterVersion: aws.Int64(parameter.Version),
+			Labels:           parameter.Labels,
+		})
+		if err != nil {
+			logger.Warn(`unable to remove labels from parameter version`, slog.Any("error", err))
+		}
+	}
+}
+
+// returns labels and policies of the parameter version (SSM only returns them as part of the parameter history),
+// history is fetched without decryption as the value is already known
+func (m *CloudProviderAwsSsm) fetchParameterVersion(ctx context.Context, logger *slogger.Logger, parameter *types.Parameter) (types.ParameterHistory, error) {
+	parameterHistory, err := m.fetchParameterHistory(ctx, logger, false)
+	if err != nil {
+		return types.ParameterHistory{}, err
+	}
+
+	for _, row := range parameterHistory {
+		if row.Version == parameter.Version {
+			row.Value = parameter.Value
+			return row, nil
+		}
+	}
+
+	// version not in history (eg. parameter was updated in between)
+	return types.ParameterHistory{
+		Name:             parameter.Name,
+		Value:            parameter.Value,
+		Version:          parameter.Version,
+		LastModifiedDate: parameter.LastModifiedDate,
+	}, nil
+}
+
+// fetches all parameter versions, sorted by version (newest first), values are only decrypted if needed
+func (m *CloudProviderAwsSsm) fetchParameterHistory(ctx context.Context, logger *slogger.Logger, withDecryption bool) (parameterHistory []types.ParameterHistory, err error) {
+	parameterHistory = []types.ParameterHistory{}
+
+	pager := ssm.NewGetParameterHistoryPaginator(m.ssmClient, &ssm.GetParameterHistoryInput{
+		Name:           m.opts.SsmParameterName,
+		WithDecryption: aws.Bool(withDecryption),
+	})
+	for pager.HasMorePages() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return parameterHistory, m.handleSsmError(logger, err)
+		}
+
+		parameterHistory = append(parameterHistory, result.Parameters...)
+	}
+
+	sort.Slice(parameterHistory, func(i, j int) bool {
+		return parameterHistory[i].Version > parameterHistory[j].Version
+	})
+
+	return
+}
+
+func (m *CloudProviderAwsSsm) updateTokenMeta(token *bootstraptoken.BootstrapToken, parameter types.ParameterHistory) {
+	created := awsSsmLabelTime(AWS_SSM_LABEL_CREATED_PREFIX, parameter.Labels)
+	if created == nil {
+		created = parameter.LastModifiedDate
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	expires := awsSsmParameterExpiration(parameter)
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "aws-ssm")
+	token.SetAnnotation("bootstraptoken.webdevops.io/parameter", aws.ToString(parameter.Name))
+	token.SetAnnotation("bootstraptoken.webdevops.io/parameterVersion", strconv.FormatInt(parameter.Version, 10))
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+}
+
+func (m *CloudProviderAwsSsm) handleSsmError(logger *slogger.Logger, err error) error {
+	code := awsErrorCode(err)
+	return handleFetchError(logger, err, code == "ParameterNotFound", code == "AccessDeniedException", "parameter", "unable to access AWS SSM Parameter Store, please check access")
+}
+
+// returns expiration of parameter version, either from label or from expiration policy
+func awsSsmParameterExpiration(parameter types.ParameterHistory) *time.Time {
+	if expires := awsSsmLabelTime(AWS_SSM_LABEL_EXPIRES_PREFIX, parameter.Labels); expires != nil {
+		return expires
+	}
+
+	for _, policy := range parameter.Policies {
+		if aws.ToString(policy.PolicyType) != "Expiration" || policy.PolicyText == nil {
+			continue
+		}
+
+		parameterPolicy := awsSsmParameterPolicy{}
+		if err := json.Unmarshal([]byte(*policy.PolicyText), &parameterPolicy); err != nil {
+			continue
+		}
+
+		if expires, err := time.Parse(time.RFC3339, parameterPolicy.Attributes["Timestamp"]); err == nil {
+			return &expires
+		}
+	}
+
+	return nil
+}
+
+func awsSsmLabelForTime(prefix string, val time.Time) string {
+	return fmt.Sprintf("%s%d", prefix, val.Unix())
+}
+
+func awsSsmLabelTime(prefix string, labels []string) *time.Time {
+	for _, label := range labels {
+		if timestamp, ok := strings.CutPrefix(label, prefix); ok {
+			if val, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+				ret := time.Unix(val, 0).UTC()
+				return &ret
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	// page size of parameter history (real limit is 50), small to test pagination
+	testSsmHistoryPageSize = 5
+)
+
+type (
+	// fakeSsm is a minimal in-memory AWS SSM Parameter Store (JSON protocol) for one SecureString parameter
+	fakeSsm struct {
+		server *httptest.Server
+
+		lock     sync.Mutex
+		tags     map[string]string
+		versions []*fakeSsmVersion
+		clock    time.Time
+
+		// number of parameter history requests with decryption
+		decryptedHistoryRequests int
+
+		// optional error type returned for all requests
+		fail string
+	}
+
+	fakeSsmVersion struct {
+		Version          int64
+		Value            string
+		Labels           []string
+		Policies         []interface{}
+		LastModifiedDate time.Time
+	}
+)
+
+func newFakeSsm(t *testing.T) *fakeSsm {
+	t.Helper()
+	ssm := &fakeSsm{
+		clock: time.Now().Add(-time.Hour).Truncate(time.Second),
+	}
+	ssm.server = httptest.NewServer(http.HandlerFunc(ssm.serveHTTP))
+	t.Cleanup(ssm.server.Close)
+	return ssm
+}
+
+func (ssm *fakeSsm) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ssm.lock.Lock()
+	defer ssm.lock.Unlock()
+
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	input := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		ssm.writeError(w, "ValidationException")
+		return
+	}
+
+	if ssm.fail != "" {
+		ssm.writeError(w, ssm.fail)
+		return
+	}
+
+	if operation != "PutParameter" && len(ssm.versions) == 0 {
+		ssm.writeError(w, "ParameterNotFound")
+		return
+	}
+
+	switch operation {
+	case "PutParameter":
+		if len(ssm.versions) > 0 && input["Overwrite"] != true {
+			ssm.writeError(w, "ParameterAlreadyExists")
+			return
+		}
+		if len(ssm.versions) > 0 && input["Tags"] != nil {
+			// tags can only be set on creation
+			ssm.writeError(w, "ValidationException")
+			return
+		}
+		if ssm.tags == nil {
+			ssm.tags = map[string]string{}
+			for _, tag := range input["Tags"].([]interface{}) {
+				ssm.tags[tag.(map[string]interface{})["Key"].(string)] = tag.(map[string]interface{})["Value"].(string)
+			}
+		}
+
+		ssm.clock = ssm.clock.Add(time.Second)
+		version := &fakeSsmVersion{
+			Version:          int64(len(ssm.versions) + 1),
+			Value:            input["Value"].(string),
+			LastModifiedDate: ssm.clock,
+		}
+		if policies, ok := input["Policies"].(string); ok {
+			if err := json.Unmarshal([]byte(policies), &version.Policies); err != nil {
+				ssm.writeError(w, "InvalidPolicyAttributeException")
+				return
+			}
+		}
+		ssm.versions = append(ssm.versions, version)
+		ssm.writeJSON(w, map[string]interface{}{"Version": version.Version, "Tier": "Standard"})
+	case "GetParameter":
+		version := ssm.versions[len(ssm.versions)-1]
+		ssm.writeJSON(w, map[string]interface{}{"Parameter": map[string]interface{}{
+			"Name":             input["Name"],
+			"Type":             "SecureString",
+			"Value":            ssm.value(version, input["WithDecryption"] == true),
+			"Version":          version.Version,
+			"LastModifiedDate": version.LastModifiedDate.Unix(),
+		}})
+	case "GetParameterHistory":
+		if input["WithDecryption"] == true {
+			ssm.decryptedHistoryRequests++
+		}
+
+		start := 0
+		if nextToken, ok := input["NextToken"].(string); ok {
+			start, _ = strconv.Atoi(nextToken)
+		}
+		end := min(start+testSsmHistoryPageSize, len(ssm.versions))
+
+		// history is returned oldest first
+		parameters := []map[string]interface{}{}
+		for _, version := range ssm.versions[start:end] {
+			policies := []map[string]interface{}{}
+			for _, policy := range version.Policies {
+				policyText, _ := json.Marshal(policy)
+				policies = append(policies, map[string]interface{}{
+					"PolicyText":   string(policyText),
+					"PolicyType":   policy.(map[string]interface{})["Type"],
+					"PolicyStatus": "Pending",
+				})
+			}
+			parameters = append(parameters, map[string]interface{}{
+				"Name":             input["Name"],
+				"Type":             "SecureString",
+				"Value":            ssm.value(version, input["WithDecryption"] == true),
+				"Version":          version.Version,
+				"Labels":           version.Labels,
+				"Policies":         policies,
+				"LastModifiedDate": version.LastModifiedDate.Unix(),
+			})
+		}
+
+		result := map[string]interface{}{"Parameters": parameters}
+		if end < len(ssm.versions) {
+			result["NextToken"] = strconv.Itoa(end)
+		}
+		ssm.writeJSON(w, result)
+	case "LabelParameterVersion":
+		target := ssm.version(input["ParameterVersion"])
+		if target == nil {
+			ssm.writeError(w, "ParameterVersionNotFound")
+			return
+		}
+		for _, label := range input["Labels"].([]interface{}) {
+			// labels are unique per parameter, label is moved from previous version
+			for _, version := range ssm.versions {
+				version.Labels = slices.DeleteFunc(version.Labels, func(val string) bool { return val == label.(string) })
+			}
+			target.Labels = append(target.Labels, label.(string))
+		}
+		ssm.writeJSON(w, map[string]interface{}{"InvalidLabels": []string{}, "ParameterVersion": target.Version})
+	case "UnlabelParameterVersion":
+		target := ssm.version(input["ParameterVersion"])
+		if target == nil {
+			ssm.writeError(w, "ParameterVersionNotFound")
+			return
+		}
+		removed := []string{}
+		for _, label := range input["Labels"].([]interface{}) {
+			if slices.Contains(target.Labels, label.(string)) {
+				removed = append(removed, label.(string))
+			}
+			target.Labels = slices.DeleteFunc(target.Labels, func(val string) bool { return val == label.(string) })
+		}
+		ssm.writeJSON(w, map[string]interface{}{"InvalidLabels": []string{}, "RemovedLabels": removed})
+	default:
+		ssm.writeError(w, "ValidationException")
+	}
+}
+
+// value returns value of version, encrypted values are returned as ciphertext placeholder
+func (ssm *fakeSsm) value(version *fakeSsmVersion, withDecryption bool) string {
+	if !withDecryption {
+		return "encrypted-" + strconv.FormatInt(version.Version, 10)
+	}
+	return version.Value
+}
+
+func (ssm *fakeSsm) version(val interface{}) *fakeSsmVersion {
+	num, ok := val.(float64)
+	if !ok || num < 1 || int(num) > len(ssm.versions) {
+		return nil
+	}
+	return ssm.versions[int(num)-1]
+}
+
+func (ssm *fakeSsm) labeledVersions() int {
+	ssm.lock.Lock()
+	defer ssm.lock.Unlock()
+	count := 0
+	for _, version := range ssm.versions {
+		if len(version.Labels) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (ssm *fakeSsm) writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (ssm *fakeSsm) writeError(w http.ResponseWriter, errorType string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-ErrorType", errorType)
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"__type": errorType, "message": "fake error"})
+}
+
+func newTestAwsSsmProvider(t *testing.T, ssm *fakeSsm) *CloudProviderAwsSsm {
+	t.Helper()
+	setTestAwsEnvironment(t)
+
+	m := &CloudProviderAwsSsm{
+		opts: &awsOptions{
+			Region:           stringPtr("eu-central-1"),
+			Endpoint:         stringPtr(ssm.server.URL),
+			SsmParameterName: stringPtr("/kube-bootstrap-token"),
+		},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAwsSsmStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	ssm := newFakeSsm(t)
+	m := newTestAwsSsmProvider(t, ssm)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing parameter must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	first := newTestToken("aaaaaa", "0123456789abcdef")
+	stored := newTestToken("bbbbbb", "0123456789abcdef")
+	stored.SetCreationTime(stored.CreationTime().Add(time.Minute))
+	stored.SetExpirationTime(stored.ExpirationTime().Add(time.Minute))
+	for _, storeToken := range []*bootstraptoken.BootstrapToken{first, stored} {
+		if err := m.StoreToken(ctx, storeToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ssm.tags["managed-by"] != "kube-bootstrap-token-manager" {
+		t.Fatalf("expected managed-by tag on parameter, got %v", ssm.tags)
+	}
+
+	ssm.decryptedHistoryRequests = 0
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration from labels, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+	if token.Annotations()["bootstraptoken.webdevops.io/parameterVersion"] != "2" {
+		t.Fatalf("expected parameter version 2, got %v", token.Annotations())
+	}
+	if ssm.decryptedHistoryRequests != 0 {
+		t.Fatalf("current token must not decrypt parameter history, got %d requests", ssm.decryptedHistoryRequests)
+	}
+}
+
+func TestAwsSsmStoreTokenCleansUpLabels(t *testing.T) {
+	ctx := context.Background()
+	ssm := newFakeSsm(t)
+	m := newTestAwsSsmProvider(t, ssm)
+
+	expired := newTestToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		// labels are unique per parameter, so every token needs its own creation and expiration
+		token := newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")
+		token.SetCreationTime(token.CreationTime().Add(time.Duration(num) * time.Minute))
+		token.SetExpirationTime(token.ExpirationTime().Add(time.Duration(num) * time.Minute))
+		if err := m.StoreToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the latest SECRET_SYNC_COUNT_MAX valid versions keep their labels
+	if count := ssm.labeledVersions(); count != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d labeled versions, got %d", SECRET_SYNC_COUNT_MAX, count)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.Id() == "expire" {
+			t.Fatal("expired token must not be fetched")
+		}
+	}
+}
+
+func TestAwsSsmFetchTokenAccessDenied(t *testing.T) {
+	ssm := newFakeSsm(t)
+	m := newTestAwsSsmProvider(t, ssm)
+	ssm.fail = "AccessDeniedException"
+
+	if _, err := m.FetchToken(context.Background()); err == nil || awsErrorCode(err) != "AccessDeniedException" {
+		t.Fatalf("expected access denied error, got %v", err)
+	}
+	if _, err := m.FetchTokens(context.Background()); err == nil {
+		t.Fatal("expected error without access")
+	}
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
+
+func TestAwsSsmInitRejectsExpirationPolicyWithFullSync(t *testing.T) {
+	setTestAwsEnvironment(t)
+
+	newProvider := func() *CloudProviderAwsSsm {
+		return &CloudProviderAwsSsm{
+			opts: &awsOptions{
+				Region:              stringPtr("eu-central-1"),
+				SsmParameterName:    stringPtr("/kube-bootstrap-token"),
+				SsmExpirationPolicy: true,
+			},
+		}
+	}
+
+	opts := config.Opts{}
+	if err := newProvider().Init(context.Background(), opts, newTestLogger(), "test"); err != nil {
+		t.Fatalf("expected expiration policy without full sync to be accepted, got %v", err)
+	}
+
+	opts.Sync.Full = true
+	if err := newProvider().Init(context.Background(), opts, newTestLogger(), "test"); err == nil {
+		t.Fatal("expected expiration policy with full sync to be rejected")
+	}
+}
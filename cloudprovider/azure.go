@@ -3,11 +3,18 @@ package cloudprovider
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"sort"
+	"strconv"
+	"text/template"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
 	"github.com/webdevops/go-common/azuresdk/armclient"
 	"github.com/webdevops/go-common/log/slogger"
@@ -17,65 +24,167 @@ import (
 )
 
 const (
-	SECRET_SYNC_COUNT_MAX = 15
+	AZURE_KEYVAULT_MANAGED_BY = "kube-bootstrap-token-manager"
+
+	AZURE_KEYVAULT_TAG_MANAGED_BY = "managed-by"
+	AZURE_KEYVAULT_TAG_TOKEN      = "token"
+	AZURE_KEYVAULT_TAG_CLUSTER    = "cluster"
+	AZURE_KEYVAULT_TAG_RETIRED    = "retired"
+)
+
+var (
+	// ErrKeyvaultThrottled is returned if Azure KeyVault is still throttling requests (HTTP 429) after all retries
+	ErrKeyvaultThrottled = errors.New("request throttled by Azure KeyVault")
+
+	// ErrKeyvaultTransient is returned if Azure KeyVault is still not available (HTTP 408, 5xx, connection errors) after all retries
+	ErrKeyvaultTransient = errors.New("azure KeyVault temporarily not available")
+
+	// ErrKeyvaultAuth is returned if authentication to Azure KeyVault failed
+	ErrKeyvaultAuth = errors.New("authentication to Azure KeyVault failed")
+
+	// ErrKeyvaultForbidden is returned if access is denied by Azure KeyVault access policy, RBAC or network rules
+	ErrKeyvaultForbidden = errors.New("access to Azure KeyVault forbidden")
+
+	// ErrKeyvaultRequest is returned for all other (permanent) Azure KeyVault errors
+	ErrKeyvaultRequest = errors.New("request to Azure KeyVault failed")
 )
 
 type (
 	CloudProviderAzure struct {
 		CloudProvider
 
-		opts config.Opts
-		ctx  context.Context
+		opts *azureOptions
 
 		logger *slogger.Logger
 		client *armclient.ArmClient
 
 		keyvaultClient *azsecrets.Client
+
+		// VM Scale Set clients use own credential and options (ARM endpoint can be overridden, see --azure.vmss.endpoint)
+		vmssTemplate      *template.Template
+		vmssCred          azcore.TokenCredential
+		vmssClientOptions *arm.ClientOptions
 	}
+
+	// KeyvaultError is a classified Azure KeyVault error, use errors.Is with ErrKeyvault* to check the kind
+	KeyvaultError struct {
+		Kind       error
+		StatusCode int
+		ErrorCode  string
+		RetryAfter time.Duration
+		Err        error
+	}
+
+	// options of Azure KeyVault cloud provider (including VM Scale Set update)
+	azureOptions struct {
+		KeyVaultUrl             *string       `long:"azure.keyvault.url"               env:"AZURE_KEYVAULT_URL"               description:"URL of Keyvault to sync token"`
+		KeyVaultSecretName      *string       `long:"azure.keyvault.secret"            env:"AZURE_KEYVAULT_SECRET"            description:"Name of Keyvault secret to sync token" default:"kube-bootstrap-token"`
+		KeyVaultDiscovery       bool          `long:"azure.keyvault.discovery"         env:"AZURE_KEYVAULT_DISCOVERY"         description:"Discover all Keyvault secrets tagged with managed-by=kube-bootstrap-token-manager on full sync (in addition to --azure.keyvault.secret)"`
+		KeyVaultClusterTag      string        `long:"azure.keyvault.cluster-tag"       env:"AZURE_KEYVAULT_CLUSTER_TAG"       description:"Value of cluster tag written to Keyvault secret and used as filter for discovery (tag cluster=<value>)"`
+		KeyVaultHistoryCount    uint          `long:"azure.keyvault.history.count"     env:"AZURE_KEYVAULT_HISTORY_COUNT"     description:"Number of (valid) Keyvault secret versions to sync on full sync (0 = unlimited)" default:"15"`
+		KeyVaultHistoryMaxAge   time.Duration `long:"azure.keyvault.history.max-age"   env:"AZURE_KEYVAULT_HISTORY_MAX_AGE"   description:"Maximum age (time.Duration) of Keyvault secret versions to sync on full sync (0 = unlimited)" default:"0s"`
+		KeyVaultRetryMax        int32         `long:"azure.keyvault.retry.max"         env:"AZURE_KEYVAULT_RETRY_MAX"         description:"Maximum retries of throttled (429) and transient (408, 5xx) Keyvault requests" default:"5"`
+		KeyVaultRetryDelay      time.Duration `long:"azure.keyvault.retry.delay"       env:"AZURE_KEYVAULT_RETRY_DELAY"       description:"Initial delay (time.Duration) of exponential backoff for Keyvault retries (Retry-After header takes precedence)" default:"1s"`
+		KeyVaultRetryMaxDelay   time.Duration `long:"azure.keyvault.retry.max-delay"   env:"AZURE_KEYVAULT_RETRY_MAX_DELAY"   description:"Maximum delay (time.Duration) between Keyvault retries" default:"60s"`
+		KeyVaultRetireDisable   bool          `long:"azure.keyvault.retire.disable"    env:"AZURE_KEYVAULT_RETIRE_DISABLE"    description:"Disable retired Keyvault secret versions after rotation (expired or older than retention)"`
+		KeyVaultRetireTag       bool          `long:"azure.keyvault.retire.tag"        env:"AZURE_KEYVAULT_RETIRE_TAG"        description:"Tag retired Keyvault secret versions after rotation (tag retired=<time>, retired versions are not synced)"`
+		KeyVaultRetireRetention time.Duration `long:"azure.keyvault.retire.retention"  env:"AZURE_KEYVAULT_RETIRE_RETENTION"  description:"Retention period (time.Duration) after which Keyvault secret versions are retired even if not expired (0 = only expired versions)" default:"0s"`
+
+		Vmss                 []string `long:"azure.vmss"                     env:"AZURE_VMSS"                      env-delim:" "  description:"Resource IDs of VM Scale Sets to update with rotated token (custom data or extension protected settings)"`
+		VmssEndpoint         string   `long:"azure.vmss.endpoint"            env:"AZURE_VMSS_ENDPOINT"             description:"Azure Resource Manager endpoint (https URL) for VM Scale Set updates (eg. Azure Stack Hub, uses endpoint of Azure environment if empty)"`
+		VmssTemplateFile     string   `long:"azure.vmss.template-file"       env:"AZURE_VMSS_TEMPLATE_FILE"        description:"Path to template (text/template, token is passed as .) rendered as VM Scale Set custom data or extension protected settings (JSON)"`
+		VmssExtension        string   `long:"azure.vmss.extension"           env:"AZURE_VMSS_EXTENSION"            description:"Name of VM Scale Set extension (eg. CustomScript) to update protected settings instead of custom data"`
+		VmssUpgrade          bool     `long:"azure.vmss.upgrade"             env:"AZURE_VMSS_UPGRADE"              description:"Upgrade existing VM Scale Set instances to latest model after update (only for manual upgrade policy)"`
+		VmssUpgradeBatchSize int      `long:"azure.vmss.upgrade.batch-size"  env:"AZURE_VMSS_UPGRADE_BATCH_SIZE"   description:"Number of VM Scale Set instances upgraded at once" default:"1"`
+	}
+)
+
+var (
+	azureOpts = &azureOptions{}
 )
 
-func (m *CloudProviderAzure) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) {
+func init() {
+	Register("azure", func() CloudProvider {
+		return &CloudProviderAzure{opts: azureOpts}
+	})
+	RegisterOptions("azure", azureOpts)
+}
+
+func (e *KeyvaultError) Error() string {
+	msg := e.Kind.Error()
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d", e.StatusCode)
+		if e.ErrorCode != "" {
+			msg += fmt.Sprintf(", code %s", e.ErrorCode)
+		}
+		msg += ")"
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+func (e *KeyvaultError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+func (m *CloudProviderAzure) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
 	var err error
-	m.ctx = ctx
-	m.opts = opts
 	m.logger = logger.With(
 		slog.String("cloudprovider", "azure"),
 	)
 
 	m.client, err = armclient.NewArmClientFromEnvironment(logger.Slog())
 	if err != nil {
-		logger.Fatal(err.Error())
+		return err
 	}
 	m.client.SetUserAgent(userAgent)
 
-	if m.opts.CloudProvider.Azure.KeyVaultUrl == nil || *m.opts.CloudProvider.Azure.KeyVaultUrl == "" {
-		m.logger.Panic("no Azure KeyVault name specified")
+	if m.opts.KeyVaultUrl == nil || *m.opts.KeyVaultUrl == "" {
+		return errors.New("no Azure KeyVault name specified")
 	}
 
-	if m.opts.CloudProvider.Azure.KeyVaultSecretName == nil || *m.opts.CloudProvider.Azure.KeyVaultSecretName == "" {
-		m.logger.Panic("no Azure KeyVault secret name specified")
+	if m.opts.KeyVaultSecretName == nil || *m.opts.KeyVaultSecretName == "" {
+		return errors.New("no Azure KeyVault secret name specified")
 	}
 
-	// keyvault client
-	secretOpts := azsecrets.ClientOptions{
+	m.keyvaultClient, err = m.newKeyvaultClient(m.client.GetCred(), &azsecrets.ClientOptions{
 		ClientOptions: *m.client.NewAzCoreClientOptions(),
-	}
-	m.keyvaultClient, err = azsecrets.NewClient(*m.opts.CloudProvider.Azure.KeyVaultUrl, m.client.GetCred(), &secretOpts)
+	})
 	if err != nil {
-		m.logger.Panic(err.Error())
+		return err
 	}
+
+	return m.initScaleSets(m.client.GetCred(), m.client.NewArmClientOptions())
 }
 
-func (m *CloudProviderAzure) FetchToken() (token *bootstraptoken.BootstrapToken) {
-	vaultUrl := *m.opts.CloudProvider.Azure.KeyVaultUrl
-	secretName := *m.opts.CloudProvider.Azure.KeyVaultSecretName
+// newKeyvaultClient creates the Key Vault client, throttled (429) and transient (408, 5xx) requests
+// are retried with exponential backoff, Retry-After is honored
+func (m *CloudProviderAzure) newKeyvaultClient(cred azcore.TokenCredential, secretOpts *azsecrets.ClientOptions) (*azsecrets.Client, error) {
+	secretOpts.Retry = policy.RetryOptions{
+		MaxRetries:    m.opts.KeyVaultRetryMax,
+		RetryDelay:    m.opts.KeyVaultRetryDelay,
+		MaxRetryDelay: m.opts.KeyVaultRetryMaxDelay,
+		StatusCodes: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+	return azsecrets.NewClient(*m.opts.KeyVaultUrl, cred, secretOpts)
+}
+
+func (m *CloudProviderAzure) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	vaultUrl := *m.opts.KeyVaultUrl
+	secretName := *m.opts.KeyVaultSecretName
 
 	contextLogger := m.logger.With(slog.String("keyVault", vaultUrl), slog.String("secretName", secretName))
 
 	contextLogger.Info("fetching current token from Azure KeyVault")
-	secret, err := m.keyvaultClient.GetSecret(m.ctx, secretName, "", nil)
-	if m.handleKeyvaultError(contextLogger, err) != nil {
-		contextLogger.Panic(err.Error())
+	secret, err := m.keyvaultClient.GetSecret(ctx, secretName, "", nil)
+	if err != nil {
+		return nil, m.handleKeyvaultError(contextLogger, err)
 	}
 
 	if secret.Value != nil {
@@ -101,25 +210,95 @@ func (m *CloudProviderAzure) FetchToken() (token *bootstraptoken.BootstrapToken)
 	return
 }
 
-func (m *CloudProviderAzure) FetchTokens() (tokens []*bootstraptoken.BootstrapToken) {
+func (m *CloudProviderAzure) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
 	tokens = []*bootstraptoken.BootstrapToken{}
-	vaultUrl := *m.opts.CloudProvider.Azure.KeyVaultUrl
-	secretName := *m.opts.CloudProvider.Azure.KeyVaultSecretName
+	vaultUrl := *m.opts.KeyVaultUrl
+	secretName := *m.opts.KeyVaultSecretName
 
 	contextLogger := m.logger.With(slog.String("keyVault", vaultUrl), slog.String("secretName", secretName))
 	contextLogger.Info("fetching all tokens from Azure KeyVault")
 
+	tokens, err = m.fetchSecretTokens(ctx, contextLogger, secretName)
+	if err != nil || !m.opts.KeyVaultDiscovery {
+		return
+	}
+
+	discoveredSecretList, err := m.discoverSecrets(ctx, contextLogger)
+	if err != nil {
+		return tokens, err
+	}
+
+	for _, discoveredSecretName := range discoveredSecretList {
+		if discoveredSecretName == secretName {
+			continue
+		}
+
+		secretLogger := m.logger.With(slog.String("keyVault", vaultUrl), slog.String("secretName", discoveredSecretName))
+		secretLogger.Info("fetching all tokens from discovered Azure KeyVault secret")
+		secretTokens, err := m.fetchSecretTokens(ctx, secretLogger, discoveredSecretName)
+		if err != nil {
+			secretLogger.Warn(`unable to fetch tokens from discovered secret`, slog.Any("error", err))
+			continue
+		}
+		tokens = append(tokens, secretTokens...)
+	}
+
+	return tokens, nil
+}
+
+// discoverSecrets returns the names of all secrets tagged as managed by kube-bootstrap-token-manager
+// (and optionally tagged with the cluster tag)
+func (m *CloudProviderAzure) discoverSecrets(ctx context.Context, logger *slogger.Logger) ([]string, error) {
+	clusterTag := m.opts.KeyVaultClusterTag
+
+	secretList := []string{}
+	pager := m.keyvaultClient.NewListSecretPropertiesPager(nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, m.handleKeyvaultError(logger, err)
+		}
+
+		for _, secret := range result.Value {
+			if secret.ID == nil || secret.Attributes == nil || secret.Attributes.Enabled == nil || !*secret.Attributes.Enabled {
+				continue
+			}
+
+			if stringPtrValue(secret.Tags[AZURE_KEYVAULT_TAG_MANAGED_BY]) != AZURE_KEYVAULT_MANAGED_BY {
+				continue
+			}
+
+			if clusterTag != "" && stringPtrValue(secret.Tags[AZURE_KEYVAULT_TAG_CLUSTER]) != clusterTag {
+				continue
+			}
+
+			secretList = append(secretList, secret.ID.Name())
+		}
+	}
+
+	logger.Info("discovered Azure KeyVault secrets", slog.Int("secrets", len(secretList)), slog.String("cluster", clusterTag))
+	return secretList, nil
+}
+
+// fetchSecretTokens returns the tokens of all valid versions (inside history window) of a secret
+func (m *CloudProviderAzure) fetchSecretTokens(ctx context.Context, contextLogger *slogger.Logger, secretName string) ([]*bootstraptoken.BootstrapToken, error) {
+	tokens := []*bootstraptoken.BootstrapToken{}
+
+	historyCount := m.opts.KeyVaultHistoryCount
+	historyMaxAge := m.opts.KeyVaultHistoryMaxAge
+
+	// list only version properties first (no secret values), Key Vault doesn't return versions ordered
+	// so all pages are needed to find the latest versions
 	pager := m.keyvaultClient.NewListSecretPropertiesVersionsPager(secretName, nil)
-	// get secrets first
 	secretCandidateList := []*azsecrets.SecretProperties{}
 	for pager.More() {
-		result, err := pager.NextPage(m.ctx)
+		result, err := pager.NextPage(ctx)
 		if err != nil {
-			m.logger.Panic(err.Error())
+			return tokens, m.handleKeyvaultError(contextLogger, err)
 		}
 
 		for _, secretVersion := range result.Value {
-			if !*secretVersion.Attributes.Enabled {
+			if secretVersion.Attributes == nil || secretVersion.Attributes.Enabled == nil || !*secretVersion.Attributes.Enabled {
 				continue
 			}
 
@@ -133,21 +312,39 @@ func (m *CloudProviderAzure) FetchTokens() (tokens []*bootstraptoken.BootstrapTo
 				continue
 			}
 
+			if _, retired := secretVersion.Tags[AZURE_KEYVAULT_TAG_RETIRED]; retired {
+				// retired by previous rotation
+				continue
+			}
+
+			if historyMaxAge > 0 && secretVersion.Attributes.Created != nil && time.Since(*secretVersion.Attributes.Created) > historyMaxAge {
+				// outside of history window
+				continue
+			}
+
 			secretCandidateList = append(secretCandidateList, secretVersion)
 		}
 	}
 
 	// sort results
 	sort.Slice(secretCandidateList, func(i, j int) bool {
-		return secretCandidateList[i].Attributes.Created.UTC().After(secretCandidateList[j].Attributes.Created.UTC())
+		return azureSecretCreated(secretCandidateList[i]).After(azureSecretCreated(secretCandidateList[j]))
 	})
 
-	// process list
-	secretCounter := 0
+	if historyCount > 0 && len(secretCandidateList) > int(historyCount) {
+		contextLogger.Debug(
+			"skipping secret versions outside of history window",
+			slog.Int("versions", len(secretCandidateList)),
+			slog.Uint64("historyCount", uint64(historyCount)),
+		)
+		secretCandidateList = secretCandidateList[:historyCount]
+	}
+
+	// fetch secret values only for versions inside history window
 	for _, secretVersion := range secretCandidateList {
 		secretLogger := contextLogger.With(slog.String("secretVersion", secretVersion.ID.Version()))
 
-		secret, err := m.keyvaultClient.GetSecret(m.ctx, secretVersion.ID.Name(), secretVersion.ID.Version(), nil)
+		secret, err := m.keyvaultClient.GetSecret(ctx, secretVersion.ID.Name(), secretVersion.ID.Version(), nil)
 		if err != nil {
 			secretLogger.Warn(`unable to fetch secret`, slog.Any("error", err))
 			continue
@@ -171,19 +368,14 @@ func (m *CloudProviderAzure) FetchTokens() (tokens []*bootstraptoken.BootstrapTo
 				tokens = append(tokens, token)
 			}
 		}
-
-		secretCounter++
-		if secretCounter > SECRET_SYNC_COUNT_MAX {
-			break
-		}
 	}
 
-	return
+	return tokens, nil
 }
 
-func (m *CloudProviderAzure) StoreToken(token *bootstraptoken.BootstrapToken) {
-	vaultUrl := *m.opts.CloudProvider.Azure.KeyVaultUrl
-	secretName := *m.opts.CloudProvider.Azure.KeyVaultSecretName
+func (m *CloudProviderAzure) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	vaultUrl := *m.opts.KeyVaultUrl
+	secretName := *m.opts.KeyVaultSecretName
 
 	contextLogger := m.logger.With(
 		slog.String("token", token.Id()),
@@ -195,8 +387,8 @@ func (m *CloudProviderAzure) StoreToken(token *bootstraptoken.BootstrapToken) {
 	secretParameters := azsecrets.SetSecretParameters{
 		Value: stringPtr(token.FullToken()),
 		Tags: map[string]*string{
-			"managed-by": stringPtr("kube-bootstrap-token-manager"),
-			"token":      stringPtr(token.Id()),
+			AZURE_KEYVAULT_TAG_MANAGED_BY: stringPtr(AZURE_KEYVAULT_MANAGED_BY),
+			AZURE_KEYVAULT_TAG_TOKEN:      stringPtr(token.Id()),
 		},
 		ContentType: stringPtr("kube-bootstrap-token"),
 		SecretAttributes: &azsecrets.SecretAttributes{
@@ -205,15 +397,85 @@ func (m *CloudProviderAzure) StoreToken(token *bootstraptoken.BootstrapToken) {
 		},
 	}
 
-	_, err := m.keyvaultClient.SetSecret(m.ctx, secretName, secretParameters, nil)
+	if clusterTag := m.opts.KeyVaultClusterTag; clusterTag != "" {
+		secretParameters.Tags[AZURE_KEYVAULT_TAG_CLUSTER] = stringPtr(clusterTag)
+	}
+
+	secret, err := m.keyvaultClient.SetSecret(ctx, secretName, secretParameters, nil)
 	if err != nil {
-		m.logger.Panic(err.Error())
+		return m.parseAzCoreResponseError(err)
+	}
+
+	if m.opts.KeyVaultRetireDisable || m.opts.KeyVaultRetireTag {
+		m.retireSecretVersions(ctx, contextLogger, secret.ID.Version())
+	}
+
+	return nil
+}
+
+// retires (disables and/or tags) secret versions which are expired or older than the retention period,
+// current version is never retired
+func (m *CloudProviderAzure) retireSecretVersions(ctx context.Context, logger *slogger.Logger, currentVersion string) {
+	secretName := *m.opts.KeyVaultSecretName
+	retention := m.opts.KeyVaultRetireRetention
+	disable := m.opts.KeyVaultRetireDisable
+	tag := m.opts.KeyVaultRetireTag
+
+	pager := m.keyvaultClient.NewListSecretPropertiesVersionsPager(secretName, nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			logger.Warn(`unable to list secret versions for retirement`, slog.Any("error", err))
+			return
+		}
+
+		for _, secretVersion := range result.Value {
+			if secretVersion.ID == nil || secretVersion.Attributes == nil || secretVersion.ID.Version() == currentVersion {
+				continue
+			}
+
+			expired := secretVersion.Attributes.Expires != nil && time.Now().After(*secretVersion.Attributes.Expires)
+			outdated := retention > 0 && secretVersion.Attributes.Created != nil && time.Since(*secretVersion.Attributes.Created) > retention
+			if !expired && !outdated {
+				continue
+			}
+
+			_, tagged := secretVersion.Tags[AZURE_KEYVAULT_TAG_RETIRED]
+			enabled := secretVersion.Attributes.Enabled == nil || *secretVersion.Attributes.Enabled
+
+			parameters := azsecrets.UpdateSecretPropertiesParameters{}
+			if disable && enabled {
+				parameters.SecretAttributes = &azsecrets.SecretAttributes{
+					Enabled: boolPtr(false),
+				}
+			}
+
+			if tag && !tagged {
+				// tags are replaced on update, so existing tags need to be passed again
+				parameters.Tags = map[string]*string{}
+				for tagName, tagValue := range secretVersion.Tags {
+					parameters.Tags[tagName] = tagValue
+				}
+				parameters.Tags[AZURE_KEYVAULT_TAG_RETIRED] = stringPtr(time.Now().UTC().Format(time.RFC3339))
+			}
+
+			if parameters.SecretAttributes == nil && parameters.Tags == nil {
+				// already retired
+				continue
+			}
+
+			secretLogger := logger.With(slog.String("secretVersion", secretVersion.ID.Version()), slog.Bool("expired", expired))
+			secretLogger.Info("retiring secret version", slog.Bool("disable", parameters.SecretAttributes != nil), slog.Bool("tag", parameters.Tags != nil))
+			if _, err := m.keyvaultClient.UpdateSecretProperties(ctx, secretName, secretVersion.ID.Version(), parameters, nil); err != nil {
+				secretLogger.Warn(`unable to retire secret version`, slog.Any("error", err))
+			}
+		}
 	}
 }
 
 func (m *CloudProviderAzure) updateTokenMeta(token *bootstraptoken.BootstrapToken, secret azsecrets.GetSecretResponse) {
 	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "azure")
-	token.SetAnnotation("bootstraptoken.webdevops.io/keyvault", *m.opts.CloudProvider.Azure.KeyVaultUrl)
+	token.SetAnnotation("bootstraptoken.webdevops.io/keyvault", *m.opts.KeyVaultUrl)
 	token.SetAnnotation("bootstraptoken.webdevops.io/secret", secret.ID.Name())
 	token.SetAnnotation("bootstraptoken.webdevops.io/secretVersion", secret.ID.Version())
 
@@ -230,35 +492,99 @@ func (m *CloudProviderAzure) updateTokenMeta(token *bootstraptoken.BootstrapToke
 	}
 }
 
+// returns creation time of secret version (zero time if not set)
+func azureSecretCreated(secretVersion *azsecrets.SecretProperties) time.Time {
+	if secretVersion.Attributes != nil && secretVersion.Attributes.Created != nil {
+		return secretVersion.Attributes.Created.UTC()
+	}
+	return time.Time{}
+}
+
 func (m *CloudProviderAzure) handleKeyvaultError(logger *slogger.Logger, err error) error {
-	if err != nil {
-		switch m.parseAzCoreResponseError(err) {
-		case "SecretNotFound":
-			// no secret found, need to create new token
-			logger.Warn("no secret found, assuming non existing token")
-		case "SecretDisabled":
-			// disabled secret, continue as there would be no token
-			logger.Warn("current secret is disabled, assuming non existing token")
-		case "ForbiddenByPolicy":
-			// access is forbidden
-			logger.Error("unable to access Azure KeyVault, please check access")
-			return err
-		default:
-			// not handled error
-			return err
+	if err == nil {
+		return nil
+	}
+
+	keyvaultErr := m.parseAzCoreResponseError(err)
+	switch {
+	case keyvaultErr.ErrorCode == "SecretNotFound":
+		// no secret found, need to create new token
+		logger.Warn("no secret found, assuming non existing token")
+		return nil
+	case keyvaultErr.ErrorCode == "SecretDisabled":
+		// disabled secret, continue as there would be no token
+		logger.Warn("current secret is disabled, assuming non existing token")
+		return nil
+	case errors.Is(keyvaultErr, ErrKeyvaultForbidden):
+		// access is forbidden (access policy, RBAC or network rules)
+		logger.Error("unable to access Azure KeyVault, please check access", slog.Any("error", keyvaultErr))
+	case errors.Is(keyvaultErr, ErrKeyvaultAuth):
+		// credentials are invalid or expired
+		logger.Error("unable to authenticate to Azure KeyVault, please check credentials", slog.Any("error", keyvaultErr))
+	case errors.Is(keyvaultErr, ErrKeyvaultThrottled), errors.Is(keyvaultErr, ErrKeyvaultTransient):
+		// already retried by client, will be retried on next sync run
+		logger.Warn("Azure KeyVault temporarily not available, retrying on next sync run", slog.Any("error", keyvaultErr), slog.Duration("retryAfter", keyvaultErr.RetryAfter))
+	}
+
+	return keyvaultErr
+}
+
+// classifies errors from Azure KeyVault (and Azure authentication) into KeyvaultError
+func (m *CloudProviderAzure) parseAzCoreResponseError(err error) *KeyvaultError {
+	keyvaultErr := &KeyvaultError{
+		Kind: ErrKeyvaultRequest,
+		Err:  err,
+	}
+
+	var authErr *azidentity.AuthenticationFailedError
+	var responseErr *azcore.ResponseError
+	switch {
+	case errors.As(err, &authErr):
+		keyvaultErr.Kind = ErrKeyvaultAuth
+		if authErr.RawResponse != nil {
+			keyvaultErr.StatusCode = authErr.RawResponse.StatusCode
+		}
+	case errors.As(err, &responseErr):
+		keyvaultErr.StatusCode = responseErr.StatusCode
+		keyvaultErr.ErrorCode = responseErr.ErrorCode
+		keyvaultErr.RetryAfter = azureRetryAfter(responseErr.RawResponse)
+
+		switch {
+		case responseErr.StatusCode == http.StatusTooManyRequests:
+			keyvaultErr.Kind = ErrKeyvaultThrottled
+		case responseErr.StatusCode == http.StatusRequestTimeout,
+			responseErr.StatusCode >= http.StatusInternalServerError && responseErr.StatusCode != http.StatusNotImplemented:
+			keyvaultErr.Kind = ErrKeyvaultTransient
+		case responseErr.StatusCode == http.StatusUnauthorized:
+			keyvaultErr.Kind = ErrKeyvaultAuth
+		case responseErr.StatusCode == http.StatusForbidden, responseErr.ErrorCode == "ForbiddenByPolicy":
+			keyvaultErr.Kind = ErrKeyvaultForbidden
 		}
+	case errors.Is(err, context.Canceled):
+		// keep generic request error, sync was cancelled
+	default:
+		// no response (eg. connection errors or timeouts)
+		keyvaultErr.Kind = ErrKeyvaultTransient
 	}
-	return nil
+
+	return keyvaultErr
 }
 
-func (m *CloudProviderAzure) parseAzCoreResponseError(err error) (code interface{}) {
-	// TODO: check better error handling
+// parses Retry-After header (seconds or http date)
+func azureRetryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+
+	if val := resp.Header.Get("Retry-After"); val != "" {
+		if seconds, err := strconv.Atoi(val); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
 
-	// nolint:errorlint
-	var responseError *azcore.ResponseError
-	if err != nil && errors.As(err, &responseError) {
-		// nolint:errorlint
-		code = responseError.ErrorCode
+		if retryTime, err := http.ParseTime(val); err == nil {
+			return time.Until(retryTime)
+		}
 	}
-	return
+
+	return 0
 }
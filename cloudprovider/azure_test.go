@@ -0,0 +1,379 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+)
+
+type (
+	// fakeAzureCredential returns a static access token
+	fakeAzureCredential struct{}
+
+	// fakeKeyvault is a minimal in-memory Azure Key Vault (secrets API)
+	fakeKeyvault struct {
+		server *httptest.Server
+
+		lock     sync.Mutex
+		versions map[string][]*fakeKeyvaultVersion
+		requests map[string]int
+
+		// optional error response (status code and error code) for requests, 0 passes request to the fake
+		fail func(r *http.Request) (int, string)
+	}
+
+	fakeKeyvaultVersion struct {
+		ID          string                 `json:"id"`
+		Value       string                 `json:"value,omitempty"`
+		ContentType string                 `json:"contentType,omitempty"`
+		Attributes  map[string]interface{} `json:"attributes"`
+		Tags        map[string]*string     `json:"tags,omitempty"`
+	}
+)
+
+func (c *fakeAzureCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "fake", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func newFakeKeyvault(t *testing.T) *fakeKeyvault {
+	t.Helper()
+	kv := &fakeKeyvault{
+		versions: map[string][]*fakeKeyvaultVersion{},
+		requests: map[string]int{},
+	}
+	kv.server = httptest.NewTLSServer(http.HandlerFunc(kv.serveHTTP))
+	t.Cleanup(kv.server.Close)
+	return kv
+}
+
+// addVersion adds a secret version with creation time and expiry relative to now
+func (kv *fakeKeyvault) addVersion(name, version, value string, created, expires time.Duration) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.versions[name] = append(kv.versions[name], &fakeKeyvaultVersion{
+		ID:    fmt.Sprintf("%s/secrets/%s/%s", kv.server.URL, name, version),
+		Value: value,
+		Attributes: map[string]interface{}{
+			"enabled": true,
+			"created": time.Now().Add(created).Unix(),
+			"exp":     time.Now().Add(expires).Unix(),
+		},
+		Tags: map[string]*string{},
+	})
+}
+
+func (kv *fakeKeyvault) version(name, version string) *fakeKeyvaultVersion {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for _, secretVersion := range kv.versions[name] {
+		if strings.HasSuffix(secretVersion.ID, "/"+version) {
+			return secretVersion
+		}
+	}
+	return nil
+}
+
+func (kv *fakeKeyvault) requestCount(method string) int {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.requests[method]
+}
+
+func (kv *fakeKeyvault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// Key Vault authentication challenge
+	if r.Header.Get("Authorization") == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer authorization="https://login.microsoftonline.com/tenant", resource="https://vault.azure.net"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.requests[r.Method]++
+
+	if kv.fail != nil {
+		if statusCode, errorCode := kv.fail(r); statusCode != 0 {
+			kv.writeError(w, statusCode, errorCode)
+			return
+		}
+	}
+
+	// /secrets/<name>[/<version>|/versions]
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/secrets/"), "/")
+	name := path[0]
+	version := ""
+	if len(path) > 1 {
+		version = path[1]
+	}
+
+	switch {
+	case r.Method == http.MethodPut:
+		body := struct {
+			Value       string                 `json:"value"`
+			ContentType string                 `json:"contentType"`
+			Attributes  map[string]interface{} `json:"attributes"`
+			Tags        map[string]*string     `json:"tags"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			kv.writeError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+		secretVersion := &fakeKeyvaultVersion{
+			ID:          fmt.Sprintf("%s/secrets/%s/v%d", kv.server.URL, name, len(kv.versions[name])+1),
+			Value:       body.Value,
+			ContentType: body.ContentType,
+			Attributes:  body.Attributes,
+			Tags:        body.Tags,
+		}
+		secretVersion.Attributes["enabled"] = true
+		secretVersion.Attributes["created"] = time.Now().Unix()
+		kv.versions[name] = append(kv.versions[name], secretVersion)
+		kv.writeJSON(w, secretVersion)
+	case r.Method == http.MethodGet && version == "versions":
+		result := struct {
+			Value []fakeKeyvaultVersion `json:"value"`
+		}{}
+		for _, secretVersion := range kv.versions[name] {
+			properties := *secretVersion
+			properties.Value = ""
+			result.Value = append(result.Value, properties)
+		}
+		kv.writeJSON(w, result)
+	case r.Method == http.MethodGet:
+		secretVersions := kv.versions[name]
+		if len(secretVersions) == 0 {
+			kv.writeError(w, http.StatusNotFound, "SecretNotFound")
+			return
+		}
+		if version == "" {
+			kv.writeJSON(w, secretVersions[len(secretVersions)-1])
+			return
+		}
+		for _, secretVersion := range secretVersions {
+			if strings.HasSuffix(secretVersion.ID, "/"+version) {
+				kv.writeJSON(w, secretVersion)
+				return
+			}
+		}
+		kv.writeError(w, http.StatusNotFound, "SecretNotFound")
+	case r.Method == http.MethodPatch:
+		body := struct {
+			Attributes map[string]interface{} `json:"attributes"`
+			Tags       map[string]*string     `json:"tags"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			kv.writeError(w, http.StatusBadRequest, "BadParameter")
+			return
+		}
+		for _, secretVersion := range kv.versions[name] {
+			if strings.HasSuffix(secretVersion.ID, "/"+version) {
+				for key, value := range body.Attributes {
+					secretVersion.Attributes[key] = value
+				}
+				if body.Tags != nil {
+					secretVersion.Tags = body.Tags
+				}
+				kv.writeJSON(w, secretVersion)
+				return
+			}
+		}
+		kv.writeError(w, http.StatusNotFound, "SecretNotFound")
+	default:
+		kv.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (kv *fakeKeyvault) writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (kv *fakeKeyvault) writeError(w http.ResponseWriter, statusCode int, errorCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = io.WriteString(w, fmt.Sprintf(`{"error":{"code":"%s","message":"fake error"}}`, errorCode))
+}
+
+func newTestAzureProvider(t *testing.T, kv *fakeKeyvault, configure func(opts *azureOptions)) *CloudProviderAzure {
+	t.Helper()
+	m := &CloudProviderAzure{
+		opts: &azureOptions{
+			KeyVaultUrl:           stringPtr(kv.server.URL),
+			KeyVaultSecretName:    stringPtr("kube-bootstrap-token"),
+			KeyVaultHistoryCount:  15,
+			KeyVaultRetryMax:      3,
+			KeyVaultRetryDelay:    time.Millisecond,
+			KeyVaultRetryMaxDelay: 10 * time.Millisecond,
+		},
+		logger: newTestLogger(),
+	}
+	if configure != nil {
+		configure(m.opts)
+	}
+
+	var err error
+	m.keyvaultClient, err = m.newKeyvaultClient(&fakeAzureCredential{}, &azsecrets.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: kv.server.Client(),
+		},
+		// fake Key Vault is not running on vault.azure.net
+		DisableChallengeResourceVerification: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAzureKeyvaultRetriesThrottledAndTransientRequests(t *testing.T) {
+	ctx := context.Background()
+	kv := newFakeKeyvault(t)
+	kv.addVersion("kube-bootstrap-token", "v1", "aaaaaa.0123456789abcdef", -time.Hour, time.Hour)
+
+	failures := []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusBadGateway}
+	kv.fail = func(r *http.Request) (int, string) {
+		if len(failures) == 0 {
+			return 0, ""
+		}
+		statusCode := failures[0]
+		failures = failures[1:]
+		return statusCode, "Throttled"
+	}
+
+	m := newTestAzureProvider(t, kv, nil)
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatalf("throttled and transient requests must be retried: %v", err)
+	}
+	if token == nil || token.Id() != "aaaaaa" {
+		t.Fatalf("expected token aaaaaa, got %v", token)
+	}
+	if count := kv.requestCount(http.MethodGet); count != 4 {
+		t.Fatalf("expected 4 requests (3 retries), got %d", count)
+	}
+}
+
+func TestAzureKeyvaultErrorClassification(t *testing.T) {
+	testCases := []struct {
+		name       string
+		statusCode int
+		errorCode  string
+		kind       error
+	}{
+		{name: "throttled", statusCode: http.StatusTooManyRequests, errorCode: "Throttled", kind: ErrKeyvaultThrottled},
+		{name: "transient", statusCode: http.StatusServiceUnavailable, errorCode: "ServiceUnavailable", kind: ErrKeyvaultTransient},
+		{name: "timeout", statusCode: http.StatusRequestTimeout, errorCode: "RequestTimeout", kind: ErrKeyvaultTransient},
+		{name: "forbidden", statusCode: http.StatusForbidden, errorCode: "Forbidden", kind: ErrKeyvaultForbidden},
+		{name: "forbiddenByPolicy", statusCode: http.StatusForbidden, errorCode: "ForbiddenByPolicy", kind: ErrKeyvaultForbidden},
+		{name: "badRequest", statusCode: http.StatusBadRequest, errorCode: "BadParameter", kind: ErrKeyvaultRequest},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := context.Background()
+			kv := newFakeKeyvault(t)
+			kv.fail = func(r *http.Request) (int, string) {
+				return testCase.statusCode, testCase.errorCode
+			}
+			m := newTestAzureProvider(t, kv, nil)
+
+			_, fetchErr := m.FetchToken(ctx)
+			storeErr := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef"))
+			for _, err := range []error{fetchErr, storeErr} {
+				if !errors.Is(err, testCase.kind) {
+					t.Fatalf("expected %v, got %v", testCase.kind, err)
+				}
+
+				var keyvaultErr *KeyvaultError
+				if !errors.As(err, &keyvaultErr) || keyvaultErr.StatusCode != testCase.statusCode || keyvaultErr.ErrorCode != testCase.errorCode {
+					t.Fatalf("expected KeyvaultError with status %d and code %s, got %v", testCase.statusCode, testCase.errorCode, err)
+				}
+
+				var responseErr *azcore.ResponseError
+				if !errors.As(err, &responseErr) {
+					t.Fatalf("expected wrapped azcore.ResponseError, got %v", err)
+				}
+			}
+
+			// only throttled and transient requests are retried (2 calls with 3 retries each)
+			expectedRequests := 2
+			if errors.Is(fetchErr, ErrKeyvaultThrottled) || errors.Is(fetchErr, ErrKeyvaultTransient) {
+				expectedRequests = 2 * 4
+			}
+			if count := kv.requestCount(http.MethodGet) + kv.requestCount(http.MethodPut); count != expectedRequests {
+				t.Fatalf("expected %d requests, got %d", expectedRequests, count)
+			}
+		})
+	}
+}
+
+func TestAzureKeyvaultSecretNotFound(t *testing.T) {
+	kv := newFakeKeyvault(t)
+	m := newTestAzureProvider(t, kv, nil)
+
+	token, err := m.FetchToken(context.Background())
+	if err != nil || token != nil {
+		t.Fatalf("missing secret must be treated as non existing token, got %v, %v", token, err)
+	}
+}
+
+func TestAzureKeyvaultRetireSecretVersions(t *testing.T) {
+	ctx := context.Background()
+	kv := newFakeKeyvault(t)
+	kv.addVersion("kube-bootstrap-token", "expired", "aaaaaa.0123456789abcdef", -48*time.Hour, -24*time.Hour)
+	kv.addVersion("kube-bootstrap-token", "outdated", "bbbbbb.0123456789abcdef", -12*time.Hour, 12*time.Hour)
+	kv.addVersion("kube-bootstrap-token", "valid", "cccccc.0123456789abcdef", -time.Hour, 24*time.Hour)
+
+	m := newTestAzureProvider(t, kv, func(opts *azureOptions) {
+		opts.KeyVaultRetireDisable = true
+		opts.KeyVaultRetireTag = true
+		opts.KeyVaultRetireRetention = 6 * time.Hour
+	})
+
+	if err := m.StoreToken(ctx, newTestToken("dddddd", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"expired", "outdated"} {
+		secretVersion := kv.version("kube-bootstrap-token", version)
+		if secretVersion.Attributes["enabled"] != false {
+			t.Fatalf("expected version %s to be disabled", version)
+		}
+		if secretVersion.Tags[AZURE_KEYVAULT_TAG_RETIRED] == nil {
+			t.Fatalf("expected version %s to be tagged as retired", version)
+		}
+	}
+
+	if secretVersion := kv.version("kube-bootstrap-token", "valid"); secretVersion.Attributes["enabled"] != true || secretVersion.Tags[AZURE_KEYVAULT_TAG_RETIRED] != nil {
+		t.Fatal("expected valid version not to be retired")
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Id() != "dddddd" || tokens[1].Id() != "cccccc" {
+		t.Fatalf("expected tokens dddddd, cccccc, got %v", tokens)
+	}
+
+	// retired versions are only updated once
+	patches := kv.requestCount(http.MethodPatch)
+	if err := m.StoreToken(ctx, newTestToken("eeeeee", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if count := kv.requestCount(http.MethodPatch); count != patches {
+		t.Fatalf("expected no updates of already retired versions, got %d", count-patches)
+	}
+}
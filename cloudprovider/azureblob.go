@@ -0,0 +1,352 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	// blob metadata names must be valid C# identifiers
+	AZURE_BLOB_METADATA_CREATED    = "bootstraptoken_created"
+	AZURE_BLOB_METADATA_EXPIRES    = "bootstraptoken_expires"
+	AZURE_BLOB_METADATA_MANAGED_BY = "managed_by"
+)
+
+type (
+	CloudProviderAzureBlob struct {
+		CloudProvider
+
+		opts *azureBlobOptions
+
+		logger *slogger.Logger
+		client *armclient.ArmClient
+
+		containerClient *container.Client
+	}
+
+	azureBlobVersion struct {
+		versionId    string
+		lastModified *time.Time
+		value        string
+		metadata     map[string]*string
+	}
+
+	// options of Azure Blob Storage cloud provider
+	azureBlobOptions struct {
+		BlobContainerUrl     *string `long:"azure.blob.container-url"       env:"AZURE_BLOB_CONTAINER_URL"        description:"URL of Blob Storage container to sync token (eg. https://<account>.blob.core.windows.net/<container>)"`
+		BlobConnectionString string  `long:"azure.blob.connection-string"   env:"AZURE_BLOB_CONNECTION_STRING"    description:"Connection string of Storage account (eg. for Azurite, used instead of container URL and Azure credentials)" json:"-"`
+		BlobContainer        string  `long:"azure.blob.container"           env:"AZURE_BLOB_CONTAINER"            description:"Name of Blob Storage container (only used with connection string)" default:"kube-bootstrap-token"`
+		BlobName             string  `long:"azure.blob.name"                env:"AZURE_BLOB_NAME"                 description:"Name of blob to sync token" default:"kube-bootstrap-token"`
+	}
+)
+
+var (
+	azureBlobOpts = &azureBlobOptions{}
+)
+
+func init() {
+	Register("azure-blob", func() CloudProvider {
+		return &CloudProviderAzureBlob{opts: azureBlobOpts}
+	})
+	RegisterOptions("azure-blob", azureBlobOpts)
+}
+
+func (m *CloudProviderAzureBlob) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	var err error
+	m.logger = logger.With(
+		slog.String("cloudprovider", "azure-blob"),
+	)
+
+	if m.opts.BlobName == "" {
+		return errors.New("no Azure Blob name specified")
+	}
+
+	switch {
+	case m.opts.BlobConnectionString != "":
+		// connection string (eg. for Azurite), no Azure credentials needed
+		containerOpts := container.ClientOptions{}
+		containerOpts.Telemetry.ApplicationID = userAgent
+		m.containerClient, err = container.NewClientFromConnectionString(m.opts.BlobConnectionString, m.opts.BlobContainer, &containerOpts)
+		if err != nil {
+			return err
+		}
+	case m.opts.BlobContainerUrl != nil && *m.opts.BlobContainerUrl != "":
+		m.client, err = armclient.NewArmClientFromEnvironment(logger.Slog())
+		if err != nil {
+			return err
+		}
+		m.client.SetUserAgent(userAgent)
+
+		containerOpts := container.ClientOptions{
+			ClientOptions: *m.client.NewAzCoreClientOptions(),
+		}
+		m.containerClient, err = container.NewClient(*m.opts.BlobContainerUrl, m.client.GetCred(), &containerOpts)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("no Azure Blob container url or connection string specified")
+	}
+
+	return nil
+}
+
+func (m *CloudProviderAzureBlob) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("container", m.containerClient.URL()), slog.String("blobName", m.opts.BlobName))
+
+	contextLogger.Info("fetching current token from Azure Blob Storage")
+	blobVersion, err := m.fetchBlob(ctx, "")
+	if err != nil {
+		return nil, m.handleBlobError(contextLogger, err)
+	}
+
+	if blobVersion != nil {
+		token = m.parseBlob(blobVersion)
+	}
+
+	return
+}
+
+func (m *CloudProviderAzureBlob) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("container", m.containerClient.URL()), slog.String("blobName", m.opts.BlobName))
+	contextLogger.Info("fetching all tokens from Azure Blob Storage")
+
+	versionList, err := m.fetchBlobVersions(ctx, contextLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range versionList {
+		versionId := stringPtrValue(item.VersionID)
+		versionLogger := contextLogger.With(slog.String("blobVersion", versionId))
+
+		if expires := azureBlobMetadataTime(item.Metadata, AZURE_BLOB_METADATA_EXPIRES); expires != nil && time.Now().After(*expires) {
+			// expired
+			continue
+		}
+
+		blobVersion, err := m.fetchBlob(ctx, versionId)
+		if err != nil {
+			versionLogger.Warn(`unable to fetch blob version`, slog.Any("error", err))
+			continue
+		}
+
+		if token := m.parseBlob(blobVersion); token != nil {
+			versionLogger.Info("found valid blob version")
+			tokens = append(tokens, token)
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderAzureBlob) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("container", m.containerClient.URL()),
+		slog.String("blobName", m.opts.BlobName),
+	)
+	contextLogger.Info("storing token to Azure Blob Storage", slog.String("expiration", token.ExpirationString()))
+
+	metadata := map[string]*string{
+		AZURE_BLOB_METADATA_MANAGED_BY: stringPtr("kube-bootstrap-token-manager"),
+	}
+	if token.CreationTime() != nil {
+		metadata[AZURE_BLOB_METADATA_CREATED] = stringPtr(token.CreationTime().UTC().Format(time.RFC3339))
+	}
+	if token.ExpirationTime() != nil {
+		metadata[AZURE_BLOB_METADATA_EXPIRES] = stringPtr(token.ExpirationTime().UTC().Format(time.RFC3339))
+	}
+
+	blobClient := m.containerClient.NewBlockBlobClient(m.opts.BlobName)
+	_, err := blobClient.Upload(ctx, streaming.NopCloser(strings.NewReader(token.FullToken())), &blockblob.UploadOptions{
+		Metadata: metadata,
+		HTTPHeaders: &blob.HTTPHeaders{
+			BlobContentType: stringPtr("text/plain"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	m.cleanupBlobVersions(ctx, contextLogger)
+
+	return nil
+}
+
+// removes expired and superseded blob versions
+func (m *CloudProviderAzureBlob) cleanupBlobVersions(ctx context.Context, logger *slogger.Logger) {
+	versionList, err := m.fetchBlobVersions(ctx, logger)
+	if err != nil {
+		logger.Warn(`unable to fetch blob versions for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, item := range versionList {
+		// always keep current version, it can't be deleted by version id anyway
+		if num == 0 || item.IsCurrentVersion == nil || *item.IsCurrentVersion || item.VersionID == nil {
+			continue
+		}
+
+		if retainVersion(num, azureBlobMetadataTime(item.Metadata, AZURE_BLOB_METADATA_EXPIRES)) {
+			continue
+		}
+
+		logger.Debug("removing blob version", slog.String("blobVersion", *item.VersionID))
+		blobClient, err := m.containerClient.NewBlobClient(m.opts.BlobName).WithVersionID(*item.VersionID)
+		if err == nil {
+			_, err = blobClient.Delete(ctx, nil)
+		}
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			logger.Warn(`unable to remove blob version`, slog.Any("error", err))
+		}
+	}
+}
+
+// fetches all blob versions (including metadata), sorted by version (newest first)
+func (m *CloudProviderAzureBlob) fetchBlobVersions(ctx context.Context, logger *slogger.Logger) (versionList []*container.BlobItem, err error) {
+	versionList = []*container.BlobItem{}
+
+	pager := m.containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: stringPtr(m.opts.BlobName),
+		Include: container.ListBlobsInclude{
+			Metadata: true,
+			Versions: true,
+		},
+	})
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return versionList, m.handleBlobError(logger, err)
+		}
+
+		for _, item := range result.Segment.BlobItems {
+			// prefix also matches other blobs
+			if stringPtrValue(item.Name) == m.opts.BlobName {
+				versionList = append(versionList, item)
+			}
+		}
+	}
+
+	// version ids are timestamps, without versioning (eg. Azurite) there is only the current blob
+	sort.SliceStable(versionList, func(i, j int) bool {
+		currentI := versionList[i].IsCurrentVersion != nil && *versionList[i].IsCurrentVersion
+		currentJ := versionList[j].IsCurrentVersion != nil && *versionList[j].IsCurrentVersion
+		if currentI != currentJ {
+			return currentI
+		}
+		return stringPtrValue(versionList[i].VersionID) > stringPtrValue(versionList[j].VersionID)
+	})
+
+	return
+}
+
+// downloads blob (or specific blob version)
+func (m *CloudProviderAzureBlob) fetchBlob(ctx context.Context, versionId string) (*azureBlobVersion, error) {
+	blobClient := m.containerClient.NewBlobClient(m.opts.BlobName)
+	if versionId != "" {
+		var err error
+		blobClient, err = blobClient.WithVersionID(versionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := blobClient.DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close() // nolint:errcheck
+
+	value, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &azureBlobVersion{
+		versionId:    stringPtrValue(result.VersionID),
+		lastModified: result.LastModified,
+		value:        string(bytes.TrimSpace(value)),
+		metadata:     result.Metadata,
+	}, nil
+}
+
+func (m *CloudProviderAzureBlob) parseBlob(blobVersion *azureBlobVersion) (token *bootstraptoken.BootstrapToken) {
+	token = bootstraptoken.ParseFromString(blobVersion.value)
+	if token == nil {
+		return
+	}
+
+	created := azureBlobMetadataTime(blobVersion.metadata, AZURE_BLOB_METADATA_CREATED)
+	if created == nil {
+		created = blobVersion.lastModified
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	expires := azureBlobMetadataTime(blobVersion.metadata, AZURE_BLOB_METADATA_EXPIRES)
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "azure-blob")
+	token.SetAnnotation("bootstraptoken.webdevops.io/blob", m.containerClient.NewBlobClient(m.opts.BlobName).URL())
+	token.SetAnnotation("bootstraptoken.webdevops.io/blobVersion", blobVersion.versionId)
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderAzureBlob) handleBlobError(logger *slogger.Logger, err error) error {
+	if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		// container is not created by manager
+		logger.Error("Azure Blob container not found, please create container (with versioning enabled)")
+		return err
+	}
+
+	forbidden := bloberror.HasCode(err, bloberror.AuthorizationFailure, bloberror.AuthorizationPermissionMismatch)
+	return handleFetchError(logger, err, bloberror.HasCode(err, bloberror.BlobNotFound), forbidden, "blob", "unable to access Azure Blob Storage, please check access (eg. Storage Blob Data Contributor role)")
+}
+
+func azureBlobMetadataTime(metadata map[string]*string, name string) *time.Time {
+	// metadata names are case insensitive
+	for key, val := range metadata {
+		if strings.EqualFold(key, name) && val != nil {
+			if ret, err := time.Parse(time.RFC3339, *val); err == nil {
+				return &ret
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package cloudprovider
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	testAzureBlobAccount   = "devstoreaccount1"
+	testAzureBlobContainer = "kube-bootstrap-token"
+	testAzureBlobName      = "kube-bootstrap-token"
+
+	// well-known Azurite development account key
+	testAzureBlobAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+type (
+	// fakeAzureBlob is a minimal in-memory Azure Blob Storage (versioning enabled) for one container
+	fakeAzureBlob struct {
+		server *httptest.Server
+
+		lock     sync.Mutex
+		versions []*fakeAzureBlobVersion
+		clock    time.Time
+
+		// optional error code returned for all requests
+		fail string
+	}
+
+	fakeAzureBlobVersion struct {
+		name         string
+		versionId    string
+		body         string
+		metadata     map[string]string
+		lastModified time.Time
+	}
+)
+
+func newFakeAzureBlob(t *testing.T) *fakeAzureBlob {
+	t.Helper()
+	b := &fakeAzureBlob{
+		clock: time.Now().Add(-time.Hour).Truncate(time.Second).UTC(),
+	}
+	b.server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	t.Cleanup(b.server.Close)
+	return b
+}
+
+// put stores a new blob version
+func (b *fakeAzureBlob) put(name, body string, metadata map[string]string) *fakeAzureBlobVersion {
+	b.clock = b.clock.Add(time.Second)
+	version := &fakeAzureBlobVersion{
+		name:         name,
+		versionId:    b.clock.Format("2006-01-02T15:04:05.0000000Z"),
+		body:         body,
+		metadata:     metadata,
+		lastModified: b.clock,
+	}
+	b.versions = append(b.versions, version)
+	return version
+}
+
+// current returns the current version of blob (nil if not existing)
+func (b *fakeAzureBlob) current(name string) *fakeAzureBlobVersion {
+	for num := len(b.versions) - 1; num >= 0; num-- {
+		if b.versions[num].name == name {
+			return b.versions[num]
+		}
+	}
+	return nil
+}
+
+func (b *fakeAzureBlob) versionCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.versions)
+}
+
+func (b *fakeAzureBlob) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.fail != "" {
+		b.writeError(w, r, http.StatusForbidden, b.fail)
+		return
+	}
+
+	containerPath := "/" + testAzureBlobAccount + "/" + testAzureBlobContainer
+	if r.URL.Path == containerPath {
+		if r.Method != http.MethodGet || r.URL.Query().Get("comp") != "list" {
+			b.writeError(w, r, http.StatusBadRequest, "UnsupportedQueryParameter")
+			return
+		}
+		b.listBlobs(w, r)
+		return
+	}
+
+	name, found := strings.CutPrefix(r.URL.Path, containerPath+"/")
+	if !found {
+		b.writeError(w, r, http.StatusNotFound, string(bloberror.ContainerNotFound))
+		return
+	}
+
+	version := b.current(name)
+	if versionId := r.URL.Query().Get("versionid"); versionId != "" {
+		version = nil
+		for _, item := range b.versions {
+			if item.name == name && item.versionId == versionId {
+				version = item
+			}
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			b.writeError(w, r, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		metadata := map[string]string{}
+		for key := range r.Header {
+			if metaKey, found := strings.CutPrefix(strings.ToLower(key), "x-ms-meta-"); found {
+				metadata[metaKey] = r.Header.Get(key)
+			}
+		}
+		version := b.put(name, string(body), metadata)
+		b.writeVersionHeaders(w, version)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		if version == nil {
+			b.writeError(w, r, http.StatusNotFound, string(bloberror.BlobNotFound))
+			return
+		}
+		for key, value := range version.metadata {
+			w.Header().Set("x-ms-meta-"+key, value)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(version.body)))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		b.writeVersionHeaders(w, version)
+		_, _ = io.WriteString(w, version.body)
+	case http.MethodDelete:
+		if version == nil {
+			b.writeError(w, r, http.StatusNotFound, string(bloberror.BlobNotFound))
+			return
+		}
+		if version == b.current(name) {
+			// current version can't be deleted by version id
+			b.writeError(w, r, http.StatusForbidden, string(bloberror.OperationNotAllowedOnRootBlob))
+			return
+		}
+		for num, item := range b.versions {
+			if item == version {
+				b.versions = append(b.versions[:num], b.versions[num+1:]...)
+				break
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		b.writeError(w, r, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (b *fakeAzureBlob) listBlobs(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	blobs := strings.Builder{}
+	for _, version := range b.versions {
+		if !strings.HasPrefix(version.name, prefix) {
+			continue
+		}
+		metadata := strings.Builder{}
+		for key, value := range version.metadata {
+			fmt.Fprintf(&metadata, "<%s>%s</%s>", key, html.EscapeString(value), key)
+		}
+		fmt.Fprintf(&blobs, "<Blob><Name>%s</Name><VersionId>%s</VersionId><IsCurrentVersion>%t</IsCurrentVersion><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length><BlobType>BlockBlob</BlobType></Properties><Metadata>%s</Metadata></Blob>",
+			html.EscapeString(version.name),
+			version.versionId,
+			b.current(version.name) == version,
+			version.lastModified.Format(http.TimeFormat),
+			len(version.body),
+			metadata.String(),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ServiceEndpoint="%s" ContainerName="%s"><Prefix>%s</Prefix><Blobs>%s</Blobs><NextMarker /></EnumerationResults>`,
+		b.server.URL+"/"+testAzureBlobAccount,
+		testAzureBlobContainer,
+		html.EscapeString(prefix),
+		blobs.String(),
+	)
+}
+
+func (b *fakeAzureBlob) writeVersionHeaders(w http.ResponseWriter, version *fakeAzureBlobVersion) {
+	w.Header().Set("ETag", `"`+version.versionId+`"`)
+	w.Header().Set("Last-Modified", version.lastModified.Format(http.TimeFormat))
+	w.Header().Set("x-ms-version-id", version.versionId)
+}
+
+func (b *fakeAzureBlob) writeError(w http.ResponseWriter, r *http.Request, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(statusCode)
+	if r.Method != http.MethodHead {
+		_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>fake error</Message></Error>`, code)
+	}
+}
+
+func newTestAzureBlobProvider(t *testing.T, b *fakeAzureBlob) *CloudProviderAzureBlob {
+	t.Helper()
+
+	m := &CloudProviderAzureBlob{
+		opts: &azureBlobOptions{
+			BlobConnectionString: fmt.Sprintf(
+				"DefaultEndpointsProtocol=http;AccountName=%s;AccountKey=%s;BlobEndpoint=%s/%s;",
+				testAzureBlobAccount,
+				testAzureBlobAccountKey,
+				b.server.URL,
+				testAzureBlobAccount,
+			),
+			BlobContainer: testAzureBlobContainer,
+			BlobName:      testAzureBlobName,
+		},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAzureBlobStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	b := newFakeAzureBlob(t)
+	m := newTestAzureBlobProvider(t, b)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing blob must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if managedBy := b.current(testAzureBlobName).metadata[AZURE_BLOB_METADATA_MANAGED_BY]; managedBy != "kube-bootstrap-token-manager" {
+		t.Fatalf("expected managed by metadata, got %q", managedBy)
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration from blob metadata, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+	if blobVersion := token.Annotations()["bootstraptoken.webdevops.io/blobVersion"]; blobVersion != b.current(testAzureBlobName).versionId {
+		t.Fatalf("expected blob version annotation, got %q", blobVersion)
+	}
+}
+
+func TestAzureBlobStoreTokenCleansUpVersions(t *testing.T) {
+	ctx := context.Background()
+	b := newFakeAzureBlob(t)
+	m := newTestAzureBlobProvider(t, b)
+
+	// other blob matching name prefix must not be touched
+	b.put(testAzureBlobName+"-other", "zzzzzz.0123456789abcdef", nil)
+
+	expired := bootstraptoken.NewBootstrapToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// latest SECRET_SYNC_COUNT_MAX versions of blob and the other blob are kept
+	if count := b.versionCount(); count != SECRET_SYNC_COUNT_MAX+1 {
+		t.Fatalf("expected %d blob versions, got %d", SECRET_SYNC_COUNT_MAX+1, count)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected current token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.Id() == "expire" || token.Id() == "zzzzzz" {
+			t.Fatalf("unexpected token %s", token.Id())
+		}
+	}
+}
+
+func TestAzureBlobFetchTokensSkipsExpiredVersions(t *testing.T) {
+	ctx := context.Background()
+	b := newFakeAzureBlob(t)
+	m := newTestAzureBlobProvider(t, b)
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired version stored by another manager (eg. older manager without cleanup)
+	b.lock.Lock()
+	b.put(testAzureBlobName, "expire.0123456789abcdef", map[string]string{
+		AZURE_BLOB_METADATA_EXPIRES: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	})
+	b.lock.Unlock()
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Id() != stored.Id() {
+		t.Fatalf("expected only valid token %s, got %v", stored.Id(), tokens)
+	}
+}
+
+func TestAzureBlobFetchTokenAuthorizationFailure(t *testing.T) {
+	b := newFakeAzureBlob(t)
+	m := newTestAzureBlobProvider(t, b)
+	b.fail = string(bloberror.AuthorizationPermissionMismatch)
+
+	_, err := m.FetchToken(context.Background())
+	if err == nil || !bloberror.HasCode(err, bloberror.AuthorizationPermissionMismatch) {
+		t.Fatalf("expected AuthorizationPermissionMismatch, got %v", err)
+	}
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
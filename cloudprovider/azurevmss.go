@@ -0,0 +1,263 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+)
+
+// initScaleSets parses the VM Scale Set template (token is passed as . to the template)
+// and sets credential and client options of VM Scale Set clients
+func (m *CloudProviderAzure) initScaleSets(cred azcore.TokenCredential, clientOpts *arm.ClientOptions) error {
+	if len(m.opts.Vmss) == 0 {
+		return nil
+	}
+
+	if m.opts.VmssTemplateFile == "" {
+		return errors.New("no Azure VM Scale Set template file specified")
+	}
+
+	content, err := os.ReadFile(m.opts.VmssTemplateFile)
+	if err != nil {
+		return fmt.Errorf(`unable to read Azure VM Scale Set template: %w`, err)
+	}
+
+	m.vmssTemplate, err = template.New("VmssTemplate").Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return fmt.Errorf(`unable to parse Azure VM Scale Set template: %w`, err)
+	}
+
+	for _, resourceId := range m.opts.Vmss {
+		if _, err := arm.ParseResourceID(resourceId); err != nil {
+			return fmt.Errorf(`invalid Azure VM Scale Set resource ID "%s": %w`, resourceId, err)
+		}
+	}
+
+	m.vmssCred = cred
+	m.vmssClientOptions, err = azureArmEndpointOptions(clientOpts, m.opts.VmssEndpoint)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// azureArmEndpointOptions overrides the Azure Resource Manager endpoint of the client options,
+// the cloud configuration is copied as it's shared with other clients
+func azureArmEndpointOptions(clientOpts *arm.ClientOptions, endpoint string) (*arm.ClientOptions, error) {
+	if endpoint == "" {
+		return clientOpts, nil
+	}
+
+	if endpointUrl, err := url.Parse(endpoint); err != nil || endpointUrl.Scheme != "https" || endpointUrl.Host == "" {
+		return nil, fmt.Errorf(`invalid Azure Resource Manager endpoint "%s" (https URL required)`, endpoint)
+	}
+
+	services := map[cloud.ServiceName]cloud.ServiceConfiguration{}
+	for name, service := range clientOpts.Cloud.Services {
+		services[name] = service
+	}
+
+	resourceManager := services[cloud.ResourceManager]
+	resourceManager.Endpoint = strings.TrimSuffix(endpoint, "/")
+	if resourceManager.Audience == "" {
+		resourceManager.Audience = cloud.AzurePublic.Services[cloud.ResourceManager].Audience
+	}
+	services[cloud.ResourceManager] = resourceManager
+	clientOpts.Cloud.Services = services
+
+	return clientOpts, nil
+}
+
+// RotationTargets returns the resource IDs of all configured VM Scale Sets
+func (m *CloudProviderAzure) RotationTargets() []string {
+	return m.opts.Vmss
+}
+
+// TokenRotated updates the model of all configured VM Scale Sets so new instances boot with the new token,
+// returns the errors of all failed VM Scale Sets
+func (m *CloudProviderAzure) TokenRotated(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	if len(m.opts.Vmss) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.vmssTemplate.Execute(buf, token); err != nil {
+		return fmt.Errorf(`unable to render Azure VM Scale Set template: %w`, err)
+	}
+
+	vmssErrors := []error{}
+	for _, resourceId := range m.opts.Vmss {
+		vmssLogger := m.logger.With(slog.String("token", token.Id()), slog.String("vmss", resourceId))
+		if err := m.updateScaleSet(ctx, vmssLogger, resourceId, token, buf.Bytes()); err != nil {
+			vmssErrors = append(vmssErrors, fmt.Errorf(`unable to update Azure VM Scale Set "%s": %w`, resourceId, err))
+		}
+	}
+
+	return errors.Join(vmssErrors...)
+}
+
+func (m *CloudProviderAzure) updateScaleSet(ctx context.Context, logger *slogger.Logger, resourceId string, token *bootstraptoken.BootstrapToken, content []byte) error {
+	resourceInfo, err := arm.ParseResourceID(resourceId)
+	if err != nil {
+		return err
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetsClient(resourceInfo.SubscriptionID, m.vmssCred, m.vmssClientOptions)
+	if err != nil {
+		return err
+	}
+
+	vmss, err := client.Get(ctx, resourceInfo.ResourceGroupName, resourceInfo.Name, nil)
+	if err != nil {
+		return err
+	}
+
+	vmProfile := &armcompute.VirtualMachineScaleSetUpdateVMProfile{}
+	if extensionName := m.opts.VmssExtension; extensionName != "" {
+		// template is passed as protected settings (JSON) of extension (eg. CustomScript)
+		protectedSettings := map[string]interface{}{}
+		if err := json.Unmarshal(content, &protectedSettings); err != nil {
+			return fmt.Errorf(`rendered template is not valid JSON for extension protected settings: %w`, err)
+		}
+
+		if vmss.Properties == nil || vmss.Properties.VirtualMachineProfile == nil || vmss.Properties.VirtualMachineProfile.ExtensionProfile == nil {
+			return fmt.Errorf(`extension "%s" not found in VM Scale Set`, extensionName)
+		}
+
+		// extensions are replaced on update, so all extensions need to be passed again
+		extensionProfile := vmss.Properties.VirtualMachineProfile.ExtensionProfile
+		found := false
+		for _, extension := range extensionProfile.Extensions {
+			if extension.Name != nil && strings.EqualFold(*extension.Name, extensionName) && extension.Properties != nil {
+				extension.Properties.ProtectedSettings = protectedSettings
+				// force rerun of extension on upgraded instances
+				extension.Properties.ForceUpdateTag = stringPtr(token.Id())
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf(`extension "%s" not found in VM Scale Set`, extensionName)
+		}
+
+		vmProfile.ExtensionProfile = extensionProfile
+	} else {
+		vmProfile.OSProfile = &armcompute.VirtualMachineScaleSetUpdateOSProfile{
+			CustomData: stringPtr(base64.StdEncoding.EncodeToString(content)),
+		}
+	}
+
+	logger.Info("updating Azure VM Scale Set model", slog.String("extension", m.opts.VmssExtension))
+	poller, err := client.BeginUpdate(
+		ctx,
+		resourceInfo.ResourceGroupName,
+		resourceInfo.Name,
+		armcompute.VirtualMachineScaleSetUpdate{
+			Properties: &armcompute.VirtualMachineScaleSetUpdateProperties{
+				VirtualMachineProfile: vmProfile,
+			},
+		},
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := poller.PollUntilDone(ctx, nil); err != nil {
+		return err
+	}
+
+	if !m.opts.VmssUpgrade {
+		return nil
+	}
+
+	// instances of VM Scale Sets with rolling or automatic upgrade policy are upgraded by Azure
+	if vmss.Properties != nil && vmss.Properties.UpgradePolicy != nil && vmss.Properties.UpgradePolicy.Mode != nil && *vmss.Properties.UpgradePolicy.Mode != armcompute.UpgradeModeManual {
+		logger.Info("VM Scale Set instances are upgraded by upgrade policy", slog.String("upgradePolicy", string(*vmss.Properties.UpgradePolicy.Mode)))
+		return nil
+	}
+
+	return m.upgradeScaleSetInstances(ctx, logger, resourceInfo)
+}
+
+// upgradeScaleSetInstances upgrades instances (not running the latest model) in batches, one batch after another
+func (m *CloudProviderAzure) upgradeScaleSetInstances(ctx context.Context, logger *slogger.Logger, resourceInfo *arm.ResourceID) error {
+	vmClient, err := armcompute.NewVirtualMachineScaleSetVMsClient(resourceInfo.SubscriptionID, m.vmssCred, m.vmssClientOptions)
+	if err != nil {
+		return err
+	}
+
+	client, err := armcompute.NewVirtualMachineScaleSetsClient(resourceInfo.SubscriptionID, m.vmssCred, m.vmssClientOptions)
+	if err != nil {
+		return err
+	}
+
+	instanceIds := []*string{}
+	pager := vmClient.NewListPager(resourceInfo.ResourceGroupName, resourceInfo.Name, nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, vm := range result.Value {
+			if vm.InstanceID == nil {
+				continue
+			}
+
+			if vm.Properties != nil && vm.Properties.LatestModelApplied != nil && *vm.Properties.LatestModelApplied {
+				continue
+			}
+
+			instanceIds = append(instanceIds, vm.InstanceID)
+		}
+	}
+
+	batchSize := m.opts.VmssUpgradeBatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	for start := 0; start < len(instanceIds); start += batchSize {
+		end := start + batchSize
+		if end > len(instanceIds) {
+			end = len(instanceIds)
+		}
+		batch := instanceIds[start:end]
+
+		logger.Info("upgrading VM Scale Set instances to latest model", slog.Int("instances", len(batch)), slog.Int("remaining", len(instanceIds)-end))
+		poller, err := client.BeginUpdateInstances(
+			ctx,
+			resourceInfo.ResourceGroupName,
+			resourceInfo.Name,
+			armcompute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIDs: batch},
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+
+		if _, err := poller.PollUntilDone(ctx, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
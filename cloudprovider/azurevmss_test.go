@@ -0,0 +1,183 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	testVmssResourceId = "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss"
+)
+
+// fakeArm is a minimal Azure Resource Manager stub for one VM Scale Set (manual upgrade policy, instance 0 outdated)
+type fakeArm struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	update   map[string]interface{}
+	upgraded []string
+
+	// status code of VM Scale Set update (0 = success)
+	updateStatusCode int
+}
+
+func newFakeArm(t *testing.T) *fakeArm {
+	t.Helper()
+	stub := &fakeArm{}
+	stub.server = httptest.NewTLSServer(http.HandlerFunc(stub.serveHTTP))
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func (stub *fakeArm) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+
+	vmss := map[string]interface{}{
+		"id":       testVmssResourceId,
+		"name":     "vmss",
+		"location": "westeurope",
+		"properties": map[string]interface{}{
+			"upgradePolicy": map[string]interface{}{"mode": "Manual"},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Header.Get("Authorization") != "Bearer fake":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.Method == http.MethodGet && r.URL.Path == testVmssResourceId:
+		_ = json.NewEncoder(w).Encode(vmss)
+	case r.Method == http.MethodPatch && r.URL.Path == testVmssResourceId:
+		if stub.updateStatusCode != 0 {
+			w.WriteHeader(stub.updateStatusCode)
+			_, _ = w.Write([]byte(`{"error":{"code":"InvalidParameter","message":"fake error"}}`))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&stub.update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(vmss)
+	case r.Method == http.MethodGet && r.URL.Path == testVmssResourceId+"/virtualMachines":
+		_, _ = w.Write([]byte(`{"value":[
+			{"instanceId":"0","properties":{"latestModelApplied":false}},
+			{"instanceId":"1","properties":{"latestModelApplied":true}}
+		]}`))
+	case r.Method == http.MethodPost && r.URL.Path == testVmssResourceId+"/manualupgrade":
+		body := struct {
+			InstanceIds []string `json:"instanceIds"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stub.upgraded = append(stub.upgraded, body.InstanceIds...)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":{"code":"NotFound","message":"` + r.Method + " " + r.URL.Path + `"}}`))
+	}
+}
+
+func newTestAzureVmssProvider(t *testing.T, stub *fakeArm) *CloudProviderAzure {
+	t.Helper()
+
+	templateFile := filepath.Join(t.TempDir(), "template.txt")
+	if err := os.WriteFile(templateFile, []byte("token={{ .FullToken }}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &CloudProviderAzure{
+		opts: &azureOptions{
+			Vmss:             []string{testVmssResourceId},
+			VmssTemplateFile: templateFile,
+			VmssEndpoint:     stub.server.URL,
+			VmssUpgrade:      true,
+		},
+		logger: newTestLogger(),
+	}
+
+	err := m.initScaleSets(&fakeAzureCredential{}, &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Transport: stub.server.Client(),
+			Retry:     policy.RetryOptions{MaxRetries: -1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAzureVmssTokenRotated(t *testing.T) {
+	stub := newFakeArm(t)
+	m := newTestAzureVmssProvider(t, stub)
+
+	if targets := m.RotationTargets(); len(targets) != 1 || targets[0] != testVmssResourceId {
+		t.Fatalf("expected VM Scale Set as rotation target, got %v", targets)
+	}
+
+	token := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.TokenRotated(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	osProfile := stub.update["properties"].(map[string]interface{})["virtualMachineProfile"].(map[string]interface{})["osProfile"].(map[string]interface{})
+	if expected := base64.StdEncoding.EncodeToString([]byte("token=" + token.FullToken())); osProfile["customData"] != expected {
+		t.Fatalf("expected custom data %s, got %v", expected, osProfile["customData"])
+	}
+
+	if len(stub.upgraded) != 1 || stub.upgraded[0] != "0" {
+		t.Fatalf("expected only outdated instance 0 to be upgraded, got %v", stub.upgraded)
+	}
+}
+
+func TestAzureVmssTokenRotatedReturnsErrors(t *testing.T) {
+	stub := newFakeArm(t)
+	stub.updateStatusCode = http.StatusBadRequest
+	m := newTestAzureVmssProvider(t, stub)
+
+	err := m.TokenRotated(context.Background(), newTestToken("aaaaaa", "0123456789abcdef"))
+	if err == nil || !strings.Contains(err.Error(), testVmssResourceId) {
+		t.Fatalf("expected error of VM Scale Set update, got %v", err)
+	}
+
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected wrapped azcore.ResponseError, got %v", err)
+	}
+
+	if len(stub.upgraded) != 0 {
+		t.Fatalf("instances must not be upgraded after failed update, got %v", stub.upgraded)
+	}
+}
+
+func TestAzureArmEndpointOptions(t *testing.T) {
+	for _, endpoint := range []string{"http://management.local", "management.local", "https://"} {
+		if _, err := azureArmEndpointOptions(&arm.ClientOptions{}, endpoint); err == nil {
+			t.Fatalf("expected invalid endpoint %s to be rejected", endpoint)
+		}
+	}
+
+	clientOpts, err := azureArmEndpointOptions(&arm.ClientOptions{}, "https://management.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := clientOpts.Cloud.Services[cloud.ResourceManager].Endpoint; endpoint != "https://management.local" {
+		t.Fatalf("expected overridden endpoint, got %s", endpoint)
+	}
+}
@@ -3,7 +3,9 @@ package cloudprovider
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/webdevops/go-common/log/slogger"
 
@@ -11,20 +13,73 @@ import (
 	"github.com/webdevops/kube-bootstrap-token-manager/config"
 )
 
+const (
+	// number of versions which are synced on full sync and kept on cleanup (providers without own history settings)
+	SECRET_SYNC_COUNT_MAX = 15
+)
+
 type (
 	CloudProvider interface {
-		Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string)
-		FetchToken() (token *bootstraptoken.BootstrapToken)
-		FetchTokens() (token []*bootstraptoken.BootstrapToken)
-		StoreToken(token *bootstraptoken.BootstrapToken)
+		Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error
+		FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error)
+		FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error)
+		StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error
+	}
+
+	// CloudProviderHealer is implemented by cloud providers which can heal inconsistencies found by FetchToken
+	// (eg. mirror secondaries missing the current token), healing is an explicit step so it can be skipped (eg. dry run)
+	CloudProviderHealer interface {
+		// HealTargets returns the names of cloud providers missing token (based on last FetchToken)
+		HealTargets(token *bootstraptoken.BootstrapToken) []string
+		// Heal stores token to all cloud providers missing it
+		Heal(ctx context.Context, token *bootstraptoken.BootstrapToken) error
+	}
+
+	// CloudProviderRotationHandler is implemented by cloud providers which update further resources with a new token
+	// (eg. Azure VM Scale Sets), it's only called after rotation (not when storing or healing tokens) and runs in background
+	CloudProviderRotationHandler interface {
+		// RotationTargets returns the names of resources updated after rotation
+		RotationTargets() []string
+		// TokenRotated updates all resources with the new token
+		TokenRotated(ctx context.Context, token *bootstraptoken.BootstrapToken) error
 	}
 )
 
-func NewCloudProvider(provider string) CloudProvider {
-	switch strings.ToLower(provider) {
-	case "azure":
-		return &CloudProviderAzure{}
+// NewCloudProvider creates (uninitialized) cloud provider registered under provider name
+func NewCloudProvider(provider string) (CloudProvider, error) {
+	if factory := lookupProvider(provider); factory != nil {
+		return factory(), nil
+	}
+
+	return nil, fmt.Errorf("cloud provider \"%s\" not available (available: %s)", provider, strings.Join(Providers(), ", "))
+}
+
+// syncLimitReached returns true if SECRET_SYNC_COUNT_MAX tokens were collected on full sync,
+// remaining (older) versions are not fetched anymore
+func syncLimitReached(tokens []*bootstraptoken.BootstrapToken) bool {
+	return len(tokens) >= SECRET_SYNC_COUNT_MAX
+}
+
+// retainVersion returns true if version at position num (sorted newest first) is kept on cleanup,
+// the latest SECRET_SYNC_COUNT_MAX versions are kept as long as they are not expired (expires may be nil)
+func retainVersion(num int, expires *time.Time) bool {
+	return num < SECRET_SYNC_COUNT_MAX && (expires == nil || time.Now().Before(*expires))
+}
+
+// handleFetchError handles errors while fetching tokens: not existing secrets are no error (a new token is created),
+// access errors are logged with a hint, all other errors are returned
+func handleFetchError(logger *slogger.Logger, err error, notFound, forbidden bool, resource, accessHint string) error {
+	switch {
+	case err == nil:
+		return nil
+	case notFound:
+		// no secret found, need to create new token
+		logger.Warn(fmt.Sprintf("no %s found, assuming non existing token", resource))
+		return nil
+	case forbidden:
+		// access is forbidden
+		logger.Error(accessHint, slog.Any("error", err))
 	}
 
-	panic(fmt.Sprintf("cloud provider \"%s\" not available", provider))
+	return err
 }
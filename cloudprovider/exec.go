@@ -0,0 +1,265 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	EXEC_API_VERSION   = "bootstraptoken.webdevops.io/v1"
+	EXEC_KIND_REQUEST  = "ExecProviderRequest"
+	EXEC_KIND_RESPONSE = "ExecProviderResponse"
+
+	EXEC_OPERATION_FETCH_TOKEN  = "FetchToken"
+	EXEC_OPERATION_FETCH_TOKENS = "FetchTokens"
+	EXEC_OPERATION_STORE_TOKEN  = "StoreToken"
+
+	EXEC_ENV_OPERATION = "BOOTSTRAPTOKEN_EXEC_OPERATION"
+)
+
+type (
+	CloudProviderExec struct {
+		CloudProvider
+
+		opts *execOptions
+
+		logger *slogger.Logger
+	}
+
+	// request sent to plugin via stdin
+	execRequest struct {
+		ApiVersion string     `json:"apiVersion"`
+		Kind       string     `json:"kind"`
+		Operation  string     `json:"operation"`
+		Token      *execToken `json:"token,omitempty"`
+	}
+
+	// response read from plugin via stdout
+	execResponse struct {
+		ApiVersion string       `json:"apiVersion"`
+		Kind       string       `json:"kind"`
+		Token      *execToken   `json:"token,omitempty"`
+		Tokens     []*execToken `json:"tokens,omitempty"`
+		Error      string       `json:"error,omitempty"`
+	}
+
+	execToken struct {
+		Id             string            `json:"id"`
+		Secret         string            `json:"secret"`
+		CreationTime   *time.Time        `json:"creationTime,omitempty"`
+		ExpirationTime *time.Time        `json:"expirationTime,omitempty"`
+		Annotations    map[string]string `json:"annotations,omitempty"`
+	}
+
+	// options of exec plugin cloud provider
+	execOptions struct {
+		Command *string       `long:"exec.command"    env:"EXEC_COMMAND"                  description:"Path to exec plugin (see README for JSON protocol)"`
+		Args    []string      `long:"exec.arg"        env:"EXEC_ARGS"     env-delim:" "   description:"Arguments for exec plugin"`
+		Timeout time.Duration `long:"exec.timeout"    env:"EXEC_TIMEOUT"                  description:"Timeout (time.Duration) for exec plugin calls" default:"30s"`
+	}
+)
+
+var (
+	execOpts = &execOptions{}
+
+	// bootstrap token format, see https://kubernetes.io/docs/reference/access-authn-authz/bootstrap-tokens/#token-format
+	execTokenIdRegexp     = regexp.MustCompile(`^[a-z0-9]{6}$`)
+	execTokenSecretRegexp = regexp.MustCompile(`^[a-z0-9]{16}$`)
+)
+
+func init() {
+	Register("exec", func() CloudProvider {
+		return &CloudProviderExec{opts: execOpts}
+	})
+	RegisterOptions("exec", execOpts)
+}
+
+func (m *CloudProviderExec) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "exec"),
+	)
+
+	if m.opts.Command == nil || *m.opts.Command == "" {
+		return errors.New("no exec plugin command specified")
+	}
+
+	if _, err := exec.LookPath(*m.opts.Command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *CloudProviderExec) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("command", *m.opts.Command))
+
+	contextLogger.Info("fetching current token from exec plugin")
+	response, err := m.execPlugin(ctx, contextLogger, execRequest{Operation: EXEC_OPERATION_FETCH_TOKEN})
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Token == nil {
+		contextLogger.Warn("no token returned, assuming non existing token")
+		return
+	}
+
+	return m.parseToken(response.Token)
+}
+
+func (m *CloudProviderExec) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("command", *m.opts.Command))
+	contextLogger.Info("fetching all tokens from exec plugin")
+
+	response, err := m.execPlugin(ctx, contextLogger, execRequest{Operation: EXEC_OPERATION_FETCH_TOKENS})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range response.Tokens {
+		token, err := m.parseToken(row)
+		if err != nil {
+			contextLogger.Warn("exec plugin returned invalid token, ignoring", slog.Any("error", err))
+			continue
+		}
+
+		if token.ExpirationTime() != nil && time.Now().After(*token.ExpirationTime()) {
+			// expired
+			continue
+		}
+
+		contextLogger.Info("found valid token", slog.String("token", token.Id()))
+		tokens = append(tokens, token)
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderExec) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("command", *m.opts.Command),
+	)
+	contextLogger.Info("storing token via exec plugin", slog.String("expiration", token.ExpirationString()))
+
+	_, err := m.execPlugin(ctx, contextLogger, execRequest{
+		Operation: EXEC_OPERATION_STORE_TOKEN,
+		Token: &execToken{
+			Id:             token.Id(),
+			Secret:         token.Secret(),
+			CreationTime:   token.CreationTime(),
+			ExpirationTime: token.ExpirationTime(),
+			Annotations:    token.Annotations(),
+		},
+	})
+	return err
+}
+
+// runs plugin with request as json on stdin and parses json response from stdout,
+// stderr of plugin is passed through to the log
+func (m *CloudProviderExec) execPlugin(ctx context.Context, logger *slogger.Logger, request execRequest) (response execResponse, err error) {
+	request.ApiVersion = EXEC_API_VERSION
+	request.Kind = EXEC_KIND_REQUEST
+
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.opts.Timeout)
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, *m.opts.Command, m.opts.Args...) // #nosec G204 -- plugin command is configured by operator
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", EXEC_ENV_OPERATION, request.Operation))
+	cmd.Stdin = bytes.NewReader(requestBody)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	logger.Debug("running exec plugin", slog.String("operation", request.Operation))
+	err = cmd.Run()
+
+	if stderr.Len() > 0 {
+		logger.Info("exec plugin output", slog.String("operation", request.Operation), slog.String("stderr", strings.TrimSpace(stderr.String())))
+	}
+
+	if err != nil {
+		return response, fmt.Errorf(`exec plugin failed for operation "%s": %w`, request.Operation, err)
+	}
+
+	// plugin might have exited without doing anything, empty output must not be treated as non existing token
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return response, fmt.Errorf(`exec plugin returned empty response for operation "%s"`, request.Operation)
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return response, fmt.Errorf(`unable to parse exec plugin response for operation "%s": %w`, request.Operation, err)
+	}
+
+	if response.ApiVersion != EXEC_API_VERSION || response.Kind != EXEC_KIND_RESPONSE {
+		return response, fmt.Errorf(`exec plugin returned unsupported response "%s/%s", expected "%s/%s"`, response.ApiVersion, response.Kind, EXEC_API_VERSION, EXEC_KIND_RESPONSE)
+	}
+
+	if response.Error != "" {
+		return response, fmt.Errorf(`exec plugin returned error for operation "%s": %s`, request.Operation, response.Error)
+	}
+
+	return
+}
+
+func (m *CloudProviderExec) parseToken(row *execToken) (token *bootstraptoken.BootstrapToken, err error) {
+	if row == nil {
+		return nil, errors.New("exec plugin returned empty token")
+	}
+
+	if !execTokenIdRegexp.MatchString(row.Id) {
+		return nil, fmt.Errorf(`exec plugin returned invalid token id "%s", expected %s`, row.Id, execTokenIdRegexp.String())
+	}
+
+	// secret must not be logged
+	if !execTokenSecretRegexp.MatchString(row.Secret) {
+		return nil, fmt.Errorf(`exec plugin returned invalid secret for token "%s", expected %s`, row.Id, execTokenSecretRegexp.String())
+	}
+
+	token = bootstraptoken.NewBootstrapToken(row.Id, row.Secret)
+
+	for name, value := range row.Annotations {
+		token.SetAnnotation(name, value)
+	}
+
+	if row.CreationTime != nil {
+		token.SetCreationTime(*row.CreationTime)
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", row.CreationTime.Format(time.RFC3339))
+	}
+
+	if row.ExpirationTime != nil {
+		token.SetExpirationTime(*row.ExpirationTime)
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", row.ExpirationTime.Format(time.RFC3339))
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "exec")
+
+	return
+}
@@ -0,0 +1,185 @@
+package cloudprovider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+// testExecPlugin stores tokens (newest first, one JSON object per line) in file "tokens" next to the script,
+// EXEC_TEST_MODE switches to failing responses
+const testExecPlugin = `#!/bin/sh
+state="$(dirname "$0")/tokens"
+response='"apiVersion":"bootstraptoken.webdevops.io/v1","kind":"ExecProviderResponse"'
+
+case "$EXEC_TEST_MODE" in
+fail)
+	echo "plugin failed" >&2
+	exit 1;;
+empty)
+	exit 0;;
+wrong-api)
+	response='"apiVersion":"bootstraptoken.webdevops.io/v2","kind":"ExecProviderResponse"';;
+esac
+
+case "$BOOTSTRAPTOKEN_EXEC_OPERATION" in
+StoreToken)
+	token=$(sed 's/.*"token":\(.*\)}$/\1/')
+	touch "$state"
+	{ echo "$token"; cat "$state"; } > "$state.new" && mv "$state.new" "$state"
+	echo "{$response}";;
+FetchToken)
+	if [ -s "$state" ]; then
+		echo "{$response,\"token\":$(head -n 1 "$state")}"
+	else
+		echo "{$response}"
+	fi;;
+FetchTokens)
+	echo "{$response,\"tokens\":[$(paste -sd, "$state" 2>/dev/null)]}";;
+esac
+`
+
+func newTestExecProvider(t *testing.T) (*CloudProviderExec, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	plugin := filepath.Join(dir, "plugin.sh")
+	if err := os.WriteFile(plugin, []byte(testExecPlugin), 0700); err != nil { // #nosec G306 -- plugin must be executable
+		t.Fatal(err)
+	}
+
+	m := &CloudProviderExec{
+		opts: &execOptions{
+			Command: stringPtr(plugin),
+			Timeout: 10 * time.Second,
+		},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, filepath.Join(dir, "tokens")
+}
+
+func TestExecStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestExecProvider(t)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("response without token must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	stored.SetAnnotation("example.com/secret-ref", "secret/123")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration of stored token, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+	if token.Annotations()["example.com/secret-ref"] != "secret/123" {
+		t.Fatalf("expected annotations of stored token, got %v", token.Annotations())
+	}
+}
+
+func TestExecFetchTokens(t *testing.T) {
+	ctx := context.Background()
+	m, state := newTestExecProvider(t)
+
+	expired := newTestToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// invalid tokens returned by plugin are ignored
+	content, err := os.ReadFile(state) // #nosec G304 -- state file of test plugin
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = append([]byte(`{"id":"INVALID","secret":"0123456789abcdef"}`+"\n"), content...)
+	if err := os.WriteFile(state, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.Id() == "expire" {
+			t.Fatal("expired token must not be fetched")
+		}
+	}
+}
+
+func TestExecFetchTokenInvalidToken(t *testing.T) {
+	m, state := newTestExecProvider(t)
+
+	for _, row := range []string{
+		`{"id":"","secret":"0123456789abcdef"}`,
+		`{"id":"aaaaa","secret":"0123456789abcdef"}`,
+		`{"id":"AAAAAA","secret":"0123456789abcdef"}`,
+		`{"id":"aaaaaa","secret":""}`,
+		`{"id":"aaaaaa","secret":"0123456789abcdefg"}`,
+		`{"id":"aaaaaa","secret":"0123456789ABCDEF"}`,
+	} {
+		if err := os.WriteFile(state, []byte(row+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := m.FetchToken(context.Background())
+		if err == nil {
+			t.Fatalf("expected error for invalid token %s, got %v", row, token)
+		}
+		if strings.Contains(err.Error(), "0123456789") {
+			t.Fatalf("token secret must not be part of error: %v", err)
+		}
+	}
+}
+
+func TestExecPluginErrors(t *testing.T) {
+	for _, mode := range []string{"fail", "empty", "wrong-api"} {
+		t.Run(mode, func(t *testing.T) {
+			m, _ := newTestExecProvider(t)
+			t.Setenv("EXEC_TEST_MODE", mode)
+
+			if token, err := m.FetchToken(context.Background()); err == nil {
+				t.Fatalf("expected error, got %v", token)
+			}
+			if tokens, err := m.FetchTokens(context.Background()); err == nil {
+				t.Fatalf("expected error, got %v", tokens)
+			}
+			if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+				t.Fatal("expected error storing token")
+			}
+		})
+	}
+}
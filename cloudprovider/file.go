@@ -0,0 +1,347 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	FILE_VERSION_SUFFIX = ".json"
+	FILE_LOCK_SUFFIX    = ".lock"
+)
+
+type (
+	CloudProviderFile struct {
+		CloudProvider
+
+		opts *fileOptions
+
+		logger *slogger.Logger
+
+		lock *flock.Flock
+	}
+
+	fileTokenVersion struct {
+		Version    int        `json:"version"`
+		Token      string     `json:"token"`
+		Created    *time.Time `json:"created,omitempty"`
+		Expiration *time.Time `json:"expiration,omitempty"`
+
+		path string
+	}
+
+	// options of file cloud provider
+	fileOptions struct {
+		Path *string `long:"file.path"    env:"FILE_PATH"    description:"Directory to store token files (eg. mounted PVC or hostPath)"`
+		Name string  `long:"file.name"    env:"FILE_NAME"    description:"Name of token files (stored as <name>.v<version>.json)" default:"kube-bootstrap-token"`
+	}
+)
+
+var (
+	fileOpts = &fileOptions{}
+)
+
+func init() {
+	Register("file", func() CloudProvider {
+		return &CloudProviderFile{opts: fileOpts}
+	})
+	RegisterOptions("file", fileOpts)
+}
+
+func (m *CloudProviderFile) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "file"),
+	)
+
+	if m.opts.Path == nil || *m.opts.Path == "" {
+		return errors.New("no file path specified")
+	}
+
+	if m.opts.Name == "" || strings.ContainsRune(m.opts.Name, os.PathSeparator) {
+		return errors.New("invalid file name specified")
+	}
+
+	if err := os.MkdirAll(*m.opts.Path, 0700); err != nil {
+		return err
+	}
+
+	m.lock = flock.New(filepath.Join(*m.opts.Path, m.opts.Name+FILE_LOCK_SUFFIX))
+
+	return nil
+}
+
+func (m *CloudProviderFile) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("path", *m.opts.Path), slog.String("name", m.opts.Name))
+
+	contextLogger.Info("fetching current token from file")
+	if err := m.lock.RLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock(contextLogger)
+
+	// versions are sorted by version, newest first
+	versionList, err := m.fetchVersions(contextLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versionList) == 0 {
+		contextLogger.Warn("no token file found, assuming non existing token")
+		return
+	}
+
+	return m.parseVersion(versionList[0]), nil
+}
+
+func (m *CloudProviderFile) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("path", *m.opts.Path), slog.String("name", m.opts.Name))
+	contextLogger.Info("fetching all tokens from files")
+
+	if err := m.lock.RLock(); err != nil {
+		return nil, err
+	}
+	defer m.unlock(contextLogger)
+
+	versionList, err := m.fetchVersions(contextLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versionList {
+		versionLogger := contextLogger.With(slog.Int("fileVersion", version.Version))
+
+		if version.Expiration != nil && time.Now().After(*version.Expiration) {
+			// expired
+			continue
+		}
+
+		if token := m.parseVersion(version); token != nil {
+			versionLogger.Info("found valid token file")
+			tokens = append(tokens, token)
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderFile) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("path", *m.opts.Path),
+		slog.String("name", m.opts.Name),
+	)
+	contextLogger.Info("storing token to file", slog.String("expiration", token.ExpirationString()))
+
+	if err := m.lock.Lock(); err != nil {
+		return err
+	}
+	defer m.unlock(contextLogger)
+
+	version := fileTokenVersion{
+		Version:    1,
+		Token:      token.FullToken(),
+		Created:    token.CreationTime(),
+		Expiration: token.ExpirationTime(),
+	}
+
+	versionList, err := m.fetchVersions(contextLogger)
+	if err != nil {
+		return err
+	}
+
+	if len(versionList) > 0 {
+		version.Version = versionList[0].Version + 1
+	}
+
+	content, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(m.versionPath(version.Version), content); err != nil {
+		return err
+	}
+
+	m.cleanupVersions(contextLogger)
+
+	return nil
+}
+
+// writes file to temporary file in same directory and renames it afterwards,
+// readers will either see the previous state or the complete file
+func writeFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // nolint:errcheck
+
+	if err := tmpFile.Chmod(0600); err != nil {
+		tmpFile.Close() // nolint:errcheck
+		return err
+	}
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close() // nolint:errcheck
+		return err
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close() // nolint:errcheck
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// persist rename
+	if dirFile, err := os.Open(dir); err == nil {
+		defer dirFile.Close() // nolint:errcheck
+		return dirFile.Sync()
+	}
+
+	return nil
+}
+
+// removes expired and superseded token files
+func (m *CloudProviderFile) cleanupVersions(logger *slogger.Logger) {
+	versionList, err := m.fetchVersions(logger)
+	if err != nil {
+		logger.Warn(`unable to fetch token files for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, version := range versionList {
+		// always keep current version
+		if num == 0 {
+			continue
+		}
+
+		if retainVersion(num, version.Expiration) {
+			continue
+		}
+
+		logger.Debug("removing token file", slog.String("file", version.path))
+		if err := os.Remove(version.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn(`unable to remove token file`, slog.Any("error", err))
+		}
+	}
+}
+
+// fetches all token files, sorted by version (newest first)
+func (m *CloudProviderFile) fetchVersions(logger *slogger.Logger) (versionList []fileTokenVersion, err error) {
+	versionList = []fileTokenVersion{}
+
+	fileList, err := filepath.Glob(filepath.Join(*m.opts.Path, m.opts.Name+".v*"+FILE_VERSION_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := m.opts.Name + ".v"
+	for _, path := range fileList {
+		versionString := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), FILE_VERSION_SUFFIX)
+		if _, err := strconv.Atoi(versionString); err != nil {
+			// not a token file
+			continue
+		}
+
+		content, err := os.ReadFile(path) // #nosec G304 -- path is built from configured directory
+		if err != nil {
+			return nil, err
+		}
+
+		version := fileTokenVersion{}
+		if err := json.Unmarshal(content, &version); err != nil {
+			logger.Warn(`unable to parse token file, ignoring`, slog.String("file", path), slog.Any("error", err))
+			continue
+		}
+		version.path = path
+
+		versionList = append(versionList, version)
+	}
+
+	sort.Slice(versionList, func(i, j int) bool {
+		return versionList[i].Version > versionList[j].Version
+	})
+
+	return
+}
+
+func (m *CloudProviderFile) parseVersion(version fileTokenVersion) (token *bootstraptoken.BootstrapToken) {
+	token = bootstraptoken.ParseFromString(version.Token)
+	if token == nil {
+		return
+	}
+
+	created := version.Created
+	if created == nil {
+		if stat, err := os.Stat(version.path); err == nil {
+			modTime := stat.ModTime()
+			created = &modTime
+		}
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	if version.Expiration != nil {
+		token.SetExpirationTime(*version.Expiration)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "file")
+	token.SetAnnotation("bootstraptoken.webdevops.io/file", version.path)
+	token.SetAnnotation("bootstraptoken.webdevops.io/fileVersion", strconv.Itoa(version.Version))
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if version.Expiration != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", version.Expiration.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderFile) versionPath(version int) string {
+	return filepath.Join(
+		*m.opts.Path,
+		fmt.Sprintf("%s.v%d%s", m.opts.Name, version, FILE_VERSION_SUFFIX),
+	)
+}
+
+func (m *CloudProviderFile) unlock(logger *slogger.Logger) {
+	if err := m.lock.Unlock(); err != nil {
+		logger.Warn(`unable to release file lock`, slog.Any("error", err))
+	}
+}
@@ -0,0 +1,220 @@
+package cloudprovider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+func newTestFileProvider(t *testing.T) (*CloudProviderFile, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "tokens")
+
+	m := &CloudProviderFile{
+		opts: &fileOptions{
+			Path: stringPtr(dir),
+			Name: "kube-bootstrap-token",
+		},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, dir
+}
+
+// tokenFiles returns names of all files in dir except lock file
+func tokenFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), FILE_LOCK_SUFFIX) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestFileStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	m, dir := newTestFileProvider(t)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing token file must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	first := newTestToken("aaaaaa", "0123456789abcdef")
+	stored := newTestToken("bbbbbb", "0123456789abcdef")
+	for _, storeToken := range []*bootstraptoken.BootstrapToken{first, stored} {
+		if err := m.StoreToken(ctx, storeToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := tokenFiles(t, dir)
+	if len(files) != 2 || files[0] != "kube-bootstrap-token.v1.json" || files[1] != "kube-bootstrap-token.v2.json" {
+		t.Fatalf("expected versioned token files without temporary files, got %v", files)
+	}
+
+	stat, err := os.Stat(filepath.Join(dir, "kube-bootstrap-token.v2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Fatalf("expected token file mode 0600, got %v", stat.Mode().Perm())
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration of stored token, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+	if token.Annotations()["bootstraptoken.webdevops.io/fileVersion"] != "2" {
+		t.Fatalf("expected file version 2, got %v", token.Annotations())
+	}
+}
+
+func TestFileFetchTokensSkipsExpiredAndInvalidFiles(t *testing.T) {
+	ctx := context.Background()
+	m, dir := newTestFileProvider(t)
+
+	valid := newTestToken("aaaaaa", "0123456789abcdef")
+	expired := newTestToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	for _, storeToken := range []*bootstraptoken.BootstrapToken{valid, expired} {
+		if err := m.StoreToken(ctx, storeToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other files in directory are ignored
+	for name, content := range map[string]string{
+		"kube-bootstrap-token.v3.json":      "{invalid",
+		"kube-bootstrap-token.vtest.json":   "{}",
+		"other-bootstrap-token.v9.json":     `{"version":9,"token":"zzzzzz.0123456789abcdef"}`,
+		".kube-bootstrap-token.v4.json.tmp": `{"version":4,"token":"zzzzzz.0123456789abcdef"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Id() != "aaaaaa" {
+		t.Fatalf("expected only valid token aaaaaa, got %v", tokens)
+	}
+
+	// expired token is still the current token
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Id() != "expire" {
+		t.Fatalf("expected current token expire, got %v", token)
+	}
+}
+
+func TestFileStoreTokenCleansUpVersions(t *testing.T) {
+	ctx := context.Background()
+	m, dir := newTestFileProvider(t)
+
+	expired := newTestToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if files := tokenFiles(t, dir); len(files) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d token files, got %v", SECRET_SYNC_COUNT_MAX, files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "kube-bootstrap-token.v1.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected expired token file to be removed, got %v", err)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+
+	// versions continue after removed files
+	if err := m.StoreToken(ctx, newTestToken("cccccc", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.versionPath(SECRET_SYNC_COUNT_MAX + 4)); err != nil {
+		t.Fatalf("expected token file version %d, got %v", SECRET_SYNC_COUNT_MAX+4, err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.json")
+
+	if err := os.WriteFile(path, []byte("previous content which is longer"), 0644); err != nil { // #nosec G306 -- mode is replaced by write
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path) // #nosec G304 -- test file
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Fatalf("expected file to be replaced, got %q", content)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary file to be renamed, got %v", entries)
+	}
+
+	// target can't be replaced (directory), temporary file must be removed
+	target := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Join(target, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(target, []byte("content")); err == nil {
+		t.Fatal("expected error replacing non empty directory")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Fatalf("expected temporary file to be removed after failed rename, got %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,458 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+	"golang.org/x/oauth2/google"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	GCP_ANNOTATION_EXPIRES_PREFIX = "expires-v"
+	GCP_ANNOTATION_RETRY_MAX      = 5
+)
+
+type (
+	CloudProviderGcp struct {
+		CloudProvider
+
+		opts *gcpOptions
+
+		logger    *slogger.Logger
+		userAgent string
+
+		client *http.Client
+	}
+
+	gcpSecret struct {
+		Name        string                `json:"name,omitempty"`
+		Labels      map[string]string     `json:"labels,omitempty"`
+		Annotations map[string]string     `json:"annotations,omitempty"`
+		Replication *gcpSecretReplication `json:"replication,omitempty"`
+		Etag        string                `json:"etag,omitempty"`
+	}
+
+	gcpSecretReplication struct {
+		Automatic *struct{} `json:"automatic,omitempty"`
+	}
+
+	gcpSecretVersion struct {
+		Name       string    `json:"name"`
+		CreateTime time.Time `json:"createTime"`
+		State      string    `json:"state"`
+	}
+
+	gcpSecretVersionList struct {
+		Versions      []gcpSecretVersion `json:"versions"`
+		NextPageToken string             `json:"nextPageToken"`
+	}
+
+	gcpSecretPayload struct {
+		Name    string `json:"name,omitempty"`
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+
+	gcpError struct {
+		StatusCode int
+		Code       int    `json:"code"`
+		Message    string `json:"message"`
+		Status     string `json:"status"`
+	}
+
+	// options of GCP Secret Manager cloud provider
+	gcpOptions struct {
+		Project    *string `long:"gcp.project"     env:"GCP_PROJECT"     description:"GCP project of Secret Manager secret to sync token"`
+		SecretName *string `long:"gcp.secret"      env:"GCP_SECRET"      description:"Name of Secret Manager secret to sync token" default:"kube-bootstrap-token"`
+		Endpoint   string  `long:"gcp.endpoint"    env:"GCP_ENDPOINT"    description:"Secret Manager API endpoint (eg. for local mock endpoints)" default:"https://secretmanager.googleapis.com"`
+	}
+)
+
+var (
+	gcpOpts = &gcpOptions{}
+)
+
+func init() {
+	Register("gcp", func() CloudProvider {
+		return &CloudProviderGcp{opts: gcpOpts}
+	})
+	RegisterOptions("gcp", gcpOpts)
+}
+
+func (e *gcpError) Error() string {
+	return fmt.Sprintf("gcp secret manager request failed with status %d (%s): %s", e.StatusCode, e.Status, e.Message)
+}
+
+func (m *CloudProviderGcp) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	var err error
+	m.userAgent = userAgent
+	m.logger = logger.With(
+		slog.String("cloudprovider", "gcp"),
+	)
+
+	if m.opts.Project == nil || *m.opts.Project == "" {
+		return errors.New("no GCP project specified")
+	}
+
+	if m.opts.SecretName == nil || *m.opts.SecretName == "" {
+		return errors.New("no GCP Secret Manager secret name specified")
+	}
+
+	m.client, err = google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *CloudProviderGcp) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	secretName := *m.opts.SecretName
+
+	contextLogger := m.logger.With(slog.String("project", *m.opts.Project), slog.String("secretName", secretName))
+
+	contextLogger.Info("fetching current token from GCP Secret Manager")
+	secret, versionList, err := m.fetchSecretVersions(ctx)
+	if err != nil {
+		return nil, m.handleGcpError(contextLogger, err)
+	}
+
+	if len(versionList) == 0 {
+		return
+	}
+
+	// versions are sorted, newest first
+	token, err = m.accessSecretVersion(ctx, secret, versionList[0])
+	if err != nil {
+		return nil, m.handleGcpError(contextLogger, err)
+	}
+
+	return
+}
+
+func (m *CloudProviderGcp) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+	secretName := *m.opts.SecretName
+
+	contextLogger := m.logger.With(slog.String("project", *m.opts.Project), slog.String("secretName", secretName))
+	contextLogger.Info("fetching all tokens from GCP Secret Manager")
+
+	secret, versionList, err := m.fetchSecretVersions(ctx)
+	if err != nil {
+		return tokens, m.handleGcpError(contextLogger, err)
+	}
+
+	for _, secretVersion := range versionList {
+		secretLogger := contextLogger.With(slog.String("secretVersion", path.Base(secretVersion.Name)))
+
+		if expires := gcpSecretVersionExpiration(secret, secretVersion); expires != nil && time.Now().After(*expires) {
+			// expired
+			continue
+		}
+
+		token, err := m.accessSecretVersion(ctx, secret, secretVersion)
+		if err != nil {
+			secretLogger.Warn(`unable to fetch secret`, slog.Any("error", err))
+			continue
+		}
+
+		if token != nil {
+			secretLogger.Info("found valid secret")
+			tokens = append(tokens, token)
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderGcp) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	secretName := *m.opts.SecretName
+
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("project", *m.opts.Project),
+		slog.String("secretName", secretName),
+	)
+	contextLogger.Info("storing token to GCP Secret Manager", slog.String("expiration", token.ExpirationString()))
+
+	secret := gcpSecret{}
+	err := m.request(ctx, http.MethodGet, m.secretPath(), nil, nil, &secret)
+	var gcpErr *gcpError
+	if errors.As(err, &gcpErr) && gcpErr.StatusCode == http.StatusNotFound {
+		// secret doesn't exist yet, create it
+		contextLogger.Info("creating new GCP Secret Manager secret")
+		secret = gcpSecret{
+			Labels: map[string]string{
+				"managed-by": "kube-bootstrap-token-manager",
+			},
+			Replication: &gcpSecretReplication{
+				Automatic: &struct{}{},
+			},
+		}
+
+		query := url.Values{}
+		query.Set("secretId", secretName)
+		err = m.request(ctx, http.MethodPost, fmt.Sprintf("projects/%s/secrets", *m.opts.Project), query, secret, &secret)
+	}
+	if err != nil {
+		return err
+	}
+
+	payload := gcpSecretPayload{}
+	payload.Payload.Data = base64.StdEncoding.EncodeToString([]byte(token.FullToken()))
+
+	secretVersion := gcpSecretVersion{}
+	if err := m.request(ctx, http.MethodPost, m.secretPath()+":addVersion", nil, payload, &secretVersion); err != nil {
+		return err
+	}
+
+	// version is stored, failed annotation or cleanup must not fail the store (token would be removed from cluster)
+	version := path.Base(secretVersion.Name)
+	if expires := token.ExpirationTime(); expires != nil {
+		err := m.updateSecretAnnotations(ctx, func(annotations map[string]string) {
+			annotations[GCP_ANNOTATION_EXPIRES_PREFIX+version] = expires.UTC().Format(time.RFC3339)
+		})
+		if err != nil {
+			contextLogger.Warn("unable to annotate expiration of secret version", slog.String("secretVersion", version), slog.Any("error", err))
+		}
+	}
+
+	m.cleanupSecretVersions(ctx, contextLogger, version)
+
+	return nil
+}
+
+// destroys expired and superseded versions and removes annotations of destroyed or not enabled versions,
+// failures are only logged and retried on next store
+func (m *CloudProviderGcp) cleanupSecretVersions(ctx context.Context, logger *slogger.Logger, version string) {
+	secret, versionList, err := m.fetchSecretVersions(ctx)
+	if err != nil {
+		logger.Warn("unable to fetch secret versions for cleanup", slog.Any("error", err))
+		return
+	}
+
+	retainedVersions := map[string]bool{version: true}
+	for num, secretVersion := range versionList {
+		name := path.Base(secretVersion.Name)
+
+		// always keep current version
+		if num == 0 || name == version || retainVersion(num, gcpSecretVersionExpiration(secret, secretVersion)) {
+			retainedVersions[name] = true
+			continue
+		}
+
+		logger.Debug("destroying secret version", slog.String("secretVersion", name))
+		if err := m.request(ctx, http.MethodPost, secretVersion.Name+":destroy", nil, struct{}{}, nil); err != nil {
+			// version is still enabled, so its expiry must be kept
+			logger.Warn(`unable to destroy secret version`, slog.Any("error", err))
+			retainedVersions[name] = true
+		}
+	}
+
+	err = m.updateSecretAnnotations(ctx, func(annotations map[string]string) {
+		for name := range annotations {
+			if annotationVersion, ok := strings.CutPrefix(name, GCP_ANNOTATION_EXPIRES_PREFIX); ok && !retainedVersions[annotationVersion] {
+				delete(annotations, name)
+			}
+		}
+	})
+	if err != nil {
+		logger.Warn("unable to remove annotations of destroyed secret versions", slog.Any("error", err))
+	}
+}
+
+// updates secret annotations (GCP has no per version expiry, so it's stored as secret annotation per version),
+// update uses the etag of the secret and is retried if annotations were changed concurrently
+func (m *CloudProviderGcp) updateSecretAnnotations(ctx context.Context, update func(annotations map[string]string)) (err error) {
+	for range GCP_ANNOTATION_RETRY_MAX {
+		secret := gcpSecret{}
+		if err = m.request(ctx, http.MethodGet, m.secretPath(), nil, nil, &secret); err != nil {
+			return err
+		}
+
+		annotations := maps.Clone(secret.Annotations)
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		update(annotations)
+		if maps.Equal(annotations, secret.Annotations) {
+			return nil
+		}
+
+		query := url.Values{}
+		query.Set("updateMask", "annotations")
+		patch := gcpSecret{
+			Annotations: annotations,
+			Etag:        secret.Etag,
+		}
+		err = m.request(ctx, http.MethodPatch, m.secretPath(), query, patch, nil)
+
+		var gcpErr *gcpError
+		if !errors.As(err, &gcpErr) || gcpErr.StatusCode != http.StatusConflict {
+			return err
+		}
+	}
+
+	return err
+}
+
+// fetches secret and all enabled versions, sorted by creation time (newest first)
+func (m *CloudProviderGcp) fetchSecretVersions(ctx context.Context) (secret *gcpSecret, versionList []gcpSecretVersion, err error) {
+	secret = &gcpSecret{}
+	if err = m.request(ctx, http.MethodGet, m.secretPath(), nil, nil, secret); err != nil {
+		return
+	}
+
+	query := url.Values{}
+	query.Set("filter", "state:ENABLED")
+	for {
+		result := gcpSecretVersionList{}
+		if err = m.request(ctx, http.MethodGet, m.secretPath()+"/versions", query, nil, &result); err != nil {
+			return
+		}
+
+		versionList = append(versionList, result.Versions...)
+
+		if result.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+
+	sort.Slice(versionList, func(i, j int) bool {
+		return versionList[i].CreateTime.After(versionList[j].CreateTime)
+	})
+
+	return
+}
+
+func (m *CloudProviderGcp) accessSecretVersion(ctx context.Context, secret *gcpSecret, secretVersion gcpSecretVersion) (*bootstraptoken.BootstrapToken, error) {
+	result := gcpSecretPayload{}
+	if err := m.request(ctx, http.MethodGet, secretVersion.Name+":access", nil, nil, &result); err != nil {
+		return nil, err
+	}
+
+	value, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	token := bootstraptoken.ParseFromString(string(value))
+	if token != nil {
+		token.SetCreationTime(secretVersion.CreateTime)
+
+		expires := gcpSecretVersionExpiration(secret, secretVersion)
+		if expires != nil {
+			token.SetExpirationTime(*expires)
+		}
+
+		token.SetAnnotation("bootstraptoken.webdevops.io/provider", "gcp")
+		token.SetAnnotation("bootstraptoken.webdevops.io/project", *m.opts.Project)
+		token.SetAnnotation("bootstraptoken.webdevops.io/secret", *m.opts.SecretName)
+		token.SetAnnotation("bootstraptoken.webdevops.io/secretVersion", path.Base(secretVersion.Name))
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", secretVersion.CreateTime.Format(time.RFC3339))
+
+		if expires != nil {
+			token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+		}
+	}
+
+	return token, nil
+}
+
+func (m *CloudProviderGcp) secretPath() string {
+	return fmt.Sprintf("projects/%s/secrets/%s", *m.opts.Project, *m.opts.SecretName)
+}
+
+// sends request to Secret Manager REST API (v1)
+func (m *CloudProviderGcp) request(ctx context.Context, method, resourcePath string, query url.Values, body, result interface{}) error {
+	requestUrl := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(m.opts.Endpoint, "/"), resourcePath)
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, requestBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", m.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode >= 300 {
+		errorResponse := struct {
+			Error gcpError `json:"error"`
+		}{}
+		_ = json.NewDecoder(resp.Body).Decode(&errorResponse)
+		errorResponse.Error.StatusCode = resp.StatusCode
+		return &errorResponse.Error
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return nil
+}
+
+func (m *CloudProviderGcp) handleGcpError(logger *slogger.Logger, err error) error {
+	var gcpErr *gcpError
+	statusCode := 0
+	if errors.As(err, &gcpErr) {
+		statusCode = gcpErr.StatusCode
+	}
+
+	return handleFetchError(logger, err, statusCode == http.StatusNotFound, statusCode == http.StatusForbidden, "secret", "unable to access GCP Secret Manager, please check access")
+}
+
+func gcpSecretVersionExpiration(secret *gcpSecret, secretVersion gcpSecretVersion) *time.Time {
+	if secret == nil {
+		return nil
+	}
+
+	if val, exists := secret.Annotations[GCP_ANNOTATION_EXPIRES_PREFIX+path.Base(secretVersion.Name)]; exists {
+		if expires, err := time.Parse(time.RFC3339, val); err == nil {
+			return &expires
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,369 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+)
+
+const (
+	testGcpSecretPath = "/v1/projects/project/secrets/kube-bootstrap-token"
+
+	// page size of version list (to test paging)
+	testGcpPageSize = 5
+)
+
+type (
+	// fakeSecretManager is a minimal in-memory GCP Secret Manager (REST API v1) for one secret
+	fakeSecretManager struct {
+		server *httptest.Server
+
+		lock     sync.Mutex
+		secret   *gcpSecret
+		versions []*fakeSecretManagerVersion
+		clock    time.Time
+
+		// optional status code returned for all requests
+		failStatusCode int
+
+		// called before secret annotations are updated (eg. to simulate concurrent writes)
+		beforePatch func()
+	}
+
+	fakeSecretManagerVersion struct {
+		gcpSecretVersion
+		data string
+	}
+)
+
+func newFakeSecretManager(t *testing.T) *fakeSecretManager {
+	t.Helper()
+	sm := &fakeSecretManager{
+		clock: time.Now().Add(-time.Hour).Truncate(time.Second).UTC(),
+	}
+	sm.server = httptest.NewServer(http.HandlerFunc(sm.serveHTTP))
+	t.Cleanup(sm.server.Close)
+	return sm
+}
+
+// annotationCount returns number of expiry annotations
+func (sm *fakeSecretManager) annotationCount() int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	count := 0
+	for name := range sm.secret.Annotations {
+		if strings.HasPrefix(name, GCP_ANNOTATION_EXPIRES_PREFIX) {
+			count++
+		}
+	}
+	return count
+}
+
+// versionCount returns number of versions in state
+func (sm *fakeSecretManager) versionCount(state string) int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	count := 0
+	for _, version := range sm.versions {
+		if version.State == state {
+			count++
+		}
+	}
+	return count
+}
+
+func (sm *fakeSecretManager) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPatch && sm.beforePatch != nil {
+		sm.beforePatch()
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	if sm.failStatusCode != 0 {
+		sm.writeError(w, sm.failStatusCode, "PERMISSION_DENIED")
+		return
+	}
+
+	if sm.secret == nil && !(r.Method == http.MethodPost && r.URL.Path == "/v1/projects/project/secrets") {
+		sm.writeError(w, http.StatusNotFound, "NOT_FOUND")
+		return
+	}
+
+	versionPath := testGcpSecretPath + "/versions/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/projects/project/secrets":
+		if sm.secret != nil {
+			sm.writeError(w, http.StatusConflict, "ALREADY_EXISTS")
+			return
+		}
+		secret := gcpSecret{}
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil || r.URL.Query().Get("secretId") != "kube-bootstrap-token" {
+			sm.writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT")
+			return
+		}
+		secret.Name = strings.TrimPrefix(testGcpSecretPath, "/v1/")
+		secret.Etag = `"1"`
+		sm.secret = &secret
+		sm.writeJSON(w, sm.secret)
+	case r.Method == http.MethodGet && r.URL.Path == testGcpSecretPath:
+		sm.writeJSON(w, sm.secret)
+	case r.Method == http.MethodPatch && r.URL.Path == testGcpSecretPath:
+		patch := gcpSecret{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || r.URL.Query().Get("updateMask") != "annotations" {
+			sm.writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT")
+			return
+		}
+		if patch.Etag != "" && patch.Etag != sm.secret.Etag {
+			sm.writeError(w, http.StatusConflict, "ABORTED")
+			return
+		}
+		sm.updateAnnotations(patch.Annotations)
+		sm.writeJSON(w, sm.secret)
+	case r.Method == http.MethodPost && r.URL.Path == testGcpSecretPath+":addVersion":
+		payload := gcpSecretPayload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			sm.writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT")
+			return
+		}
+		sm.clock = sm.clock.Add(time.Second)
+		version := &fakeSecretManagerVersion{
+			gcpSecretVersion: gcpSecretVersion{
+				Name:       fmt.Sprintf("%s/versions/%d", strings.TrimPrefix(testGcpSecretPath, "/v1/"), len(sm.versions)+1),
+				CreateTime: sm.clock,
+				State:      "ENABLED",
+			},
+			data: payload.Payload.Data,
+		}
+		sm.versions = append(sm.versions, version)
+		sm.writeJSON(w, version.gcpSecretVersion)
+	case r.Method == http.MethodGet && r.URL.Path == testGcpSecretPath+"/versions":
+		versionList := []gcpSecretVersion{}
+		for _, version := range sm.versions {
+			if r.URL.Query().Get("filter") == "state:ENABLED" && version.State != "ENABLED" {
+				continue
+			}
+			versionList = append(versionList, version.gcpSecretVersion)
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		result := gcpSecretVersionList{Versions: versionList[min(offset, len(versionList)):]}
+		if len(result.Versions) > testGcpPageSize {
+			result.Versions = result.Versions[:testGcpPageSize]
+			result.NextPageToken = strconv.Itoa(offset + testGcpPageSize)
+		}
+		sm.writeJSON(w, result)
+	case strings.HasPrefix(r.URL.Path, versionPath):
+		versionName, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, versionPath), ":")
+		num, err := strconv.Atoi(versionName)
+		if err != nil || num < 1 || num > len(sm.versions) {
+			sm.writeError(w, http.StatusNotFound, "NOT_FOUND")
+			return
+		}
+		version := sm.versions[num-1]
+		switch {
+		case r.Method == http.MethodGet && action == "access":
+			if version.State != "ENABLED" {
+				sm.writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION")
+				return
+			}
+			payload := gcpSecretPayload{Name: version.Name}
+			payload.Payload.Data = version.data
+			sm.writeJSON(w, payload)
+		case r.Method == http.MethodPost && action == "destroy":
+			version.State = "DESTROYED"
+			version.data = ""
+			sm.writeJSON(w, version.gcpSecretVersion)
+		default:
+			sm.writeError(w, http.StatusNotFound, "NOT_FOUND")
+		}
+	default:
+		sm.writeError(w, http.StatusNotFound, "NOT_FOUND")
+	}
+}
+
+// updateAnnotations replaces secret annotations and changes etag
+func (sm *fakeSecretManager) updateAnnotations(annotations map[string]string) {
+	etag, _ := strconv.Atoi(strings.Trim(sm.secret.Etag, `"`))
+	sm.secret.Annotations = annotations
+	sm.secret.Etag = fmt.Sprintf(`"%d"`, etag+1)
+}
+
+func (sm *fakeSecretManager) writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (sm *fakeSecretManager) writeError(w http.ResponseWriter, statusCode int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": gcpError{Code: statusCode, Message: "fake error", Status: status}})
+}
+
+func newTestGcpProvider(sm *fakeSecretManager) *CloudProviderGcp {
+	return &CloudProviderGcp{
+		opts: &gcpOptions{
+			Project:    stringPtr("project"),
+			SecretName: stringPtr("kube-bootstrap-token"),
+			Endpoint:   sm.server.URL,
+		},
+		logger:    newTestLogger(),
+		userAgent: "test",
+		client:    sm.server.Client(),
+	}
+}
+
+func TestGcpStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	sm := newFakeSecretManager(t)
+	m := newTestGcpProvider(sm)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing secret must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected expiration %v from secret annotation, got %v", stored.ExpirationTime(), token.ExpirationTime())
+	}
+}
+
+func TestGcpStoreTokenCleansUpVersionsAndAnnotations(t *testing.T) {
+	ctx := context.Background()
+	sm := newFakeSecretManager(t)
+	m := newTestGcpProvider(sm)
+
+	expired := bootstraptoken.NewBootstrapToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	// manually disabled version with stale annotation
+	if err := m.StoreToken(ctx, newTestToken("disabl", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	sm.lock.Lock()
+	sm.versions[1].State = "DISABLED"
+	sm.lock.Unlock()
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := sm.versionCount("ENABLED"); count != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d enabled versions, got %d", SECRET_SYNC_COUNT_MAX, count)
+	}
+
+	// only enabled versions keep their expiry annotation
+	if count := sm.annotationCount(); count != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d expiry annotations, got %d", SECRET_SYNC_COUNT_MAX, count)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.ExpirationTime() == nil {
+			t.Fatalf("expected expiration of token %s", token.Id())
+		}
+	}
+}
+
+func TestGcpStoreTokenAnnotationConflict(t *testing.T) {
+	ctx := context.Background()
+	sm := newFakeSecretManager(t)
+	m := newTestGcpProvider(sm)
+
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	// annotations are changed between reading the secret and updating it
+	sm.beforePatch = func() {
+		sm.lock.Lock()
+		defer sm.lock.Unlock()
+		sm.updateAnnotations(map[string]string{"other": "value"})
+		sm.beforePatch = nil
+	}
+
+	// annotation update is retried with new etag
+	if err := m.StoreToken(ctx, newTestToken("bbbbbb", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if sm.secret.Annotations["other"] != "value" {
+		t.Fatal("concurrently updated annotations must not be overwritten")
+	}
+	if _, exists := sm.secret.Annotations[GCP_ANNOTATION_EXPIRES_PREFIX+"2"]; !exists {
+		t.Fatalf("expected expiration annotation of new version, got %v", sm.secret.Annotations)
+	}
+}
+
+func TestGcpStoreTokenAnnotationFailure(t *testing.T) {
+	ctx := context.Background()
+	sm := newFakeSecretManager(t)
+	m := newTestGcpProvider(sm)
+
+	// annotations are changed on every update
+	sm.beforePatch = func() {
+		sm.lock.Lock()
+		defer sm.lock.Unlock()
+		sm.updateAnnotations(map[string]string{"other": "value"})
+	}
+
+	// version is stored, so failed annotation must not fail the store (and roll back the secret in cluster)
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatalf("expected store to succeed without annotation, got %v", err)
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+}
+
+func TestGcpFetchTokenForbidden(t *testing.T) {
+	sm := newFakeSecretManager(t)
+	m := newTestGcpProvider(sm)
+	sm.failStatusCode = http.StatusForbidden
+
+	if _, err := m.FetchToken(context.Background()); err == nil {
+		t.Fatal("expected error without access")
+	}
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
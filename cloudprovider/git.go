@@ -0,0 +1,590 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/gofrs/flock"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	GIT_ENCRYPTION_AGE  = "age"
+	GIT_ENCRYPTION_SOPS = "sops"
+
+	GIT_REMOTE_NAME = "origin"
+	GIT_LOCK_FILE   = "kube-bootstrap-token-manager.lock"
+
+	GIT_RESET_TIMEOUT = 1 * time.Minute
+)
+
+type (
+	CloudProviderGit struct {
+		CloudProvider
+
+		opts *gitOptions
+
+		logger *slogger.Logger
+
+		lock *flock.Flock
+
+		ageRecipients []age.Recipient
+		ageIdentities []age.Identity
+	}
+
+	// content of token file (before encryption)
+	gitTokenFile struct {
+		Token      string     `json:"token"`
+		Created    *time.Time `json:"created,omitempty"`
+		Expiration *time.Time `json:"expiration,omitempty"`
+	}
+
+	// options of git cloud provider
+	gitOptions struct {
+		Path            *string  `long:"git.path"                env:"GIT_PATH"                                description:"Path of git working tree to sync token (cloned from remote or initialized if not existing)"`
+		File            string   `long:"git.file"                env:"GIT_FILE"                                description:"Path of encrypted token file inside git working tree" default:"kube-bootstrap-token.enc.json"`
+		Remote          string   `long:"git.remote"              env:"GIT_REMOTE"                              description:"Git remote to pull from and push to (URL or path of bare repository, optional)"`
+		Branch          string   `long:"git.branch"              env:"GIT_BRANCH"                              description:"Git branch" default:"main"`
+		AuthorName      string   `long:"git.author.name"         env:"GIT_COMMIT_AUTHOR_NAME"                  description:"Author name of git commits" default:"kube-bootstrap-token-manager"`
+		AuthorEmail     string   `long:"git.author.email"        env:"GIT_COMMIT_AUTHOR_EMAIL"                 description:"Author email of git commits" default:"kube-bootstrap-token-manager@localhost"`
+		Encryption      string   `long:"git.encryption"          env:"GIT_ENCRYPTION"                          description:"Encryption of token file" choice:"age" choice:"sops" default:"age"` // nolint:staticcheck // multiple choices are ok
+		AgeRecipients   []string `long:"git.age.recipient"       env:"GIT_AGE_RECIPIENTS"       env-delim:","  description:"age recipients for encryption (defaults to recipients of age identities)"`
+		AgeIdentityFile string   `long:"git.age.identity-file"   env:"GIT_AGE_IDENTITY_FILE"                   description:"age identity file for decryption (also passed to sops as SOPS_AGE_KEY_FILE)"`
+		SopsBinary      string   `long:"git.sops.binary"         env:"GIT_SOPS_BINARY"                         description:"Path of sops binary" default:"sops"`
+	}
+)
+
+var (
+	gitOpts = &gitOptions{}
+)
+
+func init() {
+	Register("git", func() CloudProvider {
+		return &CloudProviderGit{opts: gitOpts}
+	})
+	RegisterOptions("git", gitOpts)
+}
+
+func (m *CloudProviderGit) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "git"),
+	)
+
+	if m.opts.Path == nil || *m.opts.Path == "" {
+		return errors.New("no git path specified")
+	}
+
+	if m.opts.File == "" || filepath.IsAbs(m.opts.File) {
+		return errors.New("git file must be a relative path inside the git working tree")
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return err
+	}
+
+	switch m.opts.Encryption {
+	case GIT_ENCRYPTION_AGE:
+		if err := m.initAge(); err != nil {
+			return err
+		}
+	case GIT_ENCRYPTION_SOPS:
+		if _, err := exec.LookPath(m.opts.SopsBinary); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf(`unsupported git encryption "%s"`, m.opts.Encryption)
+	}
+
+	if err := m.initRepository(ctx); err != nil {
+		return err
+	}
+
+	gitDir, err := m.git(ctx, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return err
+	}
+	m.lock = flock.New(filepath.Join(strings.TrimSpace(gitDir), GIT_LOCK_FILE))
+
+	return nil
+}
+
+// parses age identities (for decryption) and recipients (for encryption), if no recipients are
+// specified the recipients of the identities are used
+func (m *CloudProviderGit) initAge() error {
+	if m.opts.AgeIdentityFile == "" {
+		return errors.New("no age identity file specified")
+	}
+
+	identityFile, err := os.Open(m.opts.AgeIdentityFile)
+	if err != nil {
+		return err
+	}
+	defer identityFile.Close() // nolint:errcheck
+
+	m.ageIdentities, err = age.ParseIdentities(identityFile)
+	if err != nil {
+		return fmt.Errorf(`unable to parse age identity file: %w`, err)
+	}
+
+	for _, recipient := range m.opts.AgeRecipients {
+		ageRecipient, err := age.ParseX25519Recipient(strings.TrimSpace(recipient))
+		if err != nil {
+			return fmt.Errorf(`unable to parse age recipient: %w`, err)
+		}
+		m.ageRecipients = append(m.ageRecipients, ageRecipient)
+	}
+
+	if len(m.ageRecipients) == 0 {
+		for _, identity := range m.ageIdentities {
+			if x25519Identity, ok := identity.(*age.X25519Identity); ok {
+				m.ageRecipients = append(m.ageRecipients, x25519Identity.Recipient())
+			}
+		}
+	}
+
+	if len(m.ageRecipients) == 0 {
+		return errors.New("no age recipients specified")
+	}
+
+	return nil
+}
+
+// clones remote or initializes new git repository if working tree doesn't exist yet
+func (m *CloudProviderGit) initRepository(ctx context.Context) error {
+	path := *m.opts.Path
+
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if m.opts.Remote != "" {
+		m.logger.Info("cloning git repository", slog.String("remote", m.opts.Remote), slog.String("path", path))
+		if _, err := m.gitInDir(ctx, "", "clone", "--origin", GIT_REMOTE_NAME, m.opts.Remote, path); err != nil {
+			return err
+		}
+
+		// cloned repository is on the default branch of the remote, configured branch might not exist yet
+		// (eg. empty remote), it must not be based on the default branch then
+		remoteBranch := GIT_REMOTE_NAME + "/" + m.opts.Branch
+		if _, err := m.git(ctx, "rev-parse", "--verify", "--quiet", "refs/remotes/"+remoteBranch); err == nil {
+			if _, err := m.git(ctx, "checkout", "-B", m.opts.Branch, remoteBranch); err != nil {
+				return err
+			}
+		} else {
+			if _, err := m.git(ctx, "switch", "--orphan", m.opts.Branch); err != nil {
+				return err
+			}
+		}
+	} else {
+		m.logger.Info("initializing git repository", slog.String("path", path))
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+
+		if _, err := m.git(ctx, "init", "--initial-branch", m.opts.Branch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *CloudProviderGit) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("path", *m.opts.Path), slog.String("file", m.opts.File))
+
+	contextLogger.Info("fetching current token from git")
+	err = m.withLock(contextLogger, func() error {
+		if err := m.pull(ctx, contextLogger); err != nil {
+			return err
+		}
+
+		commits, err := m.fetchCommits(ctx, contextLogger, 1)
+		if err != nil {
+			return err
+		}
+
+		if len(commits) == 0 {
+			contextLogger.Warn("no token file found in git, assuming non existing token")
+			return nil
+		}
+
+		token, err = m.parseCommit(ctx, contextLogger, commits[0])
+		return err
+	})
+
+	return
+}
+
+func (m *CloudProviderGit) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("path", *m.opts.Path), slog.String("file", m.opts.File))
+	contextLogger.Info("fetching all tokens from git history")
+
+	err = m.withLock(contextLogger, func() error {
+		if err := m.pull(ctx, contextLogger); err != nil {
+			return err
+		}
+
+		commits, err := m.fetchCommits(ctx, contextLogger, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, commit := range commits {
+			commitLogger := contextLogger.With(slog.String("commit", commit))
+
+			// old commits might not be readable anymore (eg. encrypted with rotated keys)
+			token, err := m.parseCommit(ctx, commitLogger, commit)
+			if err != nil {
+				commitLogger.Warn(`unable to read token from commit, ignoring`, slog.Any("error", err))
+				continue
+			}
+
+			if token == nil {
+				continue
+			}
+
+			if token.ExpirationTime() != nil && time.Now().After(*token.ExpirationTime()) {
+				// expired
+				continue
+			}
+
+			commitLogger.Info("found valid token file")
+			tokens = append(tokens, token)
+
+			if syncLimitReached(tokens) {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (m *CloudProviderGit) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("path", *m.opts.Path),
+		slog.String("file", m.opts.File),
+	)
+	contextLogger.Info("storing token to git", slog.String("expiration", token.ExpirationString()))
+
+	content, err := json.MarshalIndent(gitTokenFile{
+		Token:      token.FullToken(),
+		Created:    token.CreationTime(),
+		Expiration: token.ExpirationTime(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	content, err = m.encrypt(ctx, content)
+	if err != nil {
+		return err
+	}
+
+	return m.withLock(contextLogger, func() error {
+		if err := m.pull(ctx, contextLogger); err != nil {
+			return err
+		}
+
+		path := filepath.Join(*m.opts.Path, m.opts.File)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+
+		// commit before token commit (empty if repository has no commits yet)
+		previous, _ := m.git(ctx, "rev-parse", "--verify", "--quiet", "HEAD")
+
+		if err := writeFileAtomic(path, content); err != nil {
+			return err
+		}
+
+		if _, err := m.git(ctx, "add", "--", m.opts.File); err != nil {
+			return err
+		}
+
+		_, err := m.git(ctx,
+			"-c", "user.name="+m.opts.AuthorName,
+			"-c", "user.email="+m.opts.AuthorEmail,
+			"commit",
+			"--no-verify",
+			"--message", fmt.Sprintf("Rotate bootstrap token %s", token.Id()),
+			"--", m.opts.File,
+		)
+		if err != nil {
+			return err
+		}
+
+		if m.opts.Remote != "" {
+			contextLogger.Info("pushing token to git remote")
+			if _, err := m.git(ctx, "push", GIT_REMOTE_NAME, "HEAD:refs/heads/"+m.opts.Branch); err != nil {
+				m.resetToRemote(ctx, contextLogger, strings.TrimSpace(previous))
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// fetches commits changing the token file (newest first), limit 0 fetches all commits
+func (m *CloudProviderGit) fetchCommits(ctx context.Context, logger *slogger.Logger, limit int) (commitList []string, err error) {
+	commitList = []string{}
+
+	// repository without any commit
+	if _, err := m.git(ctx, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		return commitList, nil
+	}
+
+	args := []string{"log", "--format=%H"}
+	if limit > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", limit))
+	}
+	args = append(args, "--", m.opts.File)
+
+	output, err := m.git(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, commit := range strings.Split(output, "\n") {
+		if commit = strings.TrimSpace(commit); commit != "" {
+			commitList = append(commitList, commit)
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderGit) parseCommit(ctx context.Context, logger *slogger.Logger, commit string) (token *bootstraptoken.BootstrapToken, err error) {
+	// file might be deleted in commit
+	content, err := m.git(ctx, "show", fmt.Sprintf("%s:%s", commit, filepath.ToSlash(m.opts.File)))
+	if err != nil {
+		logger.Warn(`unable to read token file from git, ignoring`, slog.Any("error", err))
+		return nil, nil
+	}
+
+	plaintext, err := m.decrypt(ctx, []byte(content))
+	if err != nil {
+		return nil, fmt.Errorf(`unable to decrypt token file: %w`, err)
+	}
+
+	tokenFile := gitTokenFile{}
+	if err := json.Unmarshal(plaintext, &tokenFile); err != nil {
+		logger.Warn(`unable to parse token file, ignoring`, slog.Any("error", err))
+		return nil, nil
+	}
+
+	token = bootstraptoken.ParseFromString(tokenFile.Token)
+	if token == nil {
+		return nil, nil
+	}
+
+	created := tokenFile.Created
+	if created == nil {
+		if commitTime, err := m.git(ctx, "show", "--no-patch", "--format=%cI", commit); err == nil {
+			if val, err := time.Parse(time.RFC3339, strings.TrimSpace(commitTime)); err == nil {
+				created = &val
+			}
+		}
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	if tokenFile.Expiration != nil {
+		token.SetExpirationTime(*tokenFile.Expiration)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "git")
+	token.SetAnnotation("bootstraptoken.webdevops.io/file", m.opts.File)
+	token.SetAnnotation("bootstraptoken.webdevops.io/commit", commit)
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if tokenFile.Expiration != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", tokenFile.Expiration.Format(time.RFC3339))
+	}
+
+	return
+}
+
+// resets the working tree to the remote branch after a failed push, otherwise the unpushed commit would be read
+// as current token and block following pulls (--ff-only) if the remote branch has diverged.
+// Falls back to the previous commit if the remote branch doesn't exist (yet)
+func (m *CloudProviderGit) resetToRemote(ctx context.Context, logger *slogger.Logger, previous string) {
+	// push might have failed because of cancelled context, reset must still be done
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), GIT_RESET_TIMEOUT)
+	defer cancel()
+
+	ref := previous
+	if _, err := m.git(ctx, "fetch", GIT_REMOTE_NAME, m.opts.Branch); err == nil {
+		ref = GIT_REMOTE_NAME + "/" + m.opts.Branch
+	} else {
+		logger.Warn("unable to fetch git remote branch, resetting to previous commit", slog.Any("error", err))
+	}
+
+	var err error
+	if ref != "" {
+		logger.Info("resetting git working tree after failed push", slog.String("ref", ref))
+		_, err = m.git(ctx, "reset", "--hard", ref)
+	} else {
+		// first commit of repository
+		logger.Info("removing unpushed initial git commit after failed push")
+		_, err = m.git(ctx, "update-ref", "-d", "HEAD")
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to reset git working tree: %v", err))
+	}
+}
+
+// pulls changes from remote (if configured), remote branch might not exist yet
+func (m *CloudProviderGit) pull(ctx context.Context, logger *slogger.Logger) error {
+	if m.opts.Remote == "" {
+		return nil
+	}
+
+	remoteBranch, err := m.git(ctx, "ls-remote", "--heads", GIT_REMOTE_NAME, "refs/heads/"+m.opts.Branch)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(remoteBranch) == "" {
+		logger.Debug("git remote branch doesn't exist yet, skipping pull")
+		return nil
+	}
+
+	_, err = m.git(ctx, "pull", "--ff-only", GIT_REMOTE_NAME, m.opts.Branch)
+	return err
+}
+
+func (m *CloudProviderGit) encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	switch m.opts.Encryption {
+	case GIT_ENCRYPTION_SOPS:
+		args := []string{"--encrypt", "--input-type", "json", "--output-type", "json"}
+		if len(m.opts.AgeRecipients) > 0 {
+			args = append(args, "--age", strings.Join(m.opts.AgeRecipients, ","))
+		}
+		args = append(args, "/dev/stdin")
+		return m.sops(ctx, plaintext, args...)
+	default:
+		buf := &bytes.Buffer{}
+		armorWriter := armor.NewWriter(buf)
+
+		ageWriter, err := age.Encrypt(armorWriter, m.ageRecipients...)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := ageWriter.Write(plaintext); err != nil {
+			return nil, err
+		}
+
+		if err := ageWriter.Close(); err != nil {
+			return nil, err
+		}
+
+		if err := armorWriter.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+}
+
+func (m *CloudProviderGit) decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	switch m.opts.Encryption {
+	case GIT_ENCRYPTION_SOPS:
+		return m.sops(ctx, ciphertext, "--decrypt", "--input-type", "json", "--output-type", "json", "/dev/stdin")
+	default:
+		ageReader, err := age.Decrypt(armor.NewReader(bytes.NewReader(ciphertext)), m.ageIdentities...)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(ageReader)
+	}
+}
+
+// runs sops with content on stdin, the age identity file is passed to sops if specified
+func (m *CloudProviderGit) sops(ctx context.Context, content []byte, args ...string) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, m.opts.SopsBinary, args...) // #nosec G204 -- sops binary is configured by operator
+	cmd.Dir = *m.opts.Path
+	cmd.Env = os.Environ()
+	if m.opts.AgeIdentityFile != "" {
+		cmd.Env = append(cmd.Env, "SOPS_AGE_KEY_FILE="+m.opts.AgeIdentityFile)
+	}
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf(`sops failed: %w: %s`, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (m *CloudProviderGit) git(ctx context.Context, args ...string) (string, error) {
+	return m.gitInDir(ctx, *m.opts.Path, args...)
+}
+
+func (m *CloudProviderGit) gitInDir(ctx context.Context, dir string, args ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, "git", args...) // #nosec G204 -- arguments are built from configuration
+	cmd.Dir = dir
+	// never ask for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf(`git %s failed: %w: %s`, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+func (m *CloudProviderGit) withLock(logger *slogger.Logger, callback func() error) error {
+	if err := m.lock.Lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.lock.Unlock(); err != nil {
+			logger.Warn(`unable to release git lock`, slog.Any("error", err))
+		}
+	}()
+
+	return callback()
+}
@@ -0,0 +1,231 @@
+package cloudprovider
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+func newTestGitProvider(t *testing.T) (*CloudProviderGit, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	remote := filepath.Join(dir, "remote.git")
+	if output, err := exec.Command("git", "init", "--bare", "--initial-branch", "main", remote).CombinedOutput(); err != nil {
+		t.Fatalf("unable to init bare repository: %v: %s", err, output)
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &CloudProviderGit{
+		opts: &gitOptions{
+			Path:            stringPtr(filepath.Join(dir, "worktree")),
+			File:            "kube-bootstrap-token.enc.json",
+			Remote:          remote,
+			Branch:          "main",
+			AuthorName:      "test",
+			AuthorEmail:     "test@localhost",
+			Encryption:      GIT_ENCRYPTION_AGE,
+			AgeIdentityFile: identityFile,
+		},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, remote
+}
+
+// rejectPushes installs a pre-receive hook in the bare remote which rejects (or accepts again) all pushes
+func rejectPushes(t *testing.T, remote string, reject bool) {
+	t.Helper()
+	hook := filepath.Join(remote, "hooks", "pre-receive")
+	if !reject {
+		if err := os.Remove(hook); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0700); err != nil { // #nosec G306 -- hook must be executable
+		t.Fatal(err)
+	}
+}
+
+func gitRevParse(t *testing.T, dir, ref string) string {
+	t.Helper()
+	output, err := exec.Command("git", "-C", dir, "rev-parse", ref).Output()
+	if err != nil {
+		t.Fatalf("unable to resolve %s: %v", ref, err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestGitStoreTokenResetsAfterFailedPush(t *testing.T) {
+	ctx := context.Background()
+	m, remote := newTestGitProvider(t)
+
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	rejectPushes(t, remote, true)
+	if err := m.StoreToken(ctx, newTestToken("bbbbbb", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error of rejected push")
+	}
+
+	if local, remote := gitRevParse(t, *m.opts.Path, "HEAD"), gitRevParse(t, remote, "main"); local != remote {
+		t.Fatalf("expected working tree to be reset to remote %s, got %s", remote, local)
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Id() != "aaaaaa" {
+		t.Fatalf("unpushed token must not be fetched, got %v", token)
+	}
+
+	rejectPushes(t, remote, false)
+	if err := m.StoreToken(ctx, newTestToken("cccccc", "0123456789abcdef")); err != nil {
+		t.Fatalf("rotation must not be blocked after failed push: %v", err)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Id() != "cccccc" || tokens[1].Id() != "aaaaaa" {
+		t.Fatalf("expected tokens cccccc, aaaaaa, got %v", tokens)
+	}
+}
+
+func TestGitStoreTokenResetsFailedInitialPush(t *testing.T) {
+	ctx := context.Background()
+	m, remote := newTestGitProvider(t)
+
+	rejectPushes(t, remote, true)
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error of rejected push")
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != nil {
+		t.Fatalf("unpushed initial token must not be fetched, got %v", token.Id())
+	}
+
+	rejectPushes(t, remote, false)
+	if err := m.StoreToken(ctx, newTestToken("bbbbbb", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestGitProviderWithOpts creates another provider with copied options (eg. other working tree, branch or key)
+func newTestGitProviderWithOpts(t *testing.T, m *CloudProviderGit, modify func(opts *gitOptions)) *CloudProviderGit {
+	t.Helper()
+	opts := *m.opts
+	modify(&opts)
+
+	other := &CloudProviderGit{opts: &opts}
+	if err := other.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return other
+}
+
+func TestGitFetchTokensSkipsUnreadableCommits(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestGitProvider(t)
+
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated key, previous commit can't be decrypted anymore
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rotated := newTestGitProviderWithOpts(t, m, func(opts *gitOptions) {
+		opts.AgeIdentityFile = identityFile
+	})
+
+	if err := rotated.StoreToken(ctx, newTestToken("bbbbbb", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := rotated.FetchTokens(ctx)
+	if err != nil {
+		t.Fatalf("unreadable commit must not fail full sync: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Id() != "bbbbbb" {
+		t.Fatalf("expected token bbbbbb, got %v", tokens)
+	}
+}
+
+func TestGitInitChecksOutRemoteBranch(t *testing.T) {
+	ctx := context.Background()
+	m, remote := newTestGitProvider(t)
+
+	// default branch of remote contains another token
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	newBranchProvider := func(branch string) *CloudProviderGit {
+		return newTestGitProviderWithOpts(t, m, func(opts *gitOptions) {
+			opts.Path = stringPtr(filepath.Join(t.TempDir(), "worktree"))
+			opts.Branch = branch
+		})
+	}
+
+	// branch doesn't exist in remote, must not be based on default branch
+	tokensProvider := newBranchProvider("tokens")
+	token, err := tokensProvider.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != nil {
+		t.Fatalf("token of default branch must not be fetched, got %v", token.Id())
+	}
+	if err := tokensProvider.StoreToken(ctx, newTestToken("bbbbbb", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command("git", "-C", remote, "rev-list", "--count", "tokens").Output(); err != nil || strings.TrimSpace(string(output)) != "1" {
+		t.Fatalf("expected new branch without history of default branch, got %s (%v)", output, err)
+	}
+
+	// existing branch in remote is checked out
+	clonedProvider := newBranchProvider("tokens")
+	if local, remote := gitRevParse(t, *clonedProvider.opts.Path, "HEAD"), gitRevParse(t, remote, "tokens"); local != remote {
+		t.Fatalf("expected remote branch %s to be checked out, got %s", remote, local)
+	}
+	token, err = clonedProvider.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Id() != "bbbbbb" {
+		t.Fatalf("expected token bbbbbb of branch, got %v", token)
+	}
+}
@@ -0,0 +1,22 @@
+package cloudprovider
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+)
+
+func newTestLogger() *slogger.Logger {
+	return slogger.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func newTestToken(id, secret string) *bootstraptoken.BootstrapToken {
+	token := bootstraptoken.NewBootstrapToken(id, secret)
+	token.SetCreationTime(time.Now().Add(-time.Hour).UTC().Truncate(time.Second))
+	token.SetExpirationTime(time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second))
+	return token
+}
@@ -0,0 +1,345 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+	"github.com/webdevops/kube-bootstrap-token-manager/kubeclient"
+)
+
+const (
+	KUBERNETES_SECRET_DATA_TOKEN = "token"
+
+	KUBERNETES_LABEL_MANAGED_BY = "app.kubernetes.io/managed-by"
+	KUBERNETES_LABEL_SECRET     = "bootstraptoken.webdevops.io/secret"
+
+	KUBERNETES_ANNOTATION_VERSION = "bootstraptoken.webdevops.io/version"
+	KUBERNETES_ANNOTATION_CREATED = "bootstraptoken.webdevops.io/created"
+	KUBERNETES_ANNOTATION_EXPIRES = "bootstraptoken.webdevops.io/expires"
+)
+
+type (
+	CloudProviderKubernetes struct {
+		CloudProvider
+
+		opts *kubernetesOptions
+
+		logger *slogger.Logger
+
+		client kubernetes.Interface
+	}
+
+	// options of Kubernetes (management cluster) cloud provider
+	kubernetesOptions struct {
+		Kubeconfig *string `long:"kubernetes.kubeconfig"    env:"KUBERNETES_KUBECONFIG"    description:"Path to kubeconfig of management cluster (uses in cluster configuration if empty)"`
+		Context    string  `long:"kubernetes.context"       env:"KUBERNETES_CONTEXT"       description:"Context of kubeconfig for management cluster (uses current context if empty)"`
+		Namespace  string  `long:"kubernetes.namespace"     env:"KUBERNETES_NAMESPACE"     description:"Namespace of Secret in management cluster to sync token" default:"default"`
+		SecretName *string `long:"kubernetes.secret"        env:"KUBERNETES_SECRET"        description:"Name of Secret in management cluster to sync token" default:"kube-bootstrap-token"`
+	}
+)
+
+var (
+	kubernetesOpts = &kubernetesOptions{}
+)
+
+func init() {
+	Register("kubernetes", func() CloudProvider {
+		return &CloudProviderKubernetes{opts: kubernetesOpts}
+	})
+	RegisterOptions("kubernetes", kubernetesOpts)
+}
+
+func (m *CloudProviderKubernetes) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "kubernetes"),
+	)
+
+	if m.opts.SecretName == nil || *m.opts.SecretName == "" {
+		return errors.New("no Kubernetes secret name specified")
+	}
+
+	kubeconfig := ""
+	if m.opts.Kubeconfig != nil {
+		kubeconfig = *m.opts.Kubeconfig
+	}
+
+	restConfig, err := kubeclient.NewRestConfig(kubeconfig, m.opts.Context)
+	if err != nil {
+		return err
+	}
+	restConfig.UserAgent = userAgent
+
+	m.client, err = kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *CloudProviderKubernetes) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	secretName := *m.opts.SecretName
+
+	contextLogger := m.logger.With(slog.String("namespace", m.opts.Namespace), slog.String("secretName", secretName))
+
+	contextLogger.Info("fetching current token from Kubernetes management cluster")
+	secret, err := m.client.CoreV1().Secrets(m.opts.Namespace).Get(ctx, secretName, v1.GetOptions{})
+	if err != nil {
+		return nil, m.handleKubernetesError(contextLogger, err)
+	}
+
+	return m.parseSecret(secret), nil
+}
+
+func (m *CloudProviderKubernetes) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+	secretName := *m.opts.SecretName
+
+	contextLogger := m.logger.With(slog.String("namespace", m.opts.Namespace), slog.String("secretName", secretName))
+	contextLogger.Info("fetching all tokens from Kubernetes management cluster")
+
+	secretList, err := m.fetchSecretVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secretList {
+		secretLogger := contextLogger.With(slog.String("secretVersion", secret.Annotations[KUBERNETES_ANNOTATION_VERSION]))
+
+		token := m.parseSecret(&secret)
+		if token == nil {
+			continue
+		}
+
+		if token.ExpirationTime() != nil && time.Now().After(*token.ExpirationTime()) {
+			// expired
+			continue
+		}
+
+		secretLogger.Info("found valid secret")
+		tokens = append(tokens, token)
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderKubernetes) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	secretName := *m.opts.SecretName
+	secretNamespace := m.opts.Namespace
+
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("namespace", secretNamespace),
+		slog.String("secretName", secretName),
+	)
+	contextLogger.Info("storing token to Kubernetes management cluster", slog.String("expiration", token.ExpirationString()))
+
+	// current secret
+	secret, err := m.client.CoreV1().Secrets(secretNamespace).Get(ctx, secretName, v1.GetOptions{})
+	exists := err == nil
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		secret = &corev1.Secret{}
+		secret.SetName(secretName)
+		secret.SetNamespace(secretNamespace)
+	}
+
+	version := 1
+	if val, err := strconv.Atoi(secret.Annotations[KUBERNETES_ANNOTATION_VERSION]); err == nil {
+		version = val + 1
+	}
+
+	// update current secret first (uses resourceVersion of fetched secret for optimistic locking),
+	// only the manager which stored version N creates the history secret of it
+	m.updateSecretData(secret, token, version)
+	if !exists {
+		_, err = m.client.CoreV1().Secrets(secretNamespace).Create(ctx, secret, v1.CreateOptions{})
+	} else {
+		_, err = m.client.CoreV1().Secrets(secretNamespace).Update(ctx, secret, v1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.storeHistorySecret(ctx, contextLogger, token, version); err != nil {
+		return err
+	}
+
+	m.cleanupSecretVersions(ctx, contextLogger)
+
+	return nil
+}
+
+// creates the immutable history secret of the version, an existing history secret with same version is kept if it
+// contains the same token, otherwise it's an orphan of a previous failed or reset run and is replaced
+func (m *CloudProviderKubernetes) storeHistorySecret(ctx context.Context, logger *slogger.Logger, token *bootstraptoken.BootstrapToken, version int) error {
+	immutable := true
+	historySecret := &corev1.Secret{}
+	historySecret.SetName(fmt.Sprintf("%s-v%d", *m.opts.SecretName, version))
+	historySecret.SetNamespace(m.opts.Namespace)
+	historySecret.Immutable = &immutable
+	m.updateSecretData(historySecret, token, version)
+
+	_, err := m.client.CoreV1().Secrets(m.opts.Namespace).Create(ctx, historySecret, v1.CreateOptions{})
+	if err == nil || !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := m.client.CoreV1().Secrets(m.opts.Namespace).Get(ctx, historySecret.Name, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(existing.Data[KUBERNETES_SECRET_DATA_TOKEN], historySecret.Data[KUBERNETES_SECRET_DATA_TOKEN]) {
+		return nil
+	}
+
+	logger.Warn("replacing orphaned history secret", slog.String("secretVersion", historySecret.Name))
+	if err := m.client.CoreV1().Secrets(m.opts.Namespace).Delete(ctx, historySecret.Name, v1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	_, err = m.client.CoreV1().Secrets(m.opts.Namespace).Create(ctx, historySecret, v1.CreateOptions{})
+	return err
+}
+
+// removes expired and superseded history secrets
+func (m *CloudProviderKubernetes) cleanupSecretVersions(ctx context.Context, logger *slogger.Logger) {
+	secretList, err := m.fetchSecretVersions(ctx)
+	if err != nil {
+		logger.Warn(`unable to fetch history secrets for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, secret := range secretList {
+		if retainVersion(num, kubernetesAnnotationTime(secret.Annotations, KUBERNETES_ANNOTATION_EXPIRES)) {
+			continue
+		}
+
+		logger.Debug("removing history secret", slog.String("secretVersion", secret.Name))
+		if err := m.client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, v1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logger.Warn(`unable to remove history secret`, slog.Any("error", err))
+		}
+	}
+}
+
+// fetches all history secrets, sorted by version (newest first)
+func (m *CloudProviderKubernetes) fetchSecretVersions(ctx context.Context) (secretList []corev1.Secret, err error) {
+	selector := labels.Set{KUBERNETES_LABEL_SECRET: *m.opts.SecretName}.AsSelector()
+
+	result, err := m.client.CoreV1().Secrets(m.opts.Namespace).List(ctx, v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	secretList = result.Items
+	sort.Slice(secretList, func(i, j int) bool {
+		versionI, _ := strconv.Atoi(secretList[i].Annotations[KUBERNETES_ANNOTATION_VERSION])
+		versionJ, _ := strconv.Atoi(secretList[j].Annotations[KUBERNETES_ANNOTATION_VERSION])
+		return versionI > versionJ
+	})
+
+	return
+}
+
+func (m *CloudProviderKubernetes) updateSecretData(secret *corev1.Secret, token *bootstraptoken.BootstrapToken, version int) {
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+
+	secret.Type = corev1.SecretTypeOpaque
+	secret.Labels[KUBERNETES_LABEL_MANAGED_BY] = "kube-bootstrap-token-manager"
+	secret.Annotations[KUBERNETES_ANNOTATION_VERSION] = strconv.Itoa(version)
+
+	delete(secret.Annotations, KUBERNETES_ANNOTATION_CREATED)
+	if token.CreationTime() != nil {
+		secret.Annotations[KUBERNETES_ANNOTATION_CREATED] = token.CreationTime().UTC().Format(time.RFC3339)
+	}
+
+	delete(secret.Annotations, KUBERNETES_ANNOTATION_EXPIRES)
+	if token.ExpirationTime() != nil {
+		secret.Annotations[KUBERNETES_ANNOTATION_EXPIRES] = token.ExpirationTime().UTC().Format(time.RFC3339)
+	}
+
+	// only history secrets are selected by secret label
+	if secret.Name != *m.opts.SecretName {
+		secret.Labels[KUBERNETES_LABEL_SECRET] = *m.opts.SecretName
+	}
+
+	secret.Data = map[string][]byte{
+		KUBERNETES_SECRET_DATA_TOKEN: []byte(token.FullToken()),
+	}
+}
+
+func (m *CloudProviderKubernetes) parseSecret(secret *corev1.Secret) (token *bootstraptoken.BootstrapToken) {
+	value, exists := secret.Data[KUBERNETES_SECRET_DATA_TOKEN]
+	if !exists {
+		return
+	}
+
+	token = bootstraptoken.ParseFromString(string(value))
+	if token == nil {
+		return
+	}
+
+	created := kubernetesAnnotationTime(secret.Annotations, KUBERNETES_ANNOTATION_CREATED)
+	if created == nil {
+		created = &secret.CreationTimestamp.Time
+	}
+	token.SetCreationTime(*created)
+
+	expires := kubernetesAnnotationTime(secret.Annotations, KUBERNETES_ANNOTATION_EXPIRES)
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "kubernetes")
+	token.SetAnnotation("bootstraptoken.webdevops.io/secret", fmt.Sprintf("%s/%s", secret.Namespace, *m.opts.SecretName))
+	token.SetAnnotation("bootstraptoken.webdevops.io/secretVersion", secret.Annotations[KUBERNETES_ANNOTATION_VERSION])
+	token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderKubernetes) handleKubernetesError(logger *slogger.Logger, err error) error {
+	return handleFetchError(logger, err, apierrors.IsNotFound(err), apierrors.IsForbidden(err), "secret", "unable to access Kubernetes management cluster, please check RBAC")
+}
+
+func kubernetesAnnotationTime(annotations map[string]string, name string) *time.Time {
+	if val, exists := annotations[name]; exists {
+		if ret, err := time.Parse(time.RFC3339, val); err == nil {
+			return &ret
+		}
+	}
+	return nil
+}
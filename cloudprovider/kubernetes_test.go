@@ -0,0 +1,87 @@
+package cloudprovider
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestKubernetesProvider(objects ...*corev1.Secret) *CloudProviderKubernetes {
+	client := fake.NewClientset()
+	for _, obj := range objects {
+		if _, err := client.CoreV1().Secrets(obj.Namespace).Create(context.Background(), obj, v1.CreateOptions{}); err != nil {
+			panic(err)
+		}
+	}
+
+	return &CloudProviderKubernetes{
+		opts: &kubernetesOptions{
+			Namespace:  "default",
+			SecretName: stringPtr("kube-bootstrap-token"),
+		},
+		logger: newTestLogger(),
+		client: client,
+	}
+}
+
+func TestKubernetesStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	m := newTestKubernetesProvider()
+
+	for _, token := range []string{"aaaaaa", "bbbbbb"} {
+		if err := m.StoreToken(ctx, newTestToken(token, "0123456789abcdef")); err != nil {
+			t.Fatalf("unable to store token %s: %v", token, err)
+		}
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Id() != "bbbbbb" {
+		t.Fatalf("expected current token bbbbbb, got %v", token)
+	}
+	if version := token.Annotations()["bootstraptoken.webdevops.io/secretVersion"]; version != "2" {
+		t.Fatalf("expected current version 2, got %s", version)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Id() != "bbbbbb" || tokens[1].Id() != "aaaaaa" {
+		t.Fatalf("expected history bbbbbb, aaaaaa, got %v", tokens)
+	}
+}
+
+func TestKubernetesStoreTokenReplacesOrphanedHistorySecret(t *testing.T) {
+	ctx := context.Background()
+
+	// history secret of a previous run which failed to update the current secret
+	orphan := newTestKubernetesProvider()
+	orphanSecret := &corev1.Secret{}
+	orphanSecret.SetName("kube-bootstrap-token-v1")
+	orphanSecret.SetNamespace("default")
+	orphan.updateSecretData(orphanSecret, newTestToken("oooooo", "0123456789abcdef"), 1)
+
+	m := newTestKubernetesProvider(orphanSecret)
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatalf("orphaned history secret must not block rotation: %v", err)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Id() != "aaaaaa" {
+		t.Fatalf("expected orphaned history secret to be replaced, got %v", tokens)
+	}
+
+	// storing the same version again (eg. retry after failed cleanup) keeps the history secret
+	if err := m.storeHistorySecret(ctx, m.logger, tokens[0], 1); err != nil {
+		t.Fatalf("identical history secret must be accepted: %v", err)
+	}
+}
@@ -0,0 +1,744 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	KV_BACKEND_ETCD   = "etcd"
+	KV_BACKEND_CONSUL = "consul"
+
+	KV_KEY_CURRENT        = "current"
+	KV_KEY_VERSION_PREFIX = "v"
+)
+
+var (
+	errKvConflict = errors.New("key was modified concurrently (compare-and-swap failed)")
+)
+
+type (
+	CloudProviderKv struct {
+		CloudProvider
+
+		opts *kvOptions
+
+		logger *slogger.Logger
+
+		backendName string
+		backend     kvBackend
+	}
+
+	// key-value backend, all write operations are executed as one atomic transaction
+	kvBackend interface {
+		get(ctx context.Context, key string) (*kvEntry, error)
+		list(ctx context.Context, prefix string) ([]kvEntry, error)
+		txn(ctx context.Context, ops []kvTxnOp) error
+	}
+
+	kvEntry struct {
+		Key      string
+		Value    []byte
+		Revision int64
+	}
+
+	// compare-and-swap operation, revision 0 requires key to be non existing
+	kvTxnOp struct {
+		Key      string
+		Value    []byte
+		Revision int64
+		Delete   bool
+	}
+
+	kvTokenPointer struct {
+		Version int `json:"version"`
+	}
+
+	kvTokenVersion struct {
+		Version    int        `json:"version"`
+		Token      string     `json:"token"`
+		Created    *time.Time `json:"created,omitempty"`
+		Expiration *time.Time `json:"expiration,omitempty"`
+
+		key      string
+		revision int64
+	}
+
+	kvHttpClient struct {
+		client    *http.Client
+		endpoint  string
+		userAgent string
+		header    http.Header
+	}
+
+	kvHttpError struct {
+		StatusCode int
+		Message    string
+	}
+
+	kvEtcdBackend struct {
+		*kvHttpClient
+
+		username string
+		password string
+	}
+
+	kvConsulBackend struct {
+		*kvHttpClient
+
+		datacenter string
+	}
+
+	// options of etcd and Consul cloud providers
+	kvOptions struct {
+		Endpoint         *string `long:"kv.endpoint"            env:"KV_ENDPOINT"            description:"Endpoint of etcd (JSON gateway, eg. http://127.0.0.1:2379) or Consul (eg. http://127.0.0.1:8500)"`
+		Prefix           string  `long:"kv.prefix"              env:"KV_PREFIX"              description:"Key prefix to store token versions" default:"kube-bootstrap-token"`
+		Username         string  `long:"kv.username"            env:"KV_USERNAME"            description:"Username for etcd authentication"`
+		Password         string  `long:"kv.password"            env:"KV_PASSWORD"            description:"Password for etcd authentication" json:"-"`
+		Token            string  `long:"kv.token"               env:"KV_TOKEN"               description:"ACL token for Consul" json:"-"`
+		ConsulDatacenter string  `long:"kv.consul.datacenter"   env:"KV_CONSUL_DATACENTER"   description:"Consul datacenter (defaults to datacenter of agent)"`
+		TlsCa            string  `long:"kv.tls.ca"              env:"KV_TLS_CA"              description:"Path to CA certificate for TLS connections"`
+		TlsCert          string  `long:"kv.tls.cert"            env:"KV_TLS_CERT"            description:"Path to client certificate for TLS connections"`
+		TlsKey           string  `long:"kv.tls.key"             env:"KV_TLS_KEY"             description:"Path to client key for TLS connections"`
+	}
+)
+
+var (
+	kvOpts = &kvOptions{}
+)
+
+func init() {
+	Register("etcd", func() CloudProvider {
+		return &CloudProviderKv{opts: kvOpts, backendName: KV_BACKEND_ETCD}
+	})
+	RegisterOptions("etcd", kvOpts)
+	Register("consul", func() CloudProvider {
+		return &CloudProviderKv{opts: kvOpts, backendName: KV_BACKEND_CONSUL}
+	})
+	RegisterOptions("consul", kvOpts)
+}
+
+func (e *kvHttpError) Error() string {
+	return fmt.Sprintf("key-value request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+func (m *CloudProviderKv) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", m.backendName),
+	)
+
+	if m.opts.Endpoint == nil || *m.opts.Endpoint == "" {
+		return errors.New("no key-value endpoint specified")
+	}
+
+	if strings.Trim(m.opts.Prefix, "/") == "" {
+		return errors.New("no key-value prefix specified")
+	}
+
+	httpClient, err := m.newHttpClient(userAgent)
+	if err != nil {
+		return err
+	}
+
+	switch m.backendName {
+	case KV_BACKEND_ETCD:
+		m.backend = &kvEtcdBackend{
+			kvHttpClient: httpClient,
+			username:     m.opts.Username,
+			password:     m.opts.Password,
+		}
+	case KV_BACKEND_CONSUL:
+		if m.opts.Token != "" {
+			httpClient.header.Set("X-Consul-Token", m.opts.Token)
+		}
+		m.backend = &kvConsulBackend{
+			kvHttpClient: httpClient,
+			datacenter:   m.opts.ConsulDatacenter,
+		}
+	default:
+		return fmt.Errorf(`key-value backend "%s" not available`, m.backendName)
+	}
+
+	return nil
+}
+
+func (m *CloudProviderKv) newHttpClient(userAgent string) (*kvHttpClient, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if m.opts.TlsCa != "" {
+		caCert, err := os.ReadFile(m.opts.TlsCa)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf(`unable to parse CA certificate "%s"`, m.opts.TlsCa)
+		}
+	}
+
+	if m.opts.TlsCert != "" || m.opts.TlsKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(m.opts.TlsCert, m.opts.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &kvHttpClient{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: transport,
+		},
+		endpoint:  strings.TrimSuffix(*m.opts.Endpoint, "/"),
+		userAgent: userAgent,
+		header:    http.Header{},
+	}, nil
+}
+
+func (m *CloudProviderKv) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("prefix", m.keyPrefix()))
+
+	contextLogger.Info("fetching current token from key-value store")
+	pointer, err := m.fetchPointer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if pointer == nil {
+		contextLogger.Warn("no key found, assuming non existing token")
+		return
+	}
+
+	entry, err := m.backend.get(ctx, m.versionKey(pointer.Version))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		contextLogger.Warn("current token version not found, assuming non existing token", slog.Int("version", pointer.Version))
+		return
+	}
+
+	version, err := m.parseEntry(*entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.parseVersion(version), nil
+}
+
+func (m *CloudProviderKv) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("prefix", m.keyPrefix()))
+	contextLogger.Info("fetching all tokens from key-value store")
+
+	versionList, err := m.fetchVersions(ctx, contextLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versionList {
+		if version.Expiration != nil && time.Now().After(*version.Expiration) {
+			// expired
+			continue
+		}
+
+		token := m.parseVersion(version)
+		if token == nil {
+			continue
+		}
+
+		contextLogger.Info("found valid key", slog.String("key", version.key))
+		tokens = append(tokens, token)
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderKv) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("prefix", m.keyPrefix()),
+	)
+	contextLogger.Info("storing token to key-value store", slog.String("expiration", token.ExpirationString()))
+
+	currentEntry, err := m.backend.get(ctx, m.currentKey())
+	if err != nil {
+		return err
+	}
+
+	versionList, err := m.fetchVersions(ctx, contextLogger)
+	if err != nil {
+		return err
+	}
+
+	version := kvTokenVersion{
+		Version:    1,
+		Token:      token.FullToken(),
+		Created:    token.CreationTime(),
+		Expiration: token.ExpirationTime(),
+	}
+
+	if len(versionList) > 0 {
+		version.Version = versionList[0].Version + 1
+	}
+
+	currentRevision := int64(0)
+	if currentEntry != nil {
+		currentRevision = currentEntry.Revision
+
+		pointer := kvTokenPointer{}
+		if err := json.Unmarshal(currentEntry.Value, &pointer); err == nil && pointer.Version >= version.Version {
+			version.Version = pointer.Version + 1
+		}
+	}
+
+	versionContent, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+
+	pointerContent, err := json.Marshal(kvTokenPointer{Version: version.Version})
+	if err != nil {
+		return err
+	}
+
+	// new version must not exist and current pointer must be unchanged since read,
+	// otherwise another manager has stored a token in the meantime
+	err = m.backend.txn(ctx, []kvTxnOp{
+		{Key: m.versionKey(version.Version), Value: versionContent, Revision: 0},
+		{Key: m.currentKey(), Value: pointerContent, Revision: currentRevision},
+	})
+	if err != nil {
+		return err
+	}
+
+	m.cleanupVersions(ctx, contextLogger, version.Version)
+
+	return nil
+}
+
+// removes expired and superseded versions
+func (m *CloudProviderKv) cleanupVersions(ctx context.Context, logger *slogger.Logger, currentVersion int) {
+	versionList, err := m.fetchVersions(ctx, logger)
+	if err != nil {
+		logger.Warn(`unable to fetch versions for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, version := range versionList {
+		// always keep current version
+		if num == 0 || version.Version == currentVersion {
+			continue
+		}
+
+		if retainVersion(num, version.Expiration) {
+			continue
+		}
+
+		logger.Debug("removing key", slog.String("key", version.key))
+		err := m.backend.txn(ctx, []kvTxnOp{{Key: version.key, Revision: version.revision, Delete: true}})
+		if err != nil {
+			logger.Warn(`unable to remove key`, slog.Any("error", err))
+		}
+	}
+}
+
+func (m *CloudProviderKv) fetchPointer(ctx context.Context) (*kvTokenPointer, error) {
+	entry, err := m.backend.get(ctx, m.currentKey())
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	pointer := kvTokenPointer{}
+	if err := json.Unmarshal(entry.Value, &pointer); err != nil {
+		return nil, fmt.Errorf(`unable to parse key "%s": %w`, entry.Key, err)
+	}
+
+	return &pointer, nil
+}
+
+// fetches all token versions, sorted by version (newest first)
+func (m *CloudProviderKv) fetchVersions(ctx context.Context, logger *slogger.Logger) (versionList []kvTokenVersion, err error) {
+	versionList = []kvTokenVersion{}
+
+	entryList, err := m.backend.list(ctx, m.keyPrefix()+"/"+KV_KEY_VERSION_PREFIX)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entryList {
+		versionString := strings.TrimPrefix(entry.Key, m.keyPrefix()+"/"+KV_KEY_VERSION_PREFIX)
+		if _, err := strconv.Atoi(versionString); err != nil {
+			// not a token key
+			continue
+		}
+
+		version, err := m.parseEntry(entry)
+		if err != nil {
+			logger.Warn(`unable to parse key, ignoring`, slog.String("key", entry.Key), slog.Any("error", err))
+			continue
+		}
+
+		versionList = append(versionList, version)
+	}
+
+	sort.Slice(versionList, func(i, j int) bool {
+		return versionList[i].Version > versionList[j].Version
+	})
+
+	return
+}
+
+func (m *CloudProviderKv) parseEntry(entry kvEntry) (version kvTokenVersion, err error) {
+	if err = json.Unmarshal(entry.Value, &version); err != nil {
+		return
+	}
+	version.key = entry.Key
+	version.revision = entry.Revision
+	return
+}
+
+func (m *CloudProviderKv) parseVersion(version kvTokenVersion) (token *bootstraptoken.BootstrapToken) {
+	token = bootstraptoken.ParseFromString(version.Token)
+	if token == nil {
+		return
+	}
+
+	if version.Created != nil {
+		token.SetCreationTime(*version.Created)
+	}
+
+	if version.Expiration != nil {
+		token.SetExpirationTime(*version.Expiration)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", m.backendName)
+	token.SetAnnotation("bootstraptoken.webdevops.io/key", version.key)
+	token.SetAnnotation("bootstraptoken.webdevops.io/keyVersion", strconv.Itoa(version.Version))
+
+	if version.Created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", version.Created.Format(time.RFC3339))
+	}
+
+	if version.Expiration != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", version.Expiration.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderKv) keyPrefix() string {
+	return strings.Trim(m.opts.Prefix, "/")
+}
+
+func (m *CloudProviderKv) currentKey() string {
+	return m.keyPrefix() + "/" + KV_KEY_CURRENT
+}
+
+func (m *CloudProviderKv) versionKey(version int) string {
+	return fmt.Sprintf("%s/%s%d", m.keyPrefix(), KV_KEY_VERSION_PREFIX, version)
+}
+
+func (c *kvHttpClient) request(ctx context.Context, method, resourcePath string, query url.Values, body, result interface{}) error {
+	requestUrl := c.endpoint + resourcePath
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, requestBody)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &kvHttpError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return nil
+}
+
+// etcd v3 using the JSON gRPC gateway (/v3/kv/*)
+func (b *kvEtcdBackend) get(ctx context.Context, key string) (*kvEntry, error) {
+	entryList, err := b.rangeRequest(ctx, key, "")
+	if err != nil || len(entryList) == 0 {
+		return nil, err
+	}
+	return &entryList[0], nil
+}
+
+func (b *kvEtcdBackend) list(ctx context.Context, prefix string) ([]kvEntry, error) {
+	return b.rangeRequest(ctx, prefix, kvEtcdPrefixRangeEnd(prefix))
+}
+
+func (b *kvEtcdBackend) rangeRequest(ctx context.Context, key, rangeEnd string) ([]kvEntry, error) {
+	body := map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(key)),
+	}
+	if rangeEnd != "" {
+		body["range_end"] = base64.StdEncoding.EncodeToString([]byte(rangeEnd))
+	}
+
+	result := struct {
+		Kvs []struct {
+			Key         []byte `json:"key"`
+			Value       []byte `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}{}
+	if err := b.call(ctx, "/v3/kv/range", body, &result); err != nil {
+		return nil, err
+	}
+
+	entryList := []kvEntry{}
+	for _, row := range result.Kvs {
+		revision, err := strconv.ParseInt(row.ModRevision, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(`unable to parse revision of key "%s": %w`, string(row.Key), err)
+		}
+
+		entryList = append(entryList, kvEntry{
+			Key:      string(row.Key),
+			Value:    row.Value,
+			Revision: revision,
+		})
+	}
+
+	return entryList, nil
+}
+
+func (b *kvEtcdBackend) txn(ctx context.Context, ops []kvTxnOp) error {
+	compareList := []map[string]string{}
+	successList := []map[string]interface{}{}
+
+	for _, op := range ops {
+		key := base64.StdEncoding.EncodeToString([]byte(op.Key))
+
+		if op.Revision == 0 {
+			compareList = append(compareList, map[string]string{
+				"key": key, "result": "EQUAL", "target": "CREATE", "create_revision": "0",
+			})
+		} else {
+			compareList = append(compareList, map[string]string{
+				"key": key, "result": "EQUAL", "target": "MOD", "mod_revision": strconv.FormatInt(op.Revision, 10),
+			})
+		}
+
+		if op.Delete {
+			successList = append(successList, map[string]interface{}{
+				"request_delete_range": map[string]string{"key": key},
+			})
+		} else {
+			successList = append(successList, map[string]interface{}{
+				"request_put": map[string]string{"key": key, "value": base64.StdEncoding.EncodeToString(op.Value)},
+			})
+		}
+	}
+
+	result := struct {
+		Succeeded bool `json:"succeeded"`
+	}{}
+	if err := b.call(ctx, "/v3/kv/txn", map[string]interface{}{"compare": compareList, "success": successList}, &result); err != nil {
+		return err
+	}
+
+	if !result.Succeeded {
+		return errKvConflict
+	}
+
+	return nil
+}
+
+// executes request, (re)authenticates if etcd auth is used
+func (b *kvEtcdBackend) call(ctx context.Context, resourcePath string, body, result interface{}) error {
+	if b.username != "" && b.header.Get("Authorization") == "" {
+		if err := b.authenticate(ctx); err != nil {
+			return err
+		}
+	}
+
+	err := b.request(ctx, http.MethodPost, resourcePath, nil, body, result)
+
+	var httpErr *kvHttpError
+	if b.username != "" && errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+		// auth token expired
+		if err := b.authenticate(ctx); err != nil {
+			return err
+		}
+		err = b.request(ctx, http.MethodPost, resourcePath, nil, body, result)
+	}
+
+	return err
+}
+
+func (b *kvEtcdBackend) authenticate(ctx context.Context) error {
+	b.header.Del("Authorization")
+
+	result := struct {
+		Token string `json:"token"`
+	}{}
+	if err := b.request(ctx, http.MethodPost, "/v3/auth/authenticate", nil, map[string]string{"name": b.username, "password": b.password}, &result); err != nil {
+		return err
+	}
+
+	b.header.Set("Authorization", result.Token)
+	return nil
+}
+
+// returns range end for prefix queries (prefix with last byte incremented)
+func kvEtcdPrefixRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// prefix of 0xff bytes, use whole keyspace
+	return "\x00"
+}
+
+// Consul KV using the HTTP API (/v1/kv, /v1/txn)
+func (b *kvConsulBackend) get(ctx context.Context, key string) (*kvEntry, error) {
+	entryList, err := b.kvRequest(ctx, key, url.Values{})
+	if err != nil || len(entryList) == 0 {
+		return nil, err
+	}
+	return &entryList[0], nil
+}
+
+func (b *kvConsulBackend) list(ctx context.Context, prefix string) ([]kvEntry, error) {
+	return b.kvRequest(ctx, prefix, url.Values{"recurse": []string{"true"}})
+}
+
+func (b *kvConsulBackend) kvRequest(ctx context.Context, key string, query url.Values) ([]kvEntry, error) {
+	if b.datacenter != "" {
+		query.Set("dc", b.datacenter)
+	}
+
+	result := []struct {
+		Key         string `json:"Key"`
+		Value       []byte `json:"Value"`
+		ModifyIndex int64  `json:"ModifyIndex"`
+	}{}
+	err := b.request(ctx, http.MethodGet, "/v1/kv/"+kvConsulEscapeKey(key), query, nil, &result)
+
+	var httpErr *kvHttpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		// no key found
+		return []kvEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entryList := []kvEntry{}
+	for _, row := range result {
+		entryList = append(entryList, kvEntry{
+			Key:      row.Key,
+			Value:    row.Value,
+			Revision: row.ModifyIndex,
+		})
+	}
+
+	return entryList, nil
+}
+
+func (b *kvConsulBackend) txn(ctx context.Context, ops []kvTxnOp) error {
+	opList := []map[string]interface{}{}
+	for _, op := range ops {
+		kvOp := map[string]interface{}{
+			"Key":   op.Key,
+			"Index": op.Revision,
+		}
+
+		if op.Delete {
+			kvOp["Verb"] = "delete-cas"
+		} else {
+			kvOp["Verb"] = "cas"
+			kvOp["Value"] = base64.StdEncoding.EncodeToString(op.Value)
+		}
+
+		opList = append(opList, map[string]interface{}{"KV": kvOp})
+	}
+
+	query := url.Values{}
+	if b.datacenter != "" {
+		query.Set("dc", b.datacenter)
+	}
+
+	err := b.request(ctx, http.MethodPut, "/v1/txn", query, opList, nil)
+
+	var httpErr *kvHttpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict {
+		// transaction was rolled back
+		return errKvConflict
+	}
+
+	return err
+}
+
+func kvConsulEscapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for num, part := range parts {
+		parts[num] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,476 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+type (
+	// fakeKv is a minimal in-memory key-value store serving the etcd JSON gateway or the Consul HTTP API
+	fakeKv struct {
+		server *httptest.Server
+
+		lock     sync.Mutex
+		entries  map[string]*fakeKvEntry
+		revision int64
+
+		// etcd credentials (empty = no authentication) and currently valid auth token
+		username  string
+		password  string
+		authToken string
+		authCount int
+
+		// called before a transaction is processed (eg. to simulate concurrent writes)
+		beforeTxn func()
+	}
+
+	fakeKvEntry struct {
+		value          []byte
+		createRevision int64
+		modRevision    int64
+	}
+)
+
+func newFakeKv(t *testing.T, backend string) *fakeKv {
+	t.Helper()
+	kv := &fakeKv{
+		entries: map[string]*fakeKvEntry{},
+	}
+	switch backend {
+	case KV_BACKEND_ETCD:
+		kv.server = httptest.NewServer(http.HandlerFunc(kv.serveEtcd))
+	case KV_BACKEND_CONSUL:
+		kv.server = httptest.NewServer(http.HandlerFunc(kv.serveConsul))
+	default:
+		t.Fatalf("unknown backend %s", backend)
+	}
+	t.Cleanup(kv.server.Close)
+	return kv
+}
+
+// put stores value with a new revision
+func (kv *fakeKv) put(key string, value []byte) {
+	kv.revision++
+	entry, exists := kv.entries[key]
+	if !exists {
+		entry = &fakeKvEntry{createRevision: kv.revision}
+		kv.entries[key] = entry
+	}
+	entry.value = value
+	entry.modRevision = kv.revision
+}
+
+// keys returns all keys with prefix (sorted)
+func (kv *fakeKv) keys(prefix string) []string {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	keyList := []string{}
+	for key := range kv.entries {
+		if strings.HasPrefix(key, prefix) {
+			keyList = append(keyList, key)
+		}
+	}
+	sort.Strings(keyList)
+	return keyList
+}
+
+func (kv *fakeKv) serveEtcd(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/kv/txn" && kv.beforeTxn != nil {
+		kv.beforeTxn()
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.Method != http.MethodPost {
+		kv.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid request", "code": 3})
+		return
+	}
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		credentials := struct {
+			Name     string `json:"name"`
+			Password string `json:"password"`
+		}{}
+		_ = json.Unmarshal(body, &credentials)
+		if kv.username == "" || credentials.Name != kv.username || credentials.Password != kv.password {
+			kv.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "etcdserver: authentication failed, invalid user ID or password", "code": 3})
+			return
+		}
+		kv.authCount++
+		kv.authToken = fmt.Sprintf("token%d", kv.authCount)
+		kv.writeJSON(w, http.StatusOK, map[string]interface{}{"token": kv.authToken})
+		return
+	}
+
+	if kv.username != "" && (kv.authToken == "" || r.Header.Get("Authorization") != kv.authToken) {
+		kv.writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "etcdserver: invalid auth token", "code": 16})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		rangeRequest := struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}{}
+		_ = json.Unmarshal(body, &rangeRequest)
+		key, rangeEnd := string(rangeRequest.Key), string(rangeRequest.RangeEnd)
+
+		kvs := []map[string]interface{}{}
+		keyList := []string{}
+		for name := range kv.entries {
+			if name == key || (rangeEnd != "" && name >= key && name < rangeEnd) {
+				keyList = append(keyList, name)
+			}
+		}
+		sort.Strings(keyList)
+		for _, name := range keyList {
+			entry := kv.entries[name]
+			kvs = append(kvs, map[string]interface{}{
+				"key":             []byte(name),
+				"value":           entry.value,
+				"create_revision": strconv.FormatInt(entry.createRevision, 10),
+				"mod_revision":    strconv.FormatInt(entry.modRevision, 10),
+			})
+		}
+
+		// empty fields are omitted by gateway
+		result := map[string]interface{}{"header": map[string]interface{}{"revision": strconv.FormatInt(kv.revision, 10)}}
+		if len(kvs) > 0 {
+			result["kvs"] = kvs
+			result["count"] = strconv.Itoa(len(kvs))
+		}
+		kv.writeJSON(w, http.StatusOK, result)
+	case "/v3/kv/txn":
+		txn := struct {
+			Compare []struct {
+				Key            []byte `json:"key"`
+				Result         string `json:"result"`
+				Target         string `json:"target"`
+				CreateRevision string `json:"create_revision"`
+				ModRevision    string `json:"mod_revision"`
+			} `json:"compare"`
+			Success []struct {
+				RequestPut *struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+				} `json:"request_put"`
+				RequestDeleteRange *struct {
+					Key []byte `json:"key"`
+				} `json:"request_delete_range"`
+			} `json:"success"`
+		}{}
+		_ = json.Unmarshal(body, &txn)
+
+		succeeded := true
+		for _, compare := range txn.Compare {
+			entry := kv.entries[string(compare.Key)]
+			actual := int64(0)
+			expected := compare.CreateRevision
+			if entry != nil {
+				actual = entry.createRevision
+			}
+			if compare.Target == "MOD" {
+				expected = compare.ModRevision
+				if entry != nil {
+					actual = entry.modRevision
+				}
+			}
+			if compare.Result != "EQUAL" || strconv.FormatInt(actual, 10) != expected {
+				succeeded = false
+			}
+		}
+
+		result := map[string]interface{}{"header": map[string]interface{}{}}
+		if succeeded {
+			for _, op := range txn.Success {
+				switch {
+				case op.RequestPut != nil:
+					kv.put(string(op.RequestPut.Key), op.RequestPut.Value)
+				case op.RequestDeleteRange != nil:
+					delete(kv.entries, string(op.RequestDeleteRange.Key))
+				}
+			}
+			result["succeeded"] = true
+		}
+		kv.writeJSON(w, http.StatusOK, result)
+	default:
+		kv.writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "not found", "code": 5})
+	}
+}
+
+func (kv *fakeKv) serveConsul(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/txn" && kv.beforeTxn != nil {
+		kv.beforeTxn()
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == http.MethodGet:
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		keyList := []string{}
+		for name := range kv.entries {
+			if name == key || (r.URL.Query().Get("recurse") == "true" && strings.HasPrefix(name, key)) {
+				keyList = append(keyList, name)
+			}
+		}
+		if len(keyList) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Strings(keyList)
+
+		result := []map[string]interface{}{}
+		for _, name := range keyList {
+			entry := kv.entries[name]
+			result = append(result, map[string]interface{}{
+				"Key":         name,
+				"Value":       entry.value,
+				"CreateIndex": entry.createRevision,
+				"ModifyIndex": entry.modRevision,
+			})
+		}
+		kv.writeJSON(w, http.StatusOK, result)
+	case r.URL.Path == "/v1/txn" && r.Method == http.MethodPut:
+		opList := []struct {
+			KV struct {
+				Verb  string
+				Key   string
+				Value string
+				Index int64
+			}
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&opList); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		errorList := []map[string]interface{}{}
+		for num, op := range opList {
+			entry := kv.entries[op.KV.Key]
+			index := int64(0)
+			if entry != nil {
+				index = entry.modRevision
+			}
+			// index 0 on cas requires key to be non existing
+			if (op.KV.Verb != "cas" && op.KV.Verb != "delete-cas") || index != op.KV.Index || (entry == nil && op.KV.Verb == "delete-cas") {
+				errorList = append(errorList, map[string]interface{}{"OpIndex": num, "What": fmt.Sprintf(`failed to %s key "%s"`, op.KV.Verb, op.KV.Key)})
+			}
+		}
+		if len(errorList) > 0 {
+			// transaction is rolled back
+			kv.writeJSON(w, http.StatusConflict, map[string]interface{}{"Results": nil, "Errors": errorList})
+			return
+		}
+
+		for _, op := range opList {
+			if op.KV.Verb == "delete-cas" {
+				delete(kv.entries, op.KV.Key)
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(op.KV.Value)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			kv.put(op.KV.Key, value)
+		}
+		kv.writeJSON(w, http.StatusOK, map[string]interface{}{"Results": []interface{}{}, "Errors": nil})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (kv *fakeKv) writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newTestKvProvider(t *testing.T, kv *fakeKv, backend string) *CloudProviderKv {
+	t.Helper()
+	m := &CloudProviderKv{
+		opts: &kvOptions{
+			Endpoint: stringPtr(kv.server.URL),
+			Prefix:   "/kube-bootstrap-token/",
+			Username: kv.username,
+			Password: kv.password,
+		},
+		backendName: backend,
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestKvStoreAndFetchToken(t *testing.T) {
+	for _, backend := range []string{KV_BACKEND_ETCD, KV_BACKEND_CONSUL} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			kv := newFakeKv(t, backend)
+			m := newTestKvProvider(t, kv, backend)
+
+			token, err := m.FetchToken(ctx)
+			if err != nil || token != nil {
+				t.Fatalf("missing key must be treated as non existing token, got %v, %v", token, err)
+			}
+
+			expired := bootstraptoken.NewBootstrapToken("expire", "0123456789abcdef")
+			expired.SetExpirationTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+			stored := newTestToken("aaaaaa", "0123456789abcdef")
+			for _, storeToken := range []*bootstraptoken.BootstrapToken{expired, stored} {
+				if err := m.StoreToken(ctx, storeToken); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			token, err = m.FetchToken(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == nil || token.FullToken() != stored.FullToken() {
+				t.Fatalf("expected token %s, got %v", stored.Id(), token)
+			}
+			if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+				t.Fatalf("expected creation and expiration of stored token, got %v, %v", token.CreationTime(), token.ExpirationTime())
+			}
+			if key := token.Annotations()["bootstraptoken.webdevops.io/key"]; key != "kube-bootstrap-token/v2" {
+				t.Fatalf("expected key kube-bootstrap-token/v2, got %s", key)
+			}
+
+			// expired version is removed on cleanup
+			if keys := kv.keys("kube-bootstrap-token/"); strings.Join(keys, ",") != "kube-bootstrap-token/current,kube-bootstrap-token/v2" {
+				t.Fatalf("expected expired version to be removed, got keys %v", keys)
+			}
+		})
+	}
+}
+
+func TestKvStoreTokenCleansUpVersions(t *testing.T) {
+	for _, backend := range []string{KV_BACKEND_ETCD, KV_BACKEND_CONSUL} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			kv := newFakeKv(t, backend)
+			m := newTestKvProvider(t, kv, backend)
+
+			for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+				if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// current pointer and latest SECRET_SYNC_COUNT_MAX versions are kept
+			if keys := kv.keys("kube-bootstrap-token/"); len(keys) != SECRET_SYNC_COUNT_MAX+1 {
+				t.Fatalf("expected %d keys, got %v", SECRET_SYNC_COUNT_MAX+1, keys)
+			}
+
+			tokens, err := m.FetchTokens(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != SECRET_SYNC_COUNT_MAX {
+				t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+			}
+			if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+				t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+			}
+		})
+	}
+}
+
+func TestKvStoreTokenConflict(t *testing.T) {
+	for _, backend := range []string{KV_BACKEND_ETCD, KV_BACKEND_CONSUL} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			kv := newFakeKv(t, backend)
+			m := newTestKvProvider(t, kv, backend)
+
+			if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+				t.Fatal(err)
+			}
+
+			// another manager stores its token between reading the current pointer and writing
+			kv.beforeTxn = func() {
+				kv.lock.Lock()
+				defer kv.lock.Unlock()
+				kv.put("kube-bootstrap-token/v2", []byte(`{"version":2,"token":"bbbbbb.0123456789abcdef"}`))
+				kv.put("kube-bootstrap-token/current", []byte(`{"version":2}`))
+				kv.beforeTxn = nil
+			}
+
+			if err := m.StoreToken(ctx, newTestToken("cccccc", "0123456789abcdef")); !errors.Is(err, errKvConflict) {
+				t.Fatalf("expected compare-and-swap conflict, got %v", err)
+			}
+
+			token, err := m.FetchToken(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == nil || token.Id() != "bbbbbb" {
+				t.Fatalf("concurrently stored token must not be overwritten, got %v", token)
+			}
+
+			// transaction is atomic, new version must not be written partially
+			for _, key := range kv.keys("kube-bootstrap-token/") {
+				if key == "kube-bootstrap-token/v3" {
+					t.Fatal("version of failed transaction must not be stored")
+				}
+			}
+		})
+	}
+}
+
+func TestKvEtcdReauthenticates(t *testing.T) {
+	ctx := context.Background()
+	kv := newFakeKv(t, KV_BACKEND_ETCD)
+	kv.username = "manager"
+	kv.password = "secret"
+	m := newTestKvProvider(t, kv, KV_BACKEND_ETCD)
+
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	// auth token expires
+	kv.lock.Lock()
+	kv.authToken = ""
+	kv.lock.Unlock()
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Id() != "aaaaaa" {
+		t.Fatalf("expected token aaaaaa, got %v", token)
+	}
+	if kv.authCount != 2 {
+		t.Fatalf("expected reauthentication after token expiry, got %d authentications", kv.authCount)
+	}
+
+	// wrong credentials
+	m = newTestKvProvider(t, kv, KV_BACKEND_ETCD)
+	m.backend.(*kvEtcdBackend).password = "wrong"
+	if _, err := m.FetchToken(ctx); err == nil {
+		t.Fatal("expected error with wrong credentials")
+	}
+}
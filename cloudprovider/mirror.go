@@ -0,0 +1,299 @@
+package cloudprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+type (
+	// CloudProviderMirror wraps a primary and multiple secondary cloud providers,
+	// tokens are read from the primary (with fallback to the secondaries) and stored to all of them
+	CloudProviderMirror struct {
+		CloudProvider
+
+		logger *slogger.Logger
+
+		providers []*mirrorCloudProvider
+
+		// tokens of cloud providers from last FetchToken (missing if fetch failed), used for healing
+		providerTokens map[string]*bootstraptoken.BootstrapToken
+	}
+
+	mirrorCloudProvider struct {
+		name     string
+		provider CloudProvider
+	}
+)
+
+// NewMirrorCloudProvider creates mirror for primary and secondary cloud providers
+func NewMirrorCloudProvider(primary string, secondaries []string) (CloudProvider, error) {
+	mirror := &CloudProviderMirror{}
+
+	for _, name := range append([]string{primary}, secondaries...) {
+		for _, existing := range mirror.providers {
+			if existing.name == name {
+				return nil, fmt.Errorf("cloud provider \"%s\" is configured multiple times", name)
+			}
+		}
+
+		provider, err := NewCloudProvider(name)
+		if err != nil {
+			return nil, err
+		}
+
+		mirror.providers = append(mirror.providers, &mirrorCloudProvider{
+			name:     name,
+			provider: provider,
+		})
+	}
+
+	return mirror, nil
+}
+
+func (m *CloudProviderMirror) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "mirror"),
+	)
+
+	for _, provider := range m.providers {
+		err := provider.call(func() error {
+			return provider.provider.Init(ctx, opts, logger, userAgent)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FetchToken fetches token from primary cloud provider, falls back to secondary cloud providers
+// if primary fails or has no token (or a secondary has a newer token), cloud providers not having
+// the current token are healed by Heal
+func (m *CloudProviderMirror) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	providerTokens := map[string]*bootstraptoken.BootstrapToken{}
+	m.providerTokens = providerTokens
+	primaryFailed := false
+
+	for _, provider := range m.providers {
+		contextLogger := m.logger.With(slog.String("mirror", provider.name))
+
+		err := provider.call(func() (err error) {
+			providerTokens[provider.name], err = provider.provider.FetchToken(ctx)
+			return
+		})
+		if err != nil {
+			delete(providerTokens, provider.name)
+			contextLogger.Error("unable to fetch token from cloud provider", slog.Any("error", err))
+			if provider == m.providers[0] {
+				primaryFailed = true
+			}
+			continue
+		}
+
+		providerToken := providerTokens[provider.name]
+		switch {
+		case providerToken == nil:
+			continue
+		case token == nil:
+			token = providerToken
+			if provider != m.providers[0] {
+				contextLogger.Warn("primary cloud provider has no token, using token from secondary cloud provider")
+			}
+		case mirrorTokenIsNewer(providerToken, token):
+			// secondary has newer token, eg. if storing to primary failed in previous run
+			contextLogger.Warn("secondary cloud provider has newer token, using token from secondary cloud provider")
+			token = providerToken
+		}
+	}
+
+	if len(providerTokens) == 0 {
+		return nil, errors.New("unable to fetch token from any cloud provider")
+	}
+
+	if token == nil && primaryFailed {
+		// secondaries without token must not lead to a new token while primary is not available (eg. outage)
+		return nil, errors.New("unable to fetch token from primary cloud provider and no secondary cloud provider has a token")
+	}
+
+	return
+}
+
+// FetchTokens fetches tokens from all cloud providers (deduplicated, primary first)
+func (m *CloudProviderMirror) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+	tokenIndex := map[string]bool{}
+	failedCount := 0
+
+	for _, provider := range m.providers {
+		contextLogger := m.logger.With(slog.String("mirror", provider.name))
+
+		var providerTokens []*bootstraptoken.BootstrapToken
+		err := provider.call(func() (err error) {
+			providerTokens, err = provider.provider.FetchTokens(ctx)
+			return
+		})
+		if err != nil {
+			contextLogger.Error("unable to fetch tokens from cloud provider", slog.Any("error", err))
+			failedCount++
+			continue
+		}
+
+		for _, token := range providerTokens {
+			if _, exists := tokenIndex[token.FullToken()]; exists {
+				continue
+			}
+
+			tokenIndex[token.FullToken()] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	if failedCount == len(m.providers) {
+		return nil, errors.New("unable to fetch tokens from any cloud provider")
+	}
+
+	return
+}
+
+// StoreToken stores token to all cloud providers, fails only if token could not be stored anywhere
+// as missing cloud providers are healed after next FetchToken
+func (m *CloudProviderMirror) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	failedCount := 0
+
+	for _, provider := range m.providers {
+		contextLogger := m.logger.With(slog.String("mirror", provider.name), slog.String("token", token.Id()))
+
+		err := provider.call(func() error {
+			return provider.provider.StoreToken(ctx, token)
+		})
+		if err != nil {
+			contextLogger.Error("unable to store token to cloud provider", slog.Any("error", err))
+			failedCount++
+		}
+	}
+
+	if failedCount == len(m.providers) {
+		return errors.New("unable to store token to any cloud provider")
+	}
+
+	return nil
+}
+
+// HealTargets returns the names of cloud providers which are missing the current token or have a different one,
+// cloud providers which failed on last FetchToken are skipped (probably not available)
+func (m *CloudProviderMirror) HealTargets(token *bootstraptoken.BootstrapToken) []string {
+	ret := []string{}
+	for _, provider := range m.providers {
+		providerToken, fetched := m.providerTokens[provider.name]
+		if !fetched {
+			continue
+		}
+
+		if providerToken != nil && providerToken.FullToken() == token.FullToken() {
+			continue
+		}
+
+		ret = append(ret, provider.name)
+	}
+
+	return ret
+}
+
+// Heal stores current token to all cloud providers which are missing the token or have a different one (see HealTargets)
+func (m *CloudProviderMirror) Heal(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	healErrors := []error{}
+	for _, name := range m.HealTargets(token) {
+		provider := m.provider(name)
+
+		contextLogger := m.logger.With(slog.String("mirror", provider.name), slog.String("token", token.Id()))
+		contextLogger.Warn("cloud provider is missing current token, healing")
+
+		err := provider.call(func() error {
+			return provider.provider.StoreToken(ctx, token)
+		})
+		if err != nil {
+			contextLogger.Error("unable to heal cloud provider", slog.Any("error", err))
+			healErrors = append(healErrors, err)
+			continue
+		}
+
+		m.providerTokens[provider.name] = token
+	}
+
+	return errors.Join(healErrors...)
+}
+
+// RotationTargets returns the rotation targets of all cloud providers implementing CloudProviderRotationHandler
+func (m *CloudProviderMirror) RotationTargets() []string {
+	ret := []string{}
+	for _, provider := range m.providers {
+		if handler, ok := provider.provider.(CloudProviderRotationHandler); ok {
+			for _, target := range handler.RotationTargets() {
+				ret = append(ret, fmt.Sprintf("%s:%s", provider.name, target))
+			}
+		}
+	}
+
+	return ret
+}
+
+// TokenRotated passes new token to all cloud providers implementing CloudProviderRotationHandler
+func (m *CloudProviderMirror) TokenRotated(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	rotationErrors := []error{}
+	for _, provider := range m.providers {
+		handler, ok := provider.provider.(CloudProviderRotationHandler)
+		if !ok {
+			continue
+		}
+
+		err := provider.call(func() error {
+			return handler.TokenRotated(ctx, token)
+		})
+		if err != nil {
+			rotationErrors = append(rotationErrors, err)
+		}
+	}
+
+	return errors.Join(rotationErrors...)
+}
+
+func (m *CloudProviderMirror) provider(name string) *mirrorCloudProvider {
+	for _, provider := range m.providers {
+		if provider.name == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+// calls cloud provider and also converts panics (eg. from out-of-tree cloud providers) into errors,
+// so one failing cloud provider doesn't stop the others
+func (p *mirrorCloudProvider) call(callback func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cloud provider \"%s\" failed: %v", p.name, r)
+		}
+	}()
+
+	if err = callback(); err != nil {
+		err = fmt.Errorf("cloud provider \"%s\" failed: %w", p.name, err)
+	}
+	return
+}
+
+// checks if token was created after current token (tokens without creation time are never newer)
+func mirrorTokenIsNewer(token, current *bootstraptoken.BootstrapToken) bool {
+	if token.CreationTime() == nil || current.CreationTime() == nil {
+		return false
+	}
+
+	return token.CreationTime().After(*current.CreationTime())
+}
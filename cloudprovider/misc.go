@@ -3,3 +3,14 @@ package cloudprovider
 func stringPtr(val string) *string {
 	return &val
 }
+
+func stringPtrValue(val *string) string {
+	if val == nil {
+		return ""
+	}
+	return *val
+}
+
+func boolPtr(val bool) *bool {
+	return &val
+}
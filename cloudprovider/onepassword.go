@@ -0,0 +1,464 @@
+package cloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	ONEPASSWORD_TAG_MANAGED_BY = "kube-bootstrap-token-manager"
+
+	ONEPASSWORD_SECTION_METADATA = "metadata"
+
+	ONEPASSWORD_FIELD_TOKEN   = "token"
+	ONEPASSWORD_FIELD_TOKENID = "token-id"
+	ONEPASSWORD_FIELD_CREATED = "created"
+	ONEPASSWORD_FIELD_EXPIRES = "expires"
+)
+
+var (
+	onePasswordVaultIdRegexp = regexp.MustCompile(`^[a-z0-9]{26}$`)
+)
+
+type (
+	CloudProviderOnePassword struct {
+		CloudProvider
+
+		opts *onePasswordOptions
+
+		logger *slogger.Logger
+
+		client    *http.Client
+		userAgent string
+
+		vaultId string
+	}
+
+	onePasswordVault struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	onePasswordItem struct {
+		Id        string                   `json:"id,omitempty"`
+		Title     string                   `json:"title"`
+		Category  string                   `json:"category"`
+		Vault     onePasswordVault         `json:"vault"`
+		Tags      []string                 `json:"tags,omitempty"`
+		Sections  []onePasswordItemSection `json:"sections,omitempty"`
+		Fields    []onePasswordItemField   `json:"fields,omitempty"`
+		CreatedAt *time.Time               `json:"createdAt,omitempty"`
+		UpdatedAt *time.Time               `json:"updatedAt,omitempty"`
+	}
+
+	onePasswordItemSection struct {
+		Id    string `json:"id"`
+		Label string `json:"label,omitempty"`
+	}
+
+	onePasswordItemField struct {
+		Id      string                  `json:"id"`
+		Type    string                  `json:"type"`
+		Purpose string                  `json:"purpose,omitempty"`
+		Label   string                  `json:"label,omitempty"`
+		Value   string                  `json:"value,omitempty"`
+		Section *onePasswordItemSection `json:"section,omitempty"`
+	}
+
+	onePasswordError struct {
+		StatusCode int    `json:"status"`
+		Message    string `json:"message"`
+	}
+
+	// options of 1Password Connect cloud provider
+	onePasswordOptions struct {
+		Url   *string `long:"onepassword.url"      env:"OP_CONNECT_HOST"     description:"URL of 1Password Connect server"`
+		Token *string `long:"onepassword.token"    env:"OP_CONNECT_TOKEN"    description:"Access token for 1Password Connect server" json:"-"`
+		Vault *string `long:"onepassword.vault"    env:"OP_VAULT"            description:"ID or name of 1Password vault to sync token"`
+		Item  string  `long:"onepassword.item"     env:"OP_ITEM"             description:"Title of 1Password items to sync token (one item per token)" default:"kube-bootstrap-token"`
+	}
+)
+
+var (
+	onePasswordOpts = &onePasswordOptions{}
+)
+
+func init() {
+	Register("onepassword", func() CloudProvider {
+		return &CloudProviderOnePassword{opts: onePasswordOpts}
+	})
+	RegisterOptions("onepassword", onePasswordOpts)
+}
+
+func (e *onePasswordError) Error() string {
+	return fmt.Sprintf("1Password Connect request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+func (m *CloudProviderOnePassword) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.userAgent = userAgent
+	m.logger = logger.With(
+		slog.String("cloudprovider", "onepassword"),
+	)
+
+	if m.opts.Url == nil || *m.opts.Url == "" {
+		return errors.New("no 1Password Connect url specified")
+	}
+
+	if m.opts.Token == nil || *m.opts.Token == "" {
+		return errors.New("no 1Password Connect token specified")
+	}
+
+	if m.opts.Vault == nil || *m.opts.Vault == "" {
+		return errors.New("no 1Password vault specified")
+	}
+
+	if m.opts.Item == "" {
+		return errors.New("no 1Password item title specified")
+	}
+
+	m.client = &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	vaultId, err := m.lookupVault(ctx)
+	if err != nil {
+		return err
+	}
+	m.vaultId = vaultId
+
+	return nil
+}
+
+// returns vault id, vault can be specified by id or name
+func (m *CloudProviderOnePassword) lookupVault(ctx context.Context) (string, error) {
+	vault := *m.opts.Vault
+	if onePasswordVaultIdRegexp.MatchString(vault) {
+		return vault, nil
+	}
+
+	vaultList := []onePasswordVault{}
+	err := m.request(ctx, http.MethodGet, "vaults", url.Values{"filter": []string{fmt.Sprintf(`name eq "%s"`, vault)}}, nil, &vaultList)
+	if err != nil {
+		return "", err
+	}
+
+	for _, row := range vaultList {
+		if row.Name == vault {
+			return row.Id, nil
+		}
+	}
+
+	return "", fmt.Errorf(`1Password vault "%s" not found`, vault)
+}
+
+func (m *CloudProviderOnePassword) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("vault", *m.opts.Vault), slog.String("item", m.opts.Item))
+
+	contextLogger.Info("fetching current token from 1Password")
+	itemList, err := m.fetchItems(ctx)
+	if err != nil {
+		return nil, m.handleOnePasswordError(contextLogger, err)
+	}
+
+	// items are sorted by creation, newest first
+	if len(itemList) == 0 {
+		contextLogger.Warn("no item found, assuming non existing token")
+		return
+	}
+
+	item, err := m.fetchItem(ctx, itemList[0].Id)
+	if err != nil {
+		return nil, m.handleOnePasswordError(contextLogger, err)
+	}
+
+	if item != nil {
+		token = m.parseItem(item)
+	}
+
+	return
+}
+
+func (m *CloudProviderOnePassword) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("vault", *m.opts.Vault), slog.String("item", m.opts.Item))
+	contextLogger.Info("fetching all tokens from 1Password")
+
+	itemList, err := m.fetchItems(ctx)
+	if err != nil {
+		return tokens, m.handleOnePasswordError(contextLogger, err)
+	}
+
+	for _, row := range itemList {
+		itemLogger := contextLogger.With(slog.String("itemId", row.Id))
+
+		item, err := m.fetchItem(ctx, row.Id)
+		if err != nil {
+			itemLogger.Warn(`unable to fetch item`, slog.Any("error", err))
+			continue
+		}
+
+		token := m.parseItem(item)
+		if token == nil {
+			continue
+		}
+
+		if token.ExpirationTime() != nil && time.Now().After(*token.ExpirationTime()) {
+			// expired
+			continue
+		}
+
+		itemLogger.Info("found valid item")
+		tokens = append(tokens, token)
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderOnePassword) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("vault", *m.opts.Vault),
+		slog.String("item", m.opts.Item),
+	)
+	contextLogger.Info("storing token to 1Password", slog.String("expiration", token.ExpirationString()))
+
+	metadataSection := onePasswordItemSection{Id: ONEPASSWORD_SECTION_METADATA, Label: "Metadata"}
+
+	item := onePasswordItem{
+		Title:    m.opts.Item,
+		Category: "PASSWORD",
+		Vault:    onePasswordVault{Id: m.vaultId},
+		Tags:     []string{ONEPASSWORD_TAG_MANAGED_BY},
+		Sections: []onePasswordItemSection{metadataSection},
+		Fields: []onePasswordItemField{
+			{Id: ONEPASSWORD_FIELD_TOKEN, Type: "CONCEALED", Purpose: "PASSWORD", Label: "token", Value: token.FullToken()},
+			{Id: ONEPASSWORD_FIELD_TOKENID, Type: "STRING", Label: "token id", Value: token.Id(), Section: &metadataSection},
+		},
+	}
+
+	if token.CreationTime() != nil {
+		item.Fields = append(item.Fields, onePasswordItemField{
+			Id: ONEPASSWORD_FIELD_CREATED, Type: "STRING", Label: "created", Value: token.CreationTime().UTC().Format(time.RFC3339), Section: &metadataSection,
+		})
+	}
+
+	if token.ExpirationTime() != nil {
+		item.Fields = append(item.Fields, onePasswordItemField{
+			Id: ONEPASSWORD_FIELD_EXPIRES, Type: "STRING", Label: "expires", Value: token.ExpirationTime().UTC().Format(time.RFC3339), Section: &metadataSection,
+		})
+	}
+
+	if err := m.request(ctx, http.MethodPost, fmt.Sprintf("vaults/%s/items", m.vaultId), nil, item, nil); err != nil {
+		return err
+	}
+
+	m.cleanupItems(ctx, contextLogger)
+
+	return nil
+}
+
+// removes expired and superseded items
+func (m *CloudProviderOnePassword) cleanupItems(ctx context.Context, logger *slogger.Logger) {
+	itemList, err := m.fetchItems(ctx)
+	if err != nil {
+		logger.Warn(`unable to fetch items for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, row := range itemList {
+		// always keep current item
+		if num == 0 {
+			continue
+		}
+
+		if retainVersion(num, nil) {
+			item, err := m.fetchItem(ctx, row.Id)
+			if err != nil {
+				logger.Warn(`unable to fetch item`, slog.Any("error", err))
+				continue
+			}
+
+			if expires := onePasswordItemFieldTime(item, ONEPASSWORD_FIELD_EXPIRES); expires == nil || time.Now().Before(*expires) {
+				continue
+			}
+		}
+
+		logger.Debug("removing item", slog.String("itemId", row.Id))
+		if err := m.request(ctx, http.MethodDelete, fmt.Sprintf("vaults/%s/items/%s", m.vaultId, row.Id), nil, nil, nil); err != nil {
+			logger.Warn(`unable to remove item`, slog.Any("error", err))
+		}
+	}
+}
+
+// fetches all managed items with configured title, sorted by creation (newest first)
+func (m *CloudProviderOnePassword) fetchItems(ctx context.Context) (itemList []onePasswordItem, err error) {
+	result := []onePasswordItem{}
+	query := url.Values{"filter": []string{fmt.Sprintf(`title eq "%s"`, m.opts.Item)}}
+	if err = m.request(ctx, http.MethodGet, fmt.Sprintf("vaults/%s/items", m.vaultId), query, nil, &result); err != nil {
+		return
+	}
+
+	itemList = []onePasswordItem{}
+	for _, item := range result {
+		// items with same title not created by manager are ignored
+		if item.Title != m.opts.Item || !onePasswordItemHasTag(item, ONEPASSWORD_TAG_MANAGED_BY) {
+			continue
+		}
+
+		itemList = append(itemList, item)
+	}
+
+	sort.SliceStable(itemList, func(i, j int) bool {
+		if itemList[i].CreatedAt == nil || itemList[j].CreatedAt == nil {
+			return itemList[i].CreatedAt != nil
+		}
+		return itemList[i].CreatedAt.After(*itemList[j].CreatedAt)
+	})
+
+	return
+}
+
+func (m *CloudProviderOnePassword) fetchItem(ctx context.Context, itemId string) (*onePasswordItem, error) {
+	item := onePasswordItem{}
+	if err := m.request(ctx, http.MethodGet, fmt.Sprintf("vaults/%s/items/%s", m.vaultId, itemId), nil, nil, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (m *CloudProviderOnePassword) parseItem(item *onePasswordItem) (token *bootstraptoken.BootstrapToken) {
+	for _, field := range item.Fields {
+		if field.Id == ONEPASSWORD_FIELD_TOKEN {
+			token = bootstraptoken.ParseFromString(field.Value)
+		}
+	}
+
+	if token == nil {
+		return
+	}
+
+	created := onePasswordItemFieldTime(item, ONEPASSWORD_FIELD_CREATED)
+	if created == nil {
+		created = item.CreatedAt
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	expires := onePasswordItemFieldTime(item, ONEPASSWORD_FIELD_EXPIRES)
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "onepassword")
+	token.SetAnnotation("bootstraptoken.webdevops.io/vault", m.vaultId)
+	token.SetAnnotation("bootstraptoken.webdevops.io/item", item.Title)
+	token.SetAnnotation("bootstraptoken.webdevops.io/itemId", item.Id)
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderOnePassword) request(ctx context.Context, method, resourcePath string, query url.Values, body, result interface{}) error {
+	requestUrl := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(*m.opts.Url, "/"), resourcePath)
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, requestBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", m.userAgent)
+	req.Header.Set("Authorization", "Bearer "+*m.opts.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode >= 300 {
+		errorResponse := onePasswordError{}
+		_ = json.NewDecoder(resp.Body).Decode(&errorResponse)
+		errorResponse.StatusCode = resp.StatusCode
+		return &errorResponse
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return nil
+}
+
+func (m *CloudProviderOnePassword) handleOnePasswordError(logger *slogger.Logger, err error) error {
+	var onePasswordErr *onePasswordError
+	statusCode := 0
+	if errors.As(err, &onePasswordErr) {
+		statusCode = onePasswordErr.StatusCode
+	}
+
+	forbidden := statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+	return handleFetchError(logger, err, statusCode == http.StatusNotFound, forbidden, "item", "unable to access 1Password Connect, please check token and vault access")
+}
+
+func onePasswordItemHasTag(item onePasswordItem, tag string) bool {
+	for _, val := range item.Tags {
+		if val == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func onePasswordItemFieldTime(item *onePasswordItem, fieldId string) *time.Time {
+	for _, field := range item.Fields {
+		if field.Id == fieldId {
+			if ret, err := time.Parse(time.RFC3339, field.Value); err == nil {
+				return &ret
+			}
+		}
+	}
+	return nil
+}
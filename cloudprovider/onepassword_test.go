@@ -0,0 +1,272 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	testOnePasswordVaultId   = "abcdefghijklmnopqrstuvwxyz"
+	testOnePasswordVaultName = "kubernetes"
+	testOnePasswordItem      = "kube-bootstrap-token"
+)
+
+// fakeOnePassword is a minimal in-memory 1Password Connect server for one vault
+type fakeOnePassword struct {
+	server *httptest.Server
+
+	lock   sync.Mutex
+	items  []*onePasswordItem
+	clock  time.Time
+	lastId int
+
+	// optional status code returned for all requests
+	failStatusCode int
+}
+
+func newFakeOnePassword(t *testing.T) *fakeOnePassword {
+	t.Helper()
+	op := &fakeOnePassword{
+		clock: time.Now().Add(-time.Hour).Truncate(time.Second).UTC(),
+	}
+	op.server = httptest.NewServer(http.HandlerFunc(op.serveHTTP))
+	t.Cleanup(op.server.Close)
+	return op
+}
+
+// add stores a new item with generated id and creation time
+func (op *fakeOnePassword) add(item onePasswordItem) *onePasswordItem {
+	op.clock = op.clock.Add(time.Second)
+	op.lastId++
+	created := op.clock
+	item.Id = fmt.Sprintf("item%022d", op.lastId)
+	item.Vault = onePasswordVault{Id: testOnePasswordVaultId}
+	item.CreatedAt = &created
+	item.UpdatedAt = &created
+	op.items = append(op.items, &item)
+	return &item
+}
+
+func (op *fakeOnePassword) itemCount() int {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	return len(op.items)
+}
+
+func (op *fakeOnePassword) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+
+	if op.failStatusCode != 0 {
+		op.writeError(w, op.failStatusCode)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer test" {
+		op.writeError(w, http.StatusUnauthorized)
+		return
+	}
+
+	itemsPath := "/v1/vaults/" + testOnePasswordVaultId + "/items"
+	switch {
+	case r.URL.Path == "/v1/vaults" && r.Method == http.MethodGet:
+		vaultList := []onePasswordVault{}
+		if r.URL.Query().Get("filter") == fmt.Sprintf(`name eq "%s"`, testOnePasswordVaultName) {
+			vaultList = append(vaultList, onePasswordVault{Id: testOnePasswordVaultId, Name: testOnePasswordVaultName})
+		}
+		op.writeJSON(w, http.StatusOK, vaultList)
+	case r.URL.Path == itemsPath && r.Method == http.MethodGet:
+		// item list doesn't contain fields
+		itemList := []onePasswordItem{}
+		for _, item := range op.items {
+			if r.URL.Query().Get("filter") != fmt.Sprintf(`title eq "%s"`, item.Title) {
+				continue
+			}
+			row := *item
+			row.Sections = nil
+			row.Fields = nil
+			itemList = append(itemList, row)
+		}
+		op.writeJSON(w, http.StatusOK, itemList)
+	case r.URL.Path == itemsPath && r.Method == http.MethodPost:
+		item := onePasswordItem{}
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil || item.Vault.Id != testOnePasswordVaultId {
+			op.writeError(w, http.StatusBadRequest)
+			return
+		}
+		op.writeJSON(w, http.StatusOK, op.add(item))
+	case strings.HasPrefix(r.URL.Path, itemsPath+"/"):
+		itemId := strings.TrimPrefix(r.URL.Path, itemsPath+"/")
+		for num, item := range op.items {
+			if item.Id != itemId {
+				continue
+			}
+			switch r.Method {
+			case http.MethodGet:
+				op.writeJSON(w, http.StatusOK, item)
+			case http.MethodDelete:
+				op.items = append(op.items[:num], op.items[num+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				op.writeError(w, http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		op.writeError(w, http.StatusNotFound)
+	default:
+		op.writeError(w, http.StatusNotFound)
+	}
+}
+
+func (op *fakeOnePassword) writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (op *fakeOnePassword) writeError(w http.ResponseWriter, statusCode int) {
+	op.writeJSON(w, statusCode, onePasswordError{StatusCode: statusCode, Message: "fake error"})
+}
+
+func newTestOnePasswordProvider(t *testing.T, op *fakeOnePassword, vault string) (*CloudProviderOnePassword, error) {
+	t.Helper()
+	m := &CloudProviderOnePassword{
+		opts: &onePasswordOptions{
+			Url:   stringPtr(op.server.URL + "/"),
+			Token: stringPtr("test"),
+			Vault: stringPtr(vault),
+			Item:  testOnePasswordItem,
+		},
+	}
+	return m, m.Init(context.Background(), config.Opts{}, newTestLogger(), "test")
+}
+
+func TestOnePasswordLookupVault(t *testing.T) {
+	op := newFakeOnePassword(t)
+
+	for _, vault := range []string{testOnePasswordVaultId, testOnePasswordVaultName} {
+		m, err := newTestOnePasswordProvider(t, op, vault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.vaultId != testOnePasswordVaultId {
+			t.Fatalf("expected vault id %s for vault %s, got %s", testOnePasswordVaultId, vault, m.vaultId)
+		}
+	}
+
+	if _, err := newTestOnePasswordProvider(t, op, "unknown"); err == nil {
+		t.Fatal("expected error for unknown vault")
+	}
+}
+
+func TestOnePasswordStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	op := newFakeOnePassword(t)
+	m, err := newTestOnePasswordProvider(t, op, testOnePasswordVaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing item must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	// items with same title not created by manager are ignored
+	op.lock.Lock()
+	op.add(onePasswordItem{
+		Title:    testOnePasswordItem,
+		Category: "PASSWORD",
+		Fields:   []onePasswordItemField{{Id: ONEPASSWORD_FIELD_TOKEN, Type: "CONCEALED", Value: "zzzzzz.0123456789abcdef"}},
+	})
+	op.lock.Unlock()
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration from item fields, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+
+	if count := op.itemCount(); count != 2 {
+		t.Fatalf("item not created by manager must not be removed, got %d items", count)
+	}
+}
+
+func TestOnePasswordStoreTokenCleansUpItems(t *testing.T) {
+	ctx := context.Background()
+	op := newFakeOnePassword(t)
+	m, err := newTestOnePasswordProvider(t, op, testOnePasswordVaultId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := bootstraptoken.NewBootstrapToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := op.itemCount(); count != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d items, got %d", SECRET_SYNC_COUNT_MAX, count)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.Id() == "expire" {
+			t.Fatal("expired token must not be fetched")
+		}
+	}
+}
+
+func TestOnePasswordFetchTokenUnauthorized(t *testing.T) {
+	op := newFakeOnePassword(t)
+	m, err := newTestOnePasswordProvider(t, op, testOnePasswordVaultId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.failStatusCode = http.StatusUnauthorized
+
+	var onePasswordErr *onePasswordError
+	if _, err := m.FetchToken(context.Background()); !errors.As(err, &onePasswordErr) || onePasswordErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
@@ -0,0 +1,113 @@
+package cloudprovider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// Factory creates a new (uninitialized) cloud provider instance
+	Factory func() CloudProvider
+
+	registryEntry struct {
+		factory Factory
+		options interface{}
+	}
+)
+
+var (
+	registry     = map[string]*registryEntry{}
+	registryLock sync.RWMutex
+)
+
+// Register registers a cloud provider under the given name, it's usually called from init()
+// of the package implementing the provider (out-of-tree providers are enabled by a blank import in main.go).
+// Registering the same name twice panics.
+func Register(name string, factory Factory) {
+	name = strings.ToLower(name)
+
+	if name == "" {
+		panic("cloud provider name must not be empty")
+	}
+
+	if factory == nil {
+		panic(fmt.Sprintf("cloud provider \"%s\" registered without factory", name))
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if entry, exists := registry[name]; exists {
+		if entry.factory != nil {
+			panic(fmt.Sprintf("cloud provider \"%s\" already registered", name))
+		}
+		entry.factory = factory
+		return
+	}
+
+	registry[name] = &registryEntry{factory: factory}
+}
+
+// RegisterOptions registers an options struct for a cloud provider, options are declared using
+// go-flags struct tags (long, env, description, default, ...) and are added as own group
+// to the argument parser. The provider reads the (parsed) options from the passed pointer.
+func RegisterOptions(name string, options interface{}) {
+	name = strings.ToLower(name)
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if entry, exists := registry[name]; exists {
+		if entry.options != nil {
+			panic(fmt.Sprintf("options for cloud provider \"%s\" already registered", name))
+		}
+		entry.options = options
+		return
+	}
+
+	registry[name] = &registryEntry{options: options}
+}
+
+// Providers returns the names of all registered cloud providers (sorted)
+func Providers() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	ret := []string{}
+	for name, entry := range registry {
+		if entry.factory != nil {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+// ProviderOptions returns the registered options struct of all cloud providers (only providers with options)
+func ProviderOptions() map[string]interface{} {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	ret := map[string]interface{}{}
+	for name, entry := range registry {
+		if entry.factory != nil && entry.options != nil {
+			ret[name] = entry.options
+		}
+	}
+
+	return ret
+}
+
+func lookupProvider(name string) Factory {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	if entry, exists := registry[strings.ToLower(name)]; exists {
+		return entry.factory
+	}
+
+	return nil
+}
@@ -0,0 +1,411 @@
+package cloudprovider
+
+import (
+	"context"
+	"crypto/md5" // #nosec G501 -- md5 is required by S3 for SSE-C key checksum
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	S3_METADATA_CREATED = "bootstraptoken-created"
+	S3_METADATA_EXPIRES = "bootstraptoken-expires"
+
+	S3_SSE_CUSTOMER_ALGORITHM = "AES256"
+
+	// S3 requires a region for request signing, S3-compatible stores (eg. MinIO) usually accept this default
+	S3_DEFAULT_REGION = "us-east-1"
+)
+
+type (
+	CloudProviderS3 struct {
+		CloudProvider
+
+		opts *s3Options
+
+		// region and endpoint of AWS options are used as defaults
+		awsOpts *awsOptions
+
+		logger *slogger.Logger
+
+		s3Client *s3.Client
+
+		sseCustomerKey    *string
+		sseCustomerKeyMd5 *string
+	}
+
+	s3ObjectVersion struct {
+		versionId    string
+		lastModified *time.Time
+		value        string
+		metadata     map[string]string
+	}
+
+	// options of S3 cloud provider
+	s3Options struct {
+		Bucket         *string `long:"s3.bucket"               env:"S3_BUCKET"               description:"Name of S3 bucket to sync token (versioning should be enabled)"`
+		Key            string  `long:"s3.key"                  env:"S3_KEY"                  description:"Object key in S3 bucket to sync token" default:"kube-bootstrap-token"`
+		Endpoint       *string `long:"s3.endpoint"             env:"S3_ENDPOINT"             description:"Custom S3 endpoint URL (eg. for MinIO)"`
+		PathStyle      bool    `long:"s3.path-style"           env:"S3_PATH_STYLE"           description:"Use path style addressing for S3 bucket (eg. for MinIO)"`
+		Sse            string  `long:"s3.sse"                  env:"S3_SSE"                  description:"Server side encryption for S3 object" choice:"" choice:"AES256" choice:"aws:kms" choice:"aws:kms:dsse"` // nolint:staticcheck // multiple choices are ok
+		SseKmsKeyId    string  `long:"s3.sse.kms-key"          env:"S3_SSE_KMS_KEY"          description:"KMS key ID for S3 server side encryption (aws:kms)"`
+		SseCustomerKey string  `long:"s3.sse.customer-key"     env:"S3_SSE_CUSTOMER_KEY"     description:"Base64 encoded 256 bit key for S3 server side encryption with customer key (SSE-C)" json:"-"`
+	}
+)
+
+var (
+	s3Opts = &s3Options{}
+)
+
+func init() {
+	Register("s3", func() CloudProvider {
+		return &CloudProviderS3{opts: s3Opts, awsOpts: awsOpts}
+	})
+	RegisterOptions("s3", s3Opts)
+}
+
+func (m *CloudProviderS3) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	m.logger = logger.With(
+		slog.String("cloudprovider", "s3"),
+	)
+
+	if m.opts.Bucket == nil || *m.opts.Bucket == "" {
+		return errors.New("no S3 bucket specified")
+	}
+
+	if m.opts.Key == "" {
+		return errors.New("no S3 object key specified")
+	}
+
+	if m.opts.SseCustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(m.opts.SseCustomerKey)
+		if err != nil || len(key) != 32 {
+			return errors.New("S3 SSE-C key must be a base64 encoded 256 bit key")
+		}
+
+		keyMd5 := md5.Sum(key) // #nosec G401 -- md5 is required by S3 for SSE-C key checksum
+		m.sseCustomerKey = aws.String(m.opts.SseCustomerKey)
+		m.sseCustomerKeyMd5 = aws.String(base64.StdEncoding.EncodeToString(keyMd5[:]))
+	}
+
+	awsConfig, err := newAwsConfig(ctx, m.awsOpts, userAgent)
+	if err != nil {
+		return err
+	}
+
+	if awsConfig.Region == "" {
+		awsConfig.Region = S3_DEFAULT_REGION
+	}
+
+	m.s3Client = s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if m.opts.Endpoint != nil && *m.opts.Endpoint != "" {
+			o.BaseEndpoint = m.opts.Endpoint
+		}
+		o.UsePathStyle = m.opts.PathStyle
+	})
+
+	// check if bucket versioning is enabled, otherwise only current token is available
+	versioning, err := m.s3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket: m.opts.Bucket,
+	})
+	if err != nil {
+		m.logger.Warn("unable to check S3 bucket versioning", slog.Any("error", err))
+	} else if versioning.Status != types.BucketVersioningStatusEnabled {
+		m.logger.Warn("S3 bucket versioning is not enabled, only current token is available")
+	}
+
+	return nil
+}
+
+func (m *CloudProviderS3) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	contextLogger := m.logger.With(slog.String("bucket", *m.opts.Bucket), slog.String("key", m.opts.Key))
+
+	contextLogger.Info("fetching current token from S3")
+	object, err := m.fetchObject(ctx, nil)
+	if err != nil {
+		return nil, m.handleS3Error(contextLogger, err)
+	}
+
+	return m.parseObject(object), nil
+}
+
+func (m *CloudProviderS3) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+
+	contextLogger := m.logger.With(slog.String("bucket", *m.opts.Bucket), slog.String("key", m.opts.Key))
+	contextLogger.Info("fetching all tokens from S3")
+
+	versionList, err := m.fetchObjectVersions(ctx, contextLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versionList {
+		versionLogger := contextLogger.With(slog.String("objectVersion", aws.ToString(version.VersionId)))
+
+		object, err := m.fetchObject(ctx, version.VersionId)
+		if err != nil {
+			if m.handleS3Error(versionLogger, err) != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if expires := s3MetadataTime(object.metadata, S3_METADATA_EXPIRES); expires != nil && time.Now().After(*expires) {
+			// expired
+			continue
+		}
+
+		if token := m.parseObject(object); token != nil {
+			versionLogger.Info("found valid object version")
+			tokens = append(tokens, token)
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderS3) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("bucket", *m.opts.Bucket),
+		slog.String("key", m.opts.Key),
+	)
+	contextLogger.Info("storing token to S3", slog.String("expiration", token.ExpirationString()))
+
+	metadata := map[string]string{}
+	if token.CreationTime() != nil {
+		metadata[S3_METADATA_CREATED] = token.CreationTime().UTC().Format(time.RFC3339)
+	}
+	if token.ExpirationTime() != nil {
+		metadata[S3_METADATA_EXPIRES] = token.ExpirationTime().UTC().Format(time.RFC3339)
+	}
+
+	putInput := s3.PutObjectInput{
+		Bucket:      m.opts.Bucket,
+		Key:         aws.String(m.opts.Key),
+		Body:        strings.NewReader(token.FullToken()),
+		ContentType: aws.String("text/plain"),
+		Metadata:    metadata,
+		Tagging:     aws.String("managed-by=kube-bootstrap-token-manager"),
+	}
+
+	switch {
+	case m.sseCustomerKey != nil:
+		putInput.SSECustomerAlgorithm = aws.String(S3_SSE_CUSTOMER_ALGORITHM)
+		putInput.SSECustomerKey = m.sseCustomerKey
+		putInput.SSECustomerKeyMD5 = m.sseCustomerKeyMd5
+	case m.opts.Sse != "":
+		putInput.ServerSideEncryption = types.ServerSideEncryption(m.opts.Sse)
+		if m.opts.SseKmsKeyId != "" {
+			putInput.SSEKMSKeyId = aws.String(m.opts.SseKmsKeyId)
+		}
+	}
+
+	if _, err := m.s3Client.PutObject(ctx, &putInput); err != nil {
+		return err
+	}
+
+	m.cleanupObjectVersions(ctx, contextLogger)
+
+	return nil
+}
+
+// removes expired and superseded object versions
+func (m *CloudProviderS3) cleanupObjectVersions(ctx context.Context, logger *slogger.Logger) {
+	versionList, err := m.fetchObjectVersions(ctx, logger)
+	if err != nil {
+		logger.Warn(`unable to fetch object versions for cleanup`, slog.Any("error", err))
+		return
+	}
+
+	for num, version := range versionList {
+		// always keep current version
+		if num == 0 || aws.ToBool(version.IsLatest) {
+			continue
+		}
+
+		if retainVersion(num, nil) {
+			object, err := m.headObject(ctx, version.VersionId)
+			if err != nil {
+				logger.Warn(`unable to fetch object version metadata`, slog.Any("error", err))
+				continue
+			}
+
+			if expires := s3MetadataTime(object.Metadata, S3_METADATA_EXPIRES); expires == nil || time.Now().Before(*expires) {
+				continue
+			}
+		}
+
+		logger.Debug("removing object version", slog.String("objectVersion", aws.ToString(version.VersionId)))
+		_, err := m.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:    m.opts.Bucket,
+			Key:       aws.String(m.opts.Key),
+			VersionId: version.VersionId,
+		})
+		if err != nil {
+			logger.Warn(`unable to remove object version`, slog.Any("error", err))
+		}
+	}
+}
+
+// fetches all object versions (without delete markers), sorted by modification time (newest first)
+func (m *CloudProviderS3) fetchObjectVersions(ctx context.Context, logger *slogger.Logger) (versionList []types.ObjectVersion, err error) {
+	versionList = []types.ObjectVersion{}
+
+	pager := s3.NewListObjectVersionsPaginator(m.s3Client, &s3.ListObjectVersionsInput{
+		Bucket: m.opts.Bucket,
+		Prefix: aws.String(m.opts.Key),
+	})
+	for pager.HasMorePages() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return versionList, m.handleS3Error(logger, err)
+		}
+
+		for _, version := range result.Versions {
+			// prefix also matches other objects
+			if aws.ToString(version.Key) == m.opts.Key {
+				versionList = append(versionList, version)
+			}
+		}
+	}
+
+	// versions are returned newest first by S3, but not every S3-compatible store guarantees it
+	sort.SliceStable(versionList, func(i, j int) bool {
+		return s3VersionIsNewer(versionList[i], versionList[j])
+	})
+
+	return
+}
+
+func (m *CloudProviderS3) fetchObject(ctx context.Context, versionId *string) (*s3ObjectVersion, error) {
+	getInput := s3.GetObjectInput{
+		Bucket:    m.opts.Bucket,
+		Key:       aws.String(m.opts.Key),
+		VersionId: versionId,
+	}
+
+	if m.sseCustomerKey != nil {
+		getInput.SSECustomerAlgorithm = aws.String(S3_SSE_CUSTOMER_ALGORITHM)
+		getInput.SSECustomerKey = m.sseCustomerKey
+		getInput.SSECustomerKeyMD5 = m.sseCustomerKeyMd5
+	}
+
+	result, err := m.s3Client.GetObject(ctx, &getInput)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close() // nolint:errcheck
+
+	value, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3ObjectVersion{
+		versionId:    aws.ToString(result.VersionId),
+		lastModified: result.LastModified,
+		value:        strings.TrimSpace(string(value)),
+		metadata:     result.Metadata,
+	}, nil
+}
+
+func (m *CloudProviderS3) headObject(ctx context.Context, versionId *string) (*s3.HeadObjectOutput, error) {
+	headInput := s3.HeadObjectInput{
+		Bucket:    m.opts.Bucket,
+		Key:       aws.String(m.opts.Key),
+		VersionId: versionId,
+	}
+
+	if m.sseCustomerKey != nil {
+		headInput.SSECustomerAlgorithm = aws.String(S3_SSE_CUSTOMER_ALGORITHM)
+		headInput.SSECustomerKey = m.sseCustomerKey
+		headInput.SSECustomerKeyMD5 = m.sseCustomerKeyMd5
+	}
+
+	return m.s3Client.HeadObject(ctx, &headInput)
+}
+
+func (m *CloudProviderS3) parseObject(object *s3ObjectVersion) (token *bootstraptoken.BootstrapToken) {
+	token = bootstraptoken.ParseFromString(object.value)
+	if token == nil {
+		return
+	}
+
+	created := s3MetadataTime(object.metadata, S3_METADATA_CREATED)
+	if created == nil {
+		created = object.lastModified
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	expires := s3MetadataTime(object.metadata, S3_METADATA_EXPIRES)
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "s3")
+	token.SetAnnotation("bootstraptoken.webdevops.io/object", fmt.Sprintf("s3://%s/%s", *m.opts.Bucket, m.opts.Key))
+	token.SetAnnotation("bootstraptoken.webdevops.io/objectVersion", object.versionId)
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderS3) handleS3Error(logger *slogger.Logger, err error) error {
+	code := awsErrorCode(err)
+	if code == "NoSuchBucket" {
+		// bucket is not created by manager
+		logger.Error("S3 bucket not found, please create bucket (with versioning enabled)")
+		return err
+	}
+
+	return handleFetchError(logger, err, code == "NoSuchKey" || code == "NotFound", code == "AccessDenied" || code == "Forbidden", "object", "unable to access S3 bucket, please check access")
+}
+
+func s3VersionIsNewer(version, other types.ObjectVersion) bool {
+	if aws.ToBool(version.IsLatest) != aws.ToBool(other.IsLatest) {
+		return aws.ToBool(version.IsLatest)
+	}
+
+	return aws.ToTime(version.LastModified).After(aws.ToTime(other.LastModified))
+}
+
+func s3MetadataTime(metadata map[string]string, name string) *time.Time {
+	// metadata keys are case insensitive and might be returned in canonical form
+	for key, val := range metadata {
+		if strings.EqualFold(key, name) {
+			if ret, err := time.Parse(time.RFC3339, val); err == nil {
+				return &ret
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package cloudprovider
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	testS3Bucket = "bucket"
+	testS3Key    = "kube-bootstrap-token"
+
+	testS3SseCustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+)
+
+type (
+	// fakeS3 is a minimal in-memory S3 (path style, versioning enabled) for one bucket
+	fakeS3 struct {
+		server *httptest.Server
+
+		lock          sync.Mutex
+		versions      []*fakeS3Version
+		clock         time.Time
+		lastVersionId int
+
+		// required SSE-C key (empty = no SSE-C)
+		sseCustomerKey string
+
+		// optional error code returned for all requests
+		fail string
+	}
+
+	fakeS3Version struct {
+		key          string
+		versionId    string
+		body         string
+		metadata     map[string]string
+		lastModified time.Time
+		sse          string
+	}
+
+	fakeS3ListVersionsResult struct {
+		XMLName  xml.Name `xml:"ListVersionsResult"`
+		Name     string
+		Prefix   string
+		Versions []fakeS3ListVersion `xml:"Version"`
+	}
+
+	fakeS3ListVersion struct {
+		Key          string
+		VersionId    string
+		IsLatest     bool
+		LastModified string
+	}
+)
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	s := &fakeS3{
+		clock: time.Now().Add(-time.Hour).Truncate(time.Second),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// put stores a new object version
+func (s *fakeS3) put(key, body string, metadata map[string]string) *fakeS3Version {
+	s.clock = s.clock.Add(time.Second)
+	s.lastVersionId++
+	version := &fakeS3Version{
+		key:          key,
+		versionId:    fmt.Sprintf("v%d", s.lastVersionId),
+		body:         body,
+		metadata:     metadata,
+		lastModified: s.clock,
+	}
+	s.versions = append(s.versions, version)
+	return version
+}
+
+// latest returns the current version of key (nil if not existing)
+func (s *fakeS3) latest(key string) *fakeS3Version {
+	for num := len(s.versions) - 1; num >= 0; num-- {
+		if s.versions[num].key == key {
+			return s.versions[num]
+		}
+	}
+	return nil
+}
+
+func (s *fakeS3) versionCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.versions)
+}
+
+func (s *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.fail != "" {
+		s.writeError(w, r, http.StatusForbidden, s.fail)
+		return
+	}
+
+	if r.URL.Path == "/"+testS3Bucket {
+		switch {
+		case r.URL.Query().Has("versioning"):
+			s.writeXML(w, `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+		case r.URL.Query().Has("versions"):
+			s.listVersions(w, r)
+		default:
+			s.writeError(w, r, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	key, found := strings.CutPrefix(r.URL.Path, "/"+testS3Bucket+"/")
+	if !found {
+		s.writeError(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if !s.checkSseCustomerKey(w, r) {
+			return
+		}
+		body, err := s.readBody(r)
+		if err != nil {
+			s.writeError(w, r, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		metadata := map[string]string{}
+		for name := range r.Header {
+			if metaKey, found := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); found {
+				metadata[metaKey] = r.Header.Get(name)
+			}
+		}
+		version := s.put(key, body, metadata)
+		version.sse = r.Header.Get("X-Amz-Server-Side-Encryption")
+		w.Header().Set("X-Amz-Version-Id", version.versionId)
+	case http.MethodGet, http.MethodHead:
+		version := s.latest(key)
+		if versionId := r.URL.Query().Get("versionId"); versionId != "" {
+			version = nil
+			for _, item := range s.versions {
+				if item.key == key && item.versionId == versionId {
+					version = item
+				}
+			}
+		}
+		if version == nil {
+			s.writeError(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if !s.checkSseCustomerKey(w, r) {
+			return
+		}
+		for name, value := range version.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("X-Amz-Version-Id", version.versionId)
+		w.Header().Set("Last-Modified", version.lastModified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(version.body)))
+		w.Header().Set("X-Amz-Checksum-Crc32", fakeS3Checksum(version.body))
+		if r.Method == http.MethodGet {
+			_, _ = io.WriteString(w, version.body)
+		}
+	case http.MethodDelete:
+		versionId := r.URL.Query().Get("versionId")
+		for num, item := range s.versions {
+			if item.key == key && item.versionId == versionId {
+				s.versions = append(s.versions[:num], s.versions[num+1:]...)
+				break
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) listVersions(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	result := fakeS3ListVersionsResult{Name: testS3Bucket, Prefix: prefix}
+
+	// newest first, like S3
+	for num := len(s.versions) - 1; num >= 0; num-- {
+		version := s.versions[num]
+		if !strings.HasPrefix(version.key, prefix) {
+			continue
+		}
+		result.Versions = append(result.Versions, fakeS3ListVersion{
+			Key:          version.key,
+			VersionId:    version.versionId,
+			IsLatest:     s.latest(version.key) == version,
+			LastModified: version.lastModified.UTC().Format(time.RFC3339),
+		})
+	}
+
+	body, err := xml.Marshal(result)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	s.writeXML(w, string(body))
+}
+
+// checkSseCustomerKey checks that the configured SSE-C key is sent
+func (s *fakeS3) checkSseCustomerKey(w http.ResponseWriter, r *http.Request) bool {
+	if s.sseCustomerKey == "" || r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key") == s.sseCustomerKey {
+		return true
+	}
+	s.writeError(w, r, http.StatusBadRequest, "InvalidRequest")
+	return false
+}
+
+// readBody reads request body, aws-chunked encoding (used for trailing checksums) is decoded
+func (s *fakeS3) readBody(r *http.Request) (string, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		body, err := io.ReadAll(r.Body)
+		return string(body), err
+	}
+
+	body := strings.Builder{}
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return "", err
+		}
+		if size == 0 {
+			return body.String(), nil
+		}
+		if _, err := io.CopyN(&body, reader, size); err != nil {
+			return "", err
+		}
+		if _, err := reader.ReadString('\n'); err != nil {
+			return "", err
+		}
+	}
+}
+
+// fakeS3Checksum returns the CRC32 checksum of body (validated by SDK on GetObject)
+func fakeS3Checksum(body string) string {
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE([]byte(body)))
+	return base64.StdEncoding.EncodeToString(checksum)
+}
+
+func (s *fakeS3) writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, body)
+}
+
+func (s *fakeS3) writeError(w http.ResponseWriter, r *http.Request, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	if r.Method != http.MethodHead {
+		_, _ = fmt.Fprintf(w, `<Error><Code>%s</Code><Message>fake error</Message></Error>`, code)
+	}
+}
+
+func newTestS3Provider(t *testing.T, s *fakeS3, opts *s3Options) *CloudProviderS3 {
+	t.Helper()
+	setTestAwsEnvironment(t)
+
+	opts.Bucket = stringPtr(testS3Bucket)
+	opts.Key = testS3Key
+	opts.Endpoint = stringPtr(s.server.URL)
+	opts.PathStyle = true
+
+	m := &CloudProviderS3{
+		opts:    opts,
+		awsOpts: &awsOptions{},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestS3StoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeS3(t)
+	m := newTestS3Provider(t, s, &s3Options{Sse: "AES256"})
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing object must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	if err := m.StoreToken(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if sse := s.latest(testS3Key).sse; sse != "AES256" {
+		t.Fatalf("expected server side encryption AES256, got %q", sse)
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration from object metadata, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+	if objectVersion := token.Annotations()["bootstraptoken.webdevops.io/objectVersion"]; objectVersion != "v1" {
+		t.Fatalf("expected object version annotation v1, got %q", objectVersion)
+	}
+}
+
+func TestS3StoreTokenCleansUpVersions(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeS3(t)
+	m := newTestS3Provider(t, s, &s3Options{})
+
+	// other object matching key prefix must not be touched
+	s.put(testS3Key+"-other", "zzzzzz.0123456789abcdef", nil)
+
+	expired := bootstraptoken.NewBootstrapToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	if err := m.StoreToken(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for num := 0; num < SECRET_SYNC_COUNT_MAX+2; num++ {
+		if err := m.StoreToken(ctx, newTestToken(fmt.Sprintf("tok%03d", num), "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// latest SECRET_SYNC_COUNT_MAX versions of key and the other object are kept
+	if count := s.versionCount(); count != SECRET_SYNC_COUNT_MAX+1 {
+		t.Fatalf("expected %d object versions, got %d", SECRET_SYNC_COUNT_MAX+1, count)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != SECRET_SYNC_COUNT_MAX {
+		t.Fatalf("expected %d tokens, got %d", SECRET_SYNC_COUNT_MAX, len(tokens))
+	}
+	if tokens[0].Id() != fmt.Sprintf("tok%03d", SECRET_SYNC_COUNT_MAX+1) {
+		t.Fatalf("expected newest token first, got %s", tokens[0].Id())
+	}
+	for _, token := range tokens {
+		if token.Id() == "expire" || token.Id() == "zzzzzz" {
+			t.Fatalf("unexpected token %s", token.Id())
+		}
+	}
+}
+
+func TestS3StoreAndFetchTokenWithCustomerKey(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeS3(t)
+	s.sseCustomerKey = testS3SseCustomerKey
+	m := newTestS3Provider(t, s, &s3Options{SseCustomerKey: testS3SseCustomerKey})
+
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	for num := 0; num < 2; num++ {
+		if err := m.StoreToken(ctx, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].FullToken() != stored.FullToken() {
+		t.Fatalf("expected two versions of token %s, got %v", stored.Id(), tokens)
+	}
+
+	// wrong key must not be accepted
+	s.sseCustomerKey = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	if _, err := m.FetchToken(ctx); err == nil {
+		t.Fatal("expected error fetching object with wrong customer key")
+	}
+}
+
+func TestS3InitRejectsInvalidCustomerKey(t *testing.T) {
+	setTestAwsEnvironment(t)
+	m := &CloudProviderS3{
+		opts: &s3Options{
+			Bucket:         stringPtr(testS3Bucket),
+			Key:            testS3Key,
+			SseCustomerKey: base64.StdEncoding.EncodeToString([]byte("too short")),
+		},
+		awsOpts: &awsOptions{},
+	}
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err == nil {
+		t.Fatal("expected invalid customer key to be rejected")
+	}
+}
+
+func TestS3FetchTokenAccessDenied(t *testing.T) {
+	s := newFakeS3(t)
+	m := newTestS3Provider(t, s, &s3Options{})
+	s.fail = "AccessDenied"
+
+	if _, err := m.FetchToken(context.Background()); err == nil || awsErrorCode(err) != "AccessDenied" {
+		t.Fatalf("expected AccessDenied, got %v", err)
+	}
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
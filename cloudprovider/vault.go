@@ -0,0 +1,468 @@
+package cloudprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/webdevops/go-common/log/slogger"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	VAULT_DATA_TOKEN                = "token"
+	VAULT_DATA_CREATED              = "created"
+	VAULT_DATA_EXPIRES              = "expires"
+	VAULT_METADATA_EXPIRES_PREFIX   = "expires-v"
+	VAULT_METADATA_CREATED_PREFIX   = "created-v"
+	VAULT_AUTH_RENEW_BEFORE_EXPIRY  = 1 * time.Minute
+	VAULT_AUTH_METHOD_TOKEN         = "token"
+	VAULT_AUTH_METHOD_KUBERNETES    = "kubernetes"
+	VAULT_AUTH_METHOD_APPROLE       = "approle"
+	VAULT_CUSTOM_METADATA_KEYS_MAX  = 64
+	VAULT_CUSTOM_METADATA_PER_TOKEN = 2
+)
+
+type (
+	CloudProviderVault struct {
+		CloudProvider
+
+		opts *vaultOptions
+
+		logger *slogger.Logger
+
+		client     *vault.Client
+		authExpiry *time.Time
+	}
+
+	// options of HashiCorp Vault cloud provider
+	vaultOptions struct {
+		Address *string `long:"vault.address"    env:"VAULT_ADDR"     description:"Vault address (defaults to Vault client configuration)"`
+		Token   *string `long:"vault.token"      env:"VAULT_TOKEN"    description:"Vault token (for token auth)" json:"-"`
+		Mount   string  `long:"vault.mount"      env:"VAULT_MOUNT"    description:"Mount path of KV v2 secret engine" default:"secret"`
+		Path    *string `long:"vault.path"       env:"VAULT_PATH"     description:"Path of KV v2 secret to sync token" default:"kube-bootstrap-token"`
+
+		Auth struct {
+			Method              string `long:"vault.auth.method"                  env:"VAULT_AUTH_METHOD"                  description:"Vault auth method" choice:"token" choice:"kubernetes" choice:"approle" default:"token"` // nolint:staticcheck // multiple choices are ok
+			Mount               string `long:"vault.auth.mount"                   env:"VAULT_AUTH_MOUNT"                   description:"Mount path of Vault auth method (defaults to auth method name)"`
+			Role                string `long:"vault.auth.role"                    env:"VAULT_AUTH_ROLE"                    description:"Role for Vault kubernetes auth"`
+			KubernetesTokenPath string `long:"vault.auth.kubernetes.token-path"   env:"VAULT_AUTH_KUBERNETES_TOKEN_PATH"   description:"Path of ServiceAccount token for Vault kubernetes auth" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+			AppRoleRoleId       string `long:"vault.auth.approle.role-id"         env:"VAULT_AUTH_APPROLE_ROLE_ID"         description:"Role ID for Vault approle auth"`
+			AppRoleSecretId     string `long:"vault.auth.approle.secret-id"       env:"VAULT_AUTH_APPROLE_SECRET_ID"       description:"Secret ID for Vault approle auth" json:"-"`
+		}
+	}
+)
+
+var (
+	vaultOpts = &vaultOptions{}
+)
+
+func init() {
+	Register("vault", func() CloudProvider {
+		return &CloudProviderVault{opts: vaultOpts}
+	})
+	RegisterOptions("vault", vaultOpts)
+}
+
+func (m *CloudProviderVault) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	var err error
+	m.logger = logger.With(
+		slog.String("cloudprovider", "vault"),
+	)
+
+	if m.opts.Path == nil || *m.opts.Path == "" {
+		return errors.New("no Vault secret path specified")
+	}
+
+	vaultConfig := vault.DefaultConfig()
+	if vaultConfig.Error != nil {
+		return vaultConfig.Error
+	}
+
+	if m.opts.Address != nil && *m.opts.Address != "" {
+		vaultConfig.Address = *m.opts.Address
+	}
+
+	m.client, err = vault.NewClient(vaultConfig)
+	if err != nil {
+		return err
+	}
+	m.client.AddHeader("User-Agent", userAgent)
+
+	switch m.opts.Auth.Method {
+	case VAULT_AUTH_METHOD_TOKEN:
+		if m.opts.Token != nil && *m.opts.Token != "" {
+			m.client.SetToken(*m.opts.Token)
+		}
+
+		if m.client.Token() == "" {
+			return errors.New("no Vault token specified")
+		}
+	default:
+		if err := m.login(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *CloudProviderVault) FetchToken(ctx context.Context) (token *bootstraptoken.BootstrapToken, err error) {
+	secretPath := *m.opts.Path
+
+	contextLogger := m.logger.With(slog.String("mount", m.opts.Mount), slog.String("path", secretPath))
+
+	contextLogger.Info("fetching current token from Vault")
+	if err := m.ensureLogin(ctx, contextLogger); err != nil {
+		return nil, err
+	}
+
+	secret, err := m.kv().Get(ctx, secretPath)
+	if err != nil {
+		return nil, m.handleVaultError(contextLogger, err)
+	}
+
+	if secret != nil {
+		token = m.parseSecret(secret, secret.CustomMetadata)
+	}
+
+	return
+}
+
+func (m *CloudProviderVault) FetchTokens(ctx context.Context) (tokens []*bootstraptoken.BootstrapToken, err error) {
+	tokens = []*bootstraptoken.BootstrapToken{}
+	secretPath := *m.opts.Path
+
+	contextLogger := m.logger.With(slog.String("mount", m.opts.Mount), slog.String("path", secretPath))
+	contextLogger.Info("fetching all tokens from Vault")
+	if err := m.ensureLogin(ctx, contextLogger); err != nil {
+		return tokens, err
+	}
+
+	metadata, err := m.kv().GetMetadata(ctx, secretPath)
+	if err != nil {
+		return tokens, m.handleVaultError(contextLogger, err)
+	}
+
+	if metadata == nil {
+		return
+	}
+
+	// get versions first
+	secretCandidateList := []vault.KVVersionMetadata{}
+	for _, secretVersion := range metadata.Versions {
+		if secretVersion.Destroyed || !secretVersion.DeletionTime.IsZero() {
+			continue
+		}
+
+		if expires := vaultMetadataTime(metadata.CustomMetadata, VAULT_METADATA_EXPIRES_PREFIX, secretVersion.Version); expires != nil && time.Now().After(*expires) {
+			// expired
+			continue
+		}
+
+		secretCandidateList = append(secretCandidateList, secretVersion)
+	}
+
+	// sort results
+	sort.Slice(secretCandidateList, func(i, j int) bool {
+		return secretCandidateList[i].Version > secretCandidateList[j].Version
+	})
+
+	// process list
+	for _, secretVersion := range secretCandidateList {
+		secretLogger := contextLogger.With(slog.Int("secretVersion", secretVersion.Version))
+
+		secret, err := m.kv().GetVersion(ctx, secretPath, secretVersion.Version)
+		if err != nil {
+			secretLogger.Warn(`unable to fetch secret`, slog.Any("error", err))
+			continue
+		}
+
+		if token := m.parseSecret(secret, metadata.CustomMetadata); token != nil {
+			if token.ExpirationTime() != nil && time.Now().After(*token.ExpirationTime()) {
+				// expired (custom metadata of version is missing)
+				continue
+			}
+
+			secretLogger.Info("found valid secret")
+			tokens = append(tokens, token)
+		}
+
+		if syncLimitReached(tokens) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *CloudProviderVault) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	secretPath := *m.opts.Path
+
+	contextLogger := m.logger.With(
+		slog.String("token", token.Id()),
+		slog.String("mount", m.opts.Mount),
+		slog.String("path", secretPath),
+	)
+	contextLogger.Info("storing token to Vault", slog.String("expiration", token.ExpirationString()))
+	if err := m.ensureLogin(ctx, contextLogger); err != nil {
+		return err
+	}
+
+	// check-and-set with current version (0 if secret doesn't exist yet), so concurrent managers can't overwrite each other's token
+	currentVersion := 0
+	metadata, err := m.kv().GetMetadata(ctx, secretPath)
+	switch {
+	case errors.Is(err, vault.ErrSecretNotFound):
+		metadata = nil
+	case err != nil:
+		return err
+	default:
+		currentVersion = metadata.CurrentVersion
+	}
+
+	// creation and expiration are also stored in the version data, so they're written atomically with the token
+	data := map[string]interface{}{
+		VAULT_DATA_TOKEN: token.FullToken(),
+	}
+	if token.CreationTime() != nil {
+		data[VAULT_DATA_CREATED] = token.CreationTime().UTC().Format(time.RFC3339)
+	}
+	if token.ExpirationTime() != nil {
+		data[VAULT_DATA_EXPIRES] = token.ExpirationTime().UTC().Format(time.RFC3339)
+	}
+
+	secret, err := m.kv().Put(ctx, secretPath, data, vault.WithCheckAndSet(currentVersion))
+	if err != nil {
+		if vaultIsCheckAndSetError(err) {
+			return fmt.Errorf("token was stored concurrently (check-and-set version %d): %w", currentVersion, err)
+		}
+		return err
+	}
+
+	if secret.VersionMetadata == nil {
+		return errors.New("no version metadata returned from Vault")
+	}
+
+	// KV v2 custom metadata is shared between all versions, so expiry and creation time are stored per version
+	// (used to skip expired versions without fetching them)
+	version := secret.VersionMetadata.Version
+	customMetadata := map[string]interface{}{
+		"managed-by": "kube-bootstrap-token-manager",
+	}
+
+	if token.CreationTime() != nil {
+		customMetadata[fmt.Sprintf("%s%d", VAULT_METADATA_CREATED_PREFIX, version)] = token.CreationTime().UTC().Format(time.RFC3339)
+	}
+
+	if token.ExpirationTime() != nil {
+		customMetadata[fmt.Sprintf("%s%d", VAULT_METADATA_EXPIRES_PREFIX, version)] = token.ExpirationTime().UTC().Format(time.RFC3339)
+	}
+
+	// remove metadata of old versions, Vault only allows a limited amount of custom metadata keys
+	if metadata != nil {
+		for key := range metadata.CustomMetadata {
+			keyVersion := vaultMetadataVersion(key)
+			if keyVersion == 0 {
+				continue
+			}
+
+			versionMetadata, exists := metadata.Versions[strconv.Itoa(keyVersion)]
+			if !exists || versionMetadata.Destroyed || !versionMetadata.DeletionTime.IsZero() || keyVersion <= version-(VAULT_CUSTOM_METADATA_KEYS_MAX/VAULT_CUSTOM_METADATA_PER_TOKEN-1) {
+				// JSON merge patch, null removes the key
+				customMetadata[key] = nil
+			}
+		}
+	}
+
+	// token is already stored (including creation and expiration), failed metadata is written again on next store
+	err = m.kv().PatchMetadata(ctx, secretPath, vault.KVMetadataPatchInput{
+		CustomMetadata: customMetadata,
+	})
+	if err != nil {
+		contextLogger.Warn("unable to update secret metadata", slog.Any("error", err))
+	}
+
+	return nil
+}
+
+func (m *CloudProviderVault) parseSecret(secret *vault.KVSecret, customMetadata map[string]interface{}) (token *bootstraptoken.BootstrapToken) {
+	if secret == nil || secret.Data == nil || secret.VersionMetadata == nil {
+		return
+	}
+
+	value, ok := secret.Data[VAULT_DATA_TOKEN].(string)
+	if !ok {
+		return
+	}
+
+	token = bootstraptoken.ParseFromString(value)
+	if token == nil {
+		return
+	}
+
+	version := secret.VersionMetadata.Version
+
+	// version data takes precedence, custom metadata is used for versions stored by previous releases
+	created := vaultDataTime(secret.Data, VAULT_DATA_CREATED)
+	if created == nil {
+		created = vaultMetadataTime(customMetadata, VAULT_METADATA_CREATED_PREFIX, version)
+	}
+	if created == nil && !secret.VersionMetadata.CreatedTime.IsZero() {
+		created = &secret.VersionMetadata.CreatedTime
+	}
+	if created != nil {
+		token.SetCreationTime(*created)
+	}
+
+	expires := vaultDataTime(secret.Data, VAULT_DATA_EXPIRES)
+	if expires == nil {
+		expires = vaultMetadataTime(customMetadata, VAULT_METADATA_EXPIRES_PREFIX, version)
+	}
+	if expires != nil {
+		token.SetExpirationTime(*expires)
+	}
+
+	token.SetAnnotation("bootstraptoken.webdevops.io/provider", "vault")
+	token.SetAnnotation("bootstraptoken.webdevops.io/secret", fmt.Sprintf("%s/%s", m.opts.Mount, *m.opts.Path))
+	token.SetAnnotation("bootstraptoken.webdevops.io/secretVersion", strconv.Itoa(version))
+
+	if created != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/created", created.Format(time.RFC3339))
+	}
+
+	if expires != nil {
+		token.SetAnnotation("bootstraptoken.webdevops.io/expires", expires.Format(time.RFC3339))
+	}
+
+	return
+}
+
+func (m *CloudProviderVault) kv() *vault.KVv2 {
+	return m.client.KVv2(m.opts.Mount)
+}
+
+// renews Vault login if token is going to expire
+func (m *CloudProviderVault) ensureLogin(ctx context.Context, logger *slogger.Logger) error {
+	if m.authExpiry == nil || time.Now().Add(VAULT_AUTH_RENEW_BEFORE_EXPIRY).Before(*m.authExpiry) {
+		return nil
+	}
+
+	logger.Info("Vault token is going to expire, renewing login")
+	return m.login(ctx)
+}
+
+// login to Vault using kubernetes or approle auth method
+func (m *CloudProviderVault) login(ctx context.Context) error {
+	authOpts := m.opts.Auth
+
+	authMount := authOpts.Mount
+	if authMount == "" {
+		authMount = authOpts.Method
+	}
+
+	loginData := map[string]interface{}{}
+	switch authOpts.Method {
+	case VAULT_AUTH_METHOD_KUBERNETES:
+		if authOpts.Role == "" {
+			return errors.New("no Vault role for kubernetes auth specified")
+		}
+
+		jwt, err := os.ReadFile(authOpts.KubernetesTokenPath)
+		if err != nil {
+			return fmt.Errorf(`unable to read ServiceAccount token: %w`, err)
+		}
+
+		loginData["role"] = authOpts.Role
+		loginData["jwt"] = strings.TrimSpace(string(jwt))
+	case VAULT_AUTH_METHOD_APPROLE:
+		if authOpts.AppRoleRoleId == "" {
+			return errors.New("no Vault role ID for approle auth specified")
+		}
+
+		loginData["role_id"] = authOpts.AppRoleRoleId
+		loginData["secret_id"] = authOpts.AppRoleSecretId
+	default:
+		return fmt.Errorf(`unsupported Vault auth method "%s"`, authOpts.Method)
+	}
+
+	m.logger.Info("login to Vault", slog.String("method", authOpts.Method), slog.String("mount", authMount))
+	secret, err := m.client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", authMount), loginData)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return errors.New("no token returned from Vault login")
+	}
+
+	m.client.SetToken(secret.Auth.ClientToken)
+	m.authExpiry = nil
+	if secret.Auth.LeaseDuration > 0 {
+		authExpiry := time.Now().Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+		m.authExpiry = &authExpiry
+	}
+
+	return nil
+}
+
+func (m *CloudProviderVault) handleVaultError(logger *slogger.Logger, err error) error {
+	var responseErr *vault.ResponseError
+	forbidden := errors.As(err, &responseErr) && responseErr.StatusCode == 403
+	return handleFetchError(logger, err, errors.Is(err, vault.ErrSecretNotFound), forbidden, "secret", "unable to access Vault, please check access")
+}
+
+// returns true if write was rejected because of check-and-set version mismatch
+func vaultIsCheckAndSetError(err error) bool {
+	var responseErr *vault.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != 400 {
+		return false
+	}
+
+	for _, msg := range responseErr.Errors {
+		if strings.Contains(msg, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
+
+func vaultMetadataTime(customMetadata map[string]interface{}, prefix string, version int) *time.Time {
+	if val, ok := customMetadata[fmt.Sprintf("%s%d", prefix, version)].(string); ok {
+		if ret, err := time.Parse(time.RFC3339, val); err == nil {
+			return &ret
+		}
+	}
+	return nil
+}
+
+// returns time of version data key (or nil if not set)
+func vaultDataTime(data map[string]interface{}, key string) *time.Time {
+	if val, ok := data[key].(string); ok {
+		if ret, err := time.Parse(time.RFC3339, val); err == nil {
+			return &ret
+		}
+	}
+	return nil
+}
+
+// returns version of per version custom metadata key (or 0 if not a per version key)
+func vaultMetadataVersion(key string) int {
+	for _, prefix := range []string{VAULT_METADATA_EXPIRES_PREFIX, VAULT_METADATA_CREATED_PREFIX} {
+		if val, ok := strings.CutPrefix(key, prefix); ok {
+			if version, err := strconv.Atoi(val); err == nil {
+				return version
+			}
+		}
+	}
+	return 0
+}
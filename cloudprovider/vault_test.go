@@ -0,0 +1,351 @@
+package cloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+type (
+	// fakeVault is a minimal in-memory Vault KV v2 secret engine (mount "secret") for one secret
+	fakeVault struct {
+		server *httptest.Server
+
+		lock           sync.Mutex
+		versions       []fakeVaultVersion
+		customMetadata map[string]interface{}
+
+		// optional status code returned for all requests
+		failStatusCode int
+
+		// optional status code returned for metadata patches
+		failPatchStatusCode int
+
+		// called before a write is processed (eg. to simulate concurrent writes)
+		beforeWrite func()
+	}
+
+	fakeVaultVersion struct {
+		data    map[string]interface{}
+		created time.Time
+	}
+)
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	v := &fakeVault{
+		customMetadata: map[string]interface{}{},
+	}
+	v.server = httptest.NewServer(http.HandlerFunc(v.serveHTTP))
+	t.Cleanup(v.server.Close)
+	return v
+}
+
+// put stores a new version (without check-and-set)
+func (v *fakeVault) put(data map[string]interface{}) {
+	v.versions = append(v.versions, fakeVaultVersion{data: data, created: time.Now().UTC()})
+}
+
+func (v *fakeVault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && v.beforeWrite != nil {
+		v.beforeWrite()
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.failStatusCode != 0 {
+		v.writeJSON(w, v.failStatusCode, map[string]interface{}{"errors": []string{"fake error"}})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != "test" {
+		v.writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/secret/data/kube-bootstrap-token" && r.Method == http.MethodGet:
+		version := len(v.versions)
+		if val := r.URL.Query().Get("version"); val != "" {
+			version, _ = strconv.Atoi(val)
+		}
+		if version < 1 || version > len(v.versions) {
+			v.writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		v.writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data":     v.versions[version-1].data,
+			"metadata": v.versionMetadata(version),
+		}})
+	case r.URL.Path == "/v1/secret/data/kube-bootstrap-token":
+		body := struct {
+			Data    map[string]interface{} `json:"data"`
+			Options map[string]interface{} `json:"options"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			v.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		if cas, ok := body.Options["cas"].(float64); ok && int(cas) != len(v.versions) {
+			v.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		v.put(body.Data)
+		v.writeJSON(w, http.StatusOK, map[string]interface{}{"data": v.versionMetadata(len(v.versions))})
+	case r.URL.Path == "/v1/secret/metadata/kube-bootstrap-token" && r.Method == http.MethodGet:
+		if len(v.versions) == 0 {
+			v.writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		versions := map[string]interface{}{}
+		for num := range v.versions {
+			versions[strconv.Itoa(num+1)] = v.versionMetadata(num + 1)
+		}
+		v.writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(v.versions),
+			"oldest_version":  1,
+			"custom_metadata": v.customMetadata,
+			"versions":        versions,
+		}})
+	case r.URL.Path == "/v1/secret/metadata/kube-bootstrap-token" && r.Method == http.MethodPatch:
+		if v.failPatchStatusCode != 0 {
+			v.writeJSON(w, v.failPatchStatusCode, map[string]interface{}{"errors": []string{"fake error"}})
+			return
+		}
+
+		// JSON merge patch, null removes key
+		body := struct {
+			CustomMetadata map[string]interface{} `json:"custom_metadata"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			v.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		for key, value := range body.CustomMetadata {
+			if value == nil {
+				delete(v.customMetadata, key)
+			} else {
+				v.customMetadata[key] = value
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		v.writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func (v *fakeVault) versionMetadata(version int) map[string]interface{} {
+	return map[string]interface{}{
+		"version":         version,
+		"created_time":    v.versions[version-1].created.Format(time.RFC3339Nano),
+		"deletion_time":   "",
+		"destroyed":       false,
+		"custom_metadata": v.customMetadata,
+	}
+}
+
+func (v *fakeVault) writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newTestVaultProvider(t *testing.T, v *fakeVault) *CloudProviderVault {
+	t.Helper()
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_MAX_RETRIES", "0")
+
+	m := &CloudProviderVault{
+		opts: &vaultOptions{
+			Address: stringPtr(v.server.URL),
+			Token:   stringPtr("test"),
+			Mount:   "secret",
+			Path:    stringPtr("kube-bootstrap-token"),
+		},
+	}
+	m.opts.Auth.Method = VAULT_AUTH_METHOD_TOKEN
+	if err := m.Init(context.Background(), config.Opts{}, newTestLogger(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestVaultStoreAndFetchToken(t *testing.T) {
+	ctx := context.Background()
+	v := newFakeVault(t)
+	m := newTestVaultProvider(t, v)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil || token != nil {
+		t.Fatalf("missing secret must be treated as non existing token, got %v, %v", token, err)
+	}
+
+	expired := newTestToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	for _, storeToken := range []*bootstraptoken.BootstrapToken{expired, stored} {
+		if err := m.StoreToken(ctx, storeToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token, err = m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.FullToken() != stored.FullToken() {
+		t.Fatalf("expected token %s, got %v", stored.Id(), token)
+	}
+	if !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration of stored token, got %v, %v", token.CreationTime(), token.ExpirationTime())
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Id() != "aaaaaa" {
+		t.Fatalf("expected only valid token aaaaaa, got %v", tokens)
+	}
+}
+
+func TestVaultStoreTokenCheckAndSet(t *testing.T) {
+	ctx := context.Background()
+	v := newFakeVault(t)
+	m := newTestVaultProvider(t, v)
+
+	if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	// another manager stores its token between reading the current version and writing
+	v.beforeWrite = func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.put(map[string]interface{}{VAULT_DATA_TOKEN: "bbbbbb.0123456789abcdef"})
+		v.beforeWrite = nil
+	}
+
+	err := m.StoreToken(ctx, newTestToken("cccccc", "0123456789abcdef"))
+	if err == nil || !strings.Contains(err.Error(), "check-and-set") {
+		t.Fatalf("expected check-and-set conflict, got %v", err)
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Id() != "bbbbbb" {
+		t.Fatalf("concurrently stored token must not be overwritten, got %v", token)
+	}
+}
+
+func TestVaultStoreTokenRemovesOldCustomMetadata(t *testing.T) {
+	ctx := context.Background()
+	v := newFakeVault(t)
+	m := newTestVaultProvider(t, v)
+
+	for num := 0; num < VAULT_CUSTOM_METADATA_KEYS_MAX; num++ {
+		if err := m.StoreToken(ctx, newTestToken("aaaaaa", "0123456789abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(v.customMetadata) > VAULT_CUSTOM_METADATA_KEYS_MAX {
+		t.Fatalf("expected at most %d custom metadata keys, got %d", VAULT_CUSTOM_METADATA_KEYS_MAX, len(v.customMetadata))
+	}
+	if _, exists := v.customMetadata[VAULT_METADATA_EXPIRES_PREFIX+"1"]; exists {
+		t.Fatal("expected custom metadata of old versions to be removed")
+	}
+	if _, exists := v.customMetadata[VAULT_METADATA_EXPIRES_PREFIX+strconv.Itoa(VAULT_CUSTOM_METADATA_KEYS_MAX)]; !exists {
+		t.Fatal("expected custom metadata of current version")
+	}
+}
+
+func TestVaultFetchTokenForbidden(t *testing.T) {
+	v := newFakeVault(t)
+	m := newTestVaultProvider(t, v)
+	v.failStatusCode = http.StatusForbidden
+
+	if _, err := m.FetchToken(context.Background()); err == nil {
+		t.Fatal("expected error without access")
+	}
+	if err := m.StoreToken(context.Background(), newTestToken("aaaaaa", "0123456789abcdef")); err == nil {
+		t.Fatal("expected error storing token without access")
+	}
+}
+
+func TestVaultStoreTokenMetadataPatchFailure(t *testing.T) {
+	ctx := context.Background()
+	v := newFakeVault(t)
+	m := newTestVaultProvider(t, v)
+	v.failPatchStatusCode = http.StatusForbidden
+
+	// token is stored with the version, failed metadata must not fail the store (and roll back the secret in cluster)
+	expired := newTestToken("expire", "0123456789abcdef")
+	expired.SetExpirationTime(time.Now().Add(-time.Minute).UTC().Truncate(time.Second))
+	stored := newTestToken("aaaaaa", "0123456789abcdef")
+	for _, storeToken := range []*bootstraptoken.BootstrapToken{expired, stored} {
+		if err := m.StoreToken(ctx, storeToken); err != nil {
+			t.Fatalf("expected store to succeed without metadata, got %v", err)
+		}
+	}
+	if len(v.customMetadata) != 0 {
+		t.Fatalf("expected no custom metadata, got %v", v.customMetadata)
+	}
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || !token.CreationTime().Equal(*stored.CreationTime()) || !token.ExpirationTime().Equal(*stored.ExpirationTime()) {
+		t.Fatalf("expected creation and expiration from version data, got %v", token)
+	}
+
+	tokens, err := m.FetchTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Id() != "aaaaaa" {
+		t.Fatalf("expected only valid token aaaaaa, got %v", tokens)
+	}
+
+	// metadata is written again with the next token
+	v.failPatchStatusCode = 0
+	if err := m.StoreToken(ctx, newTestToken("bbbbbb", "0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := v.customMetadata[VAULT_METADATA_EXPIRES_PREFIX+"3"]; !exists {
+		t.Fatalf("expected custom metadata of current version, got %v", v.customMetadata)
+	}
+}
+
+func TestVaultFetchTokenCustomMetadataFallback(t *testing.T) {
+	ctx := context.Background()
+	v := newFakeVault(t)
+	m := newTestVaultProvider(t, v)
+
+	// version stored by previous releases, creation and expiration only in custom metadata
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	v.put(map[string]interface{}{VAULT_DATA_TOKEN: "aaaaaa.0123456789abcdef"})
+	v.customMetadata[VAULT_METADATA_EXPIRES_PREFIX+"1"] = expires.Format(time.RFC3339)
+
+	token, err := m.FetchToken(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.ExpirationTime() == nil || !token.ExpirationTime().Equal(expires) {
+		t.Fatalf("expected expiration from custom metadata, got %v", token)
+	}
+}
@@ -34,26 +34,34 @@ type (
 			Time           time.Duration `long:"sync.time"               env:"SYNC_TIME"                 description:"Sync time (time.Duration)" default:"1h"`
 			RecreateBefore time.Duration `long:"sync.recreate-before"    env:"SYNC_RECREATE_BEFORE"      description:"Time duration (time.Duration) when token should be recreated" default:"2190h"`
 			Full           bool          `long:"sync.full"               env:"SYNC_FULL"                 description:"Sync also previous tokens (full sync)"`
+			Drift          string        `long:"sync.drift"              env:"SYNC_DRIFT"                description:"Handling of drift between cloud provider token and bootstrap token secret (repair: overwrite secret, report: only log and expose as metric)" choice:"repair" choice:"report" default:"repair"` // nolint:staticcheck // multiple choices are ok
 		}
 
-		CloudProvider struct {
-			Provider *string `long:"cloud-provider"  env:"CLOUD_PROVIDER"       description:"Cloud provider" choice:"azure" required:"true"`
+		LeaderElection struct {
+			Enabled       bool          `long:"leader-election"                  env:"LEADER_ELECTION"                  description:"Enable leader election (Lease), only leader syncs tokens (for running multiple replicas)"`
+			Name          string        `long:"leader-election.name"             env:"LEADER_ELECTION_NAME"             description:"Name of leader election Lease" default:"kube-bootstrap-token-manager"`
+			Namespace     string        `long:"leader-election.namespace"        env:"LEADER_ELECTION_NAMESPACE"        description:"Namespace of leader election Lease (defaults to bootstrap token namespace)"`
+			Identity      string        `long:"leader-election.identity"         env:"LEADER_ELECTION_IDENTITY"         description:"Identity of this replica (defaults to hostname, eg. pod name)"`
+			LeaseDuration time.Duration `long:"leader-election.lease-duration"   env:"LEADER_ELECTION_LEASE_DURATION"   description:"Duration (time.Duration) followers wait before taking over leadership" default:"15s"`
+			RenewDeadline time.Duration `long:"leader-election.renew-deadline"   env:"LEADER_ELECTION_RENEW_DEADLINE"   description:"Duration (time.Duration) the leader retries renewing leadership before giving up" default:"10s"`
+			RetryPeriod   time.Duration `long:"leader-election.retry-period"     env:"LEADER_ELECTION_RETRY_PERIOD"     description:"Duration (time.Duration) between leader election actions" default:"2s"`
+		}
 
-			Azure struct {
-				KeyVaultUrl        *string `long:"azure.keyvault.url"       env:"AZURE_KEYVAULT_URL"          description:"URL of Keyvault to sync token"`
-				KeyVaultSecretName *string `long:"azure.keyvault.secret"    env:"AZURE_KEYVAULT_SECRET"       description:"Name of Keyvault secret to sync token" default:"kube-bootstrap-token"`
-			}
+		CloudProvider struct {
+			Provider *string  `long:"cloud-provider"  env:"CLOUD_PROVIDER"       description:"Cloud provider" required:"true"`
+			Mirror   []string `long:"cloud-provider.mirror"  env:"CLOUD_PROVIDER_MIRROR"  env-delim:" "  description:"Secondary cloud providers to mirror token to (fallback if primary cloud provider fails)"`
 		}
 
 		// general options
-		DryRun bool `long:"dry-run"  env:"DRY_RUN"       description:"Dry run (do not apply to nodes)"`
+		DryRun bool `long:"dry-run"  env:"DRY_RUN"       description:"Dry run (do not create, update or store tokens, log reconciliation plan instead)"`
 
 		// general options
 		Server struct {
 			// general options
-			Bind         string        `long:"server.bind"              env:"SERVER_BIND"           description:"Server address"        default:":8080"`
-			ReadTimeout  time.Duration `long:"server.timeout.read"      env:"SERVER_TIMEOUT_READ"   description:"Server read timeout"   default:"5s"`
-			WriteTimeout time.Duration `long:"server.timeout.write"     env:"SERVER_TIMEOUT_WRITE"  description:"Server write timeout"  default:"10s"`
+			Bind            string        `long:"server.bind"              env:"SERVER_BIND"             description:"Server address"        default:":8080"`
+			ReadTimeout     time.Duration `long:"server.timeout.read"      env:"SERVER_TIMEOUT_READ"     description:"Server read timeout"   default:"5s"`
+			WriteTimeout    time.Duration `long:"server.timeout.write"     env:"SERVER_TIMEOUT_WRITE"    description:"Server write timeout"  default:"10s"`
+			ShutdownTimeout time.Duration `long:"server.timeout.shutdown"  env:"SERVER_TIMEOUT_SHUTDOWN" description:"Server graceful shutdown timeout"  default:"10s"`
 		}
 	}
 )
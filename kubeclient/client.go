@@ -0,0 +1,33 @@
+package kubeclient
+
+import (
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// NewRestConfig builds Kubernetes client configuration from kubeconfig (optionally with context)
+// or from in cluster configuration if no kubeconfig is specified
+func NewRestConfig(kubeconfig, kubecontext string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		// KUBECONFIG
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: kubecontext},
+		).ClientConfig()
+	}
+
+	// K8S in cluster
+	return rest.InClusterConfig()
+}
+
+// NewClient creates Kubernetes clientset, see NewRestConfig
+func NewClient(kubeconfig, kubecontext string) (*kubernetes.Clientset, error) {
+	config, err := NewRestConfig(kubeconfig, kubecontext)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
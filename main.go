@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/webdevops/go-common/azuresdk/prometheus/tracing"
 
+	"github.com/webdevops/kube-bootstrap-token-manager/cloudprovider"
 	"github.com/webdevops/kube-bootstrap-token-manager/config"
 	"github.com/webdevops/kube-bootstrap-token-manager/manager"
 )
@@ -24,6 +30,9 @@ var (
 	argparser *flags.Parser
 	Opts      config.Opts
 
+	// options of cloud providers (by option group)
+	ProviderOpts = map[string]interface{}{}
+
 	// Git version information
 	gitCommit = "<unknown>"
 	gitTag    = "<unknown>"
@@ -36,6 +45,9 @@ func main() {
 
 	logger.Infof("starting kube-bootstrap-token-manager v%s (%s; %s; by %v at %v)", gitTag, gitCommit, runtime.Version(), Author, buildDate)
 	logger.Info(string(Opts.GetJson()))
+	if providerOptsJson, err := json.Marshal(ProviderOpts); err == nil {
+		logger.Info(string(providerOptsJson))
+	}
 	initSystem()
 
 	manager := manager.KubeBootstrapTokenManager{
@@ -45,15 +57,54 @@ func main() {
 		UserAgent: fmt.Sprintf(`%s/%s`, UserAgent, gitTag),
 	}
 
-	manager.Init()
+	// root context, cancelled on SIGTERM/SIGINT for graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := manager.Init(ctx); err != nil {
+		logger.Fatal(err.Error())
+	}
 	manager.Start()
 
 	logger.Infof("starting http server on %s", Opts.Server.Bind)
-	startHttpServer()
+	startHttpServer(ctx)
+
+	logger.Info("waiting for sync to stop")
+	manager.Wait()
+	logger.Info("shutdown complete")
 }
 
 func initArgparser() {
 	argparser = flags.NewParser(&Opts, flags.Default)
+
+	// cloud provider choices are derived from registered cloud providers
+	for _, longName := range []string{"cloud-provider", "cloud-provider.mirror"} {
+		if opt := argparser.FindOptionByLongName(longName); opt != nil {
+			opt.Choices = cloudprovider.Providers()
+		}
+	}
+
+	// options of registered cloud providers, providers sharing options (eg. etcd and consul) are added as one group
+	providerOptions := cloudprovider.ProviderOptions()
+	providerOptionNames := map[interface{}][]string{}
+	providerOptionList := []interface{}{}
+	for _, name := range cloudprovider.Providers() {
+		if options, exists := providerOptions[name]; exists {
+			if _, seen := providerOptionNames[options]; !seen {
+				providerOptionList = append(providerOptionList, options)
+			}
+			providerOptionNames[options] = append(providerOptionNames[options], name)
+		}
+	}
+
+	for _, options := range providerOptionList {
+		groupName := fmt.Sprintf("Cloud provider %s", strings.Join(providerOptionNames[options], ", "))
+		if _, err := argparser.AddGroup(groupName, "", options); err != nil {
+			panic(err)
+		}
+		ProviderOpts[groupName] = options
+	}
+
 	_, err := argparser.Parse()
 
 	// check if there is an parse error
@@ -69,7 +120,8 @@ func initArgparser() {
 	}
 }
 
-func startHttpServer() {
+// startHttpServer serves http until ctx is cancelled, then shuts down gracefully
+func startHttpServer(ctx context.Context) {
 	mux := http.NewServeMux()
 
 	// healthz
@@ -94,7 +146,17 @@ func startHttpServer() {
 		ReadTimeout:  Opts.Server.ReadTimeout,
 		WriteTimeout: Opts.Server.WriteTimeout,
 	}
-	if err := srv.ListenAndServe(); err != nil {
-		logger.Fatal(err.Error())
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal(err.Error())
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutting down http server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), Opts.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error(err.Error())
 	}
 }
@@ -0,0 +1,75 @@
+package manager
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+)
+
+const (
+	SYNC_DRIFT_REPAIR = "repair"
+	SYNC_DRIFT_REPORT = "report"
+
+	DRIFT_REASON_MISSING     = "missing"
+	DRIFT_REASON_SECRET      = "secret"
+	DRIFT_REASON_EXPIRATION  = "expiration"
+	DRIFT_REASON_USAGES      = "usages"
+	DRIFT_REASON_EXTRAGROUPS = "extra-groups"
+)
+
+// detectTokenDrift compares the bootstrap token secret in the cluster with the token fetched from the cloud provider
+// and returns the reasons of all differences, resource may be nil if the secret doesn't exist
+func (m *KubeBootstrapTokenManager) detectTokenDrift(resource *corev1.Secret, token *bootstraptoken.BootstrapToken) []string {
+	if resource == nil {
+		return []string{DRIFT_REASON_MISSING}
+	}
+
+	reasons := []string{}
+	data := func(key string) string {
+		return string(resource.Data[key])
+	}
+
+	if data("token-secret") != token.Secret() {
+		reasons = append(reasons, DRIFT_REASON_SECRET)
+	}
+
+	expiration := ""
+	if token.ExpirationTime() != nil {
+		expiration = token.ExpirationTime().UTC().Format(time.RFC3339)
+	}
+	if data("expiration") != expiration {
+		reasons = append(reasons, DRIFT_REASON_EXPIRATION)
+	}
+
+	if data("usage-bootstrap-authentication") != m.Opts.BootstrapToken.UsageBootstrapAuthentication || data("usage-bootstrap-signing") != m.Opts.BootstrapToken.UsageBootstrapSigning {
+		reasons = append(reasons, DRIFT_REASON_USAGES)
+	}
+
+	if data("auth-extra-groups") != m.Opts.BootstrapToken.AuthExtraGroups {
+		reasons = append(reasons, DRIFT_REASON_EXTRAGROUPS)
+	}
+
+	return reasons
+}
+
+// setDriftMetrics exposes the drift reasons of the token (previous reasons of the token are removed)
+func (m *KubeBootstrapTokenManager) setDriftMetrics(token *bootstraptoken.BootstrapToken, reasons []string) {
+	m.prometheus.drift.DeletePartialMatch(prometheus.Labels{"tokenID": token.Id()})
+	for _, reason := range reasons {
+		m.prometheus.drift.WithLabelValues(token.Id(), reason).Set(1)
+	}
+}
+
+// repairDrift returns true if drifted bootstrap token secrets should be overwritten
+func (m *KubeBootstrapTokenManager) repairDrift() bool {
+	return m.Opts.Sync.Drift == SYNC_DRIFT_REPAIR
+}
+
+// driftReasons returns reasons as string (for log messages)
+func driftReasons(reasons []string) string {
+	return strings.Join(reasons, ", ")
+}
@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDetectTokenDrift(t *testing.T) {
+	m := newTestManager(SYNC_DRIFT_REPAIR, &fakeCloudProvider{})
+	token := newTestToken("aaaaaa", "0123456789abcdef")
+
+	testCases := []struct {
+		name     string
+		modify   func(resource *corev1.Secret)
+		missing  bool
+		expected []string
+	}{
+		{
+			name:     "missing",
+			missing:  true,
+			expected: []string{DRIFT_REASON_MISSING},
+		},
+		{
+			name:     "up to date",
+			modify:   func(resource *corev1.Secret) {},
+			expected: []string{},
+		},
+		{
+			name: "secret",
+			modify: func(resource *corev1.Secret) {
+				resource.Data["token-secret"] = []byte("fedcba9876543210")
+			},
+			expected: []string{DRIFT_REASON_SECRET},
+		},
+		{
+			name: "expiration",
+			modify: func(resource *corev1.Secret) {
+				resource.Data["expiration"] = []byte(time.Now().UTC().Format(time.RFC3339))
+			},
+			expected: []string{DRIFT_REASON_EXPIRATION},
+		},
+		{
+			name: "expiration removed",
+			modify: func(resource *corev1.Secret) {
+				delete(resource.Data, "expiration")
+			},
+			expected: []string{DRIFT_REASON_EXPIRATION},
+		},
+		{
+			name: "usages",
+			modify: func(resource *corev1.Secret) {
+				resource.Data["usage-bootstrap-signing"] = []byte("false")
+			},
+			expected: []string{DRIFT_REASON_USAGES},
+		},
+		{
+			name: "extra groups and secret",
+			modify: func(resource *corev1.Secret) {
+				resource.Data["token-secret"] = []byte("fedcba9876543210")
+				resource.Data["auth-extra-groups"] = []byte("system:bootstrappers:other")
+			},
+			expected: []string{DRIFT_REASON_SECRET, DRIFT_REASON_EXTRAGROUPS},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var resource *corev1.Secret
+			if !testCase.missing {
+				resource = newTestSecret(m, token)
+				testCase.modify(resource)
+			}
+
+			if drift := m.detectTokenDrift(resource, token); !slices.Equal(drift, testCase.expected) {
+				t.Fatalf("expected drift %v, got %v", testCase.expected, drift)
+			}
+		})
+	}
+}
+
+func TestSetDriftMetricsReplacesReasons(t *testing.T) {
+	m := newTestManager(SYNC_DRIFT_REPAIR, &fakeCloudProvider{})
+	token := newTestToken("aaaaaa", "0123456789abcdef")
+	other := newTestToken("bbbbbb", "0123456789abcdef")
+
+	m.setDriftMetrics(token, []string{DRIFT_REASON_SECRET, DRIFT_REASON_USAGES})
+	m.setDriftMetrics(other, []string{DRIFT_REASON_MISSING})
+	if count := metricCount(m.prometheus.drift); count != 3 {
+		t.Fatalf("expected 3 drift series, got %d", count)
+	}
+
+	m.setDriftMetrics(token, nil)
+	if count := metricCount(m.prometheus.drift); count != 1 {
+		t.Fatalf("expected previous reasons of token to be removed, got %d drift series", count)
+	}
+}
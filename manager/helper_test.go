@@ -0,0 +1,115 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/log/slogger"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+	"github.com/webdevops/kube-bootstrap-token-manager/config"
+)
+
+const (
+	testNamespace = "kube-system"
+)
+
+// fakeCloudProvider stores tokens in memory, storeErr is returned by StoreToken if set
+type fakeCloudProvider struct {
+	tokens   []*bootstraptoken.BootstrapToken
+	storeErr error
+}
+
+func (p *fakeCloudProvider) Init(ctx context.Context, opts config.Opts, logger *slogger.Logger, userAgent string) error {
+	return nil
+}
+
+func (p *fakeCloudProvider) FetchToken(ctx context.Context) (*bootstraptoken.BootstrapToken, error) {
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	return p.tokens[0], nil
+}
+
+func (p *fakeCloudProvider) FetchTokens(ctx context.Context) ([]*bootstraptoken.BootstrapToken, error) {
+	return p.tokens, nil
+}
+
+func (p *fakeCloudProvider) StoreToken(ctx context.Context, token *bootstraptoken.BootstrapToken) error {
+	if p.storeErr != nil {
+		return p.storeErr
+	}
+	p.tokens = append([]*bootstraptoken.BootstrapToken{token}, p.tokens...)
+	return nil
+}
+
+// newTestManager creates a manager with fake clientset (containing objects) and unregistered metrics
+func newTestManager(drift string, cloudProvider *fakeCloudProvider, objects ...runtime.Object) *KubeBootstrapTokenManager {
+	provider := "fake"
+
+	m := &KubeBootstrapTokenManager{
+		Version:       "test",
+		Logger:        slogger.New(slog.NewTextHandler(io.Discard, nil)),
+		ctx:           context.Background(),
+		k8sClient:     fake.NewClientset(objects...),
+		cloudProvider: cloudProvider,
+	}
+	m.Opts.CloudProvider.Provider = &provider
+	m.Opts.BootstrapToken.Name = "bootstrap-token-%s"
+	m.Opts.BootstrapToken.Label = "bootstraptoken.webdevops.io/managed"
+	m.Opts.BootstrapToken.Namespace = testNamespace
+	m.Opts.BootstrapToken.Type = "bootstrap.kubernetes.io/token"
+	m.Opts.BootstrapToken.UsageBootstrapAuthentication = "true"
+	m.Opts.BootstrapToken.UsageBootstrapSigning = "true"
+	m.Opts.BootstrapToken.AuthExtraGroups = "system:bootstrappers:worker"
+	m.Opts.Sync.Drift = drift
+
+	m.prometheus.token = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_token"}, []string{"tokenID"})
+	m.prometheus.tokenExpiration = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_token_expiration"}, []string{"tokenID"})
+	m.prometheus.drift = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_drift"}, []string{"tokenID", "reason"})
+
+	return m
+}
+
+func newTestToken(id, secret string) *bootstraptoken.BootstrapToken {
+	token := bootstraptoken.NewBootstrapToken(id, secret)
+	token.SetCreationTime(time.Now().Add(-time.Hour).UTC().Truncate(time.Second))
+	token.SetExpirationTime(time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second))
+	return token
+}
+
+// newTestSecret returns the bootstrap token secret as stored by the API server (string data converted to data)
+func newTestSecret(m *KubeBootstrapTokenManager, token *bootstraptoken.BootstrapToken) *corev1.Secret {
+	resource := &corev1.Secret{}
+	resource.SetName("bootstrap-token-" + token.Id())
+	resource.SetNamespace(testNamespace)
+	resource = m.updateTokenData(resource, token)
+
+	resource.Data = map[string][]byte{}
+	for key, value := range resource.StringData {
+		resource.Data[key] = []byte(value)
+	}
+	resource.StringData = nil
+	return resource
+}
+
+// metricCount returns the number of series of the collector
+func metricCount(collector prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	count := 0
+	for range ch {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// startSecretInformer watches managed bootstrap token secrets (--bootstraptoken.label) and returns a channel
+// which is triggered if a secret is deleted or its data is modified, informer is stopped when ctx is cancelled
+func (m *KubeBootstrapTokenManager) startSecretInformer(ctx context.Context) <-chan string {
+	// buffered so multiple events while a sync is running result in one reconciliation
+	trigger := make(chan string, 1)
+	notify := func(reason string, secret *corev1.Secret) {
+		m.Logger.Info("managed bootstrap token changed", slog.String("reason", reason), slog.String("secret", secret.Namespace+"/"+secret.Name))
+		select {
+		case trigger <- reason:
+		default:
+		}
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		m.k8sClient,
+		0,
+		informers.WithNamespace(m.Opts.BootstrapToken.Namespace),
+		informers.WithTweakListOptions(func(opts *v1.ListOptions) {
+			opts.LabelSelector = m.Opts.BootstrapToken.Label + "=true"
+		}),
+	)
+
+	informer := factory.Core().V1().Secrets().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, ok := oldObj.(*corev1.Secret)
+			if !ok {
+				return
+			}
+			newSecret, ok := newObj.(*corev1.Secret)
+			if !ok {
+				return
+			}
+
+			// metadata only changes (eg. own annotations) are not relevant
+			if oldSecret.Type == newSecret.Type && reflect.DeepEqual(oldSecret.Data, newSecret.Data) {
+				return
+			}
+
+			notify("modified", newSecret)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if secret, ok := obj.(*corev1.Secret); ok {
+				notify("deleted", secret)
+			}
+		},
+	})
+	if err != nil {
+		m.Logger.Error("unable to watch bootstrap token secrets", slog.Any("error", err))
+		return trigger
+	}
+
+	factory.Start(ctx.Done())
+	go func() {
+		if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) && ctx.Err() == nil {
+			m.Logger.Error("unable to sync bootstrap token secret informer")
+		}
+	}()
+
+	return trigger
+}
@@ -0,0 +1,98 @@
+package manager
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// runLeaderElection runs the sync loop only while this replica holds the leader election Lease,
+// followers are waiting for leadership (http server with /healthz and /metrics is served by all replicas)
+func (m *KubeBootstrapTokenManager) runLeaderElection() {
+	opts := m.Opts.LeaderElection
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = m.Opts.BootstrapToken.Namespace
+	}
+
+	identity := opts.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			m.Logger.Fatal(err.Error())
+		}
+		identity = hostname
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: v1.ObjectMeta{
+			Name:      opts.Name,
+			Namespace: namespace,
+		},
+		Client: m.k8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	contextLogger := m.Logger.With(
+		slog.String("lease", namespace+"/"+opts.Name),
+		slog.String("identity", identity),
+	)
+	m.prometheus.leader.WithLabelValues().Set(0)
+
+	// leader election is restarted after leadership is lost, so this replica becomes a follower again
+	for {
+		contextLogger.Info("starting leader election")
+
+		// RunOrDie starts OnStartedLeading in a goroutine, so the sync loop is run here instead
+		// to ensure it's stopped before leader election is restarted (no overlapping sync loops)
+		leaderCtx := make(chan context.Context, 1)
+		electionDone := make(chan struct{})
+		go func() {
+			defer close(electionDone)
+			leaderelection.RunOrDie(m.ctx, leaderelection.LeaderElectionConfig{
+				Lock:            lock,
+				LeaseDuration:   opts.LeaseDuration,
+				RenewDeadline:   opts.RenewDeadline,
+				RetryPeriod:     opts.RetryPeriod,
+				ReleaseOnCancel: true,
+				Name:            opts.Name,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: func(ctx context.Context) {
+						leaderCtx <- ctx
+					},
+					OnStoppedLeading: func() {
+						contextLogger.Warn("lost leadership, stopping sync")
+						m.prometheus.leader.WithLabelValues().Set(0)
+					},
+					OnNewLeader: func(leader string) {
+						if leader != identity {
+							contextLogger.Info("following leader", slog.String("leader", leader))
+						}
+					},
+				},
+			})
+		}()
+
+		select {
+		case ctx := <-leaderCtx:
+			// ctx is cancelled when leadership is lost, all sync calls use it
+			contextLogger.Info("acquired leadership, starting sync")
+			m.prometheus.leader.WithLabelValues().Set(1)
+			m.run(ctx)
+			m.prometheus.leader.WithLabelValues().Set(0)
+			<-electionDone
+		case <-electionDone:
+		}
+
+		if m.ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"log/slog"
 	"math/big"
 	"os"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -17,14 +19,16 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	_ "k8s.io/client-go/plugin/pkg/client/auth"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/retry"
 
 	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
 	"github.com/webdevops/kube-bootstrap-token-manager/cloudprovider"
 	"github.com/webdevops/kube-bootstrap-token-manager/config"
+	"github.com/webdevops/kube-bootstrap-token-manager/kubeclient"
+)
+
+const (
+	TOKEN_ROLLBACK_TIMEOUT = 30 * time.Second
 )
 
 type (
@@ -35,7 +39,8 @@ type (
 		UserAgent string
 
 		ctx       context.Context
-		k8sClient *kubernetes.Clientset
+		wg        sync.WaitGroup
+		k8sClient kubernetes.Interface
 
 		prometheus struct {
 			token           *prometheus.GaugeVec
@@ -44,6 +49,13 @@ type (
 			sync      *prometheus.GaugeVec
 			syncTime  *prometheus.GaugeVec
 			syncCount *prometheus.CounterVec
+
+			leader *prometheus.GaugeVec
+
+			drift *prometheus.GaugeVec
+
+			rotation     *prometheus.GaugeVec
+			rotationTime *prometheus.GaugeVec
 		}
 
 		bootstrapToken struct {
@@ -51,20 +63,35 @@ type (
 		}
 
 		cloudProvider cloudprovider.CloudProvider
+
+		// rotation handler of cloud provider running in background (see notifyTokenRotated)
+		rotation struct {
+			lock   sync.Mutex
+			cancel context.CancelFunc
+			done   chan struct{}
+		}
+
+		// plan of current sync run (only in dry run mode)
+		plan *reconcilePlan
 	}
 )
 
-func (m *KubeBootstrapTokenManager) Init() {
-	m.ctx = context.Background()
+// Init initializes the manager, ctx is the root context (cancelled on shutdown)
+func (m *KubeBootstrapTokenManager) Init(ctx context.Context) error {
+	m.ctx = ctx
 	m.initK8s()
 	m.initPrometheus()
-	m.initCloudProvider()
+	if err := m.initCloudProvider(); err != nil {
+		return err
+	}
 
 	if t, err := template.New("BootstrapTokenId").Parse(m.Opts.BootstrapToken.IdTemplate); err == nil {
 		m.bootstrapToken.idTemplate = t
 	} else {
-		m.Logger.Panic(err.Error())
+		return fmt.Errorf("unable to parse bootstrap token id template: %w", err)
 	}
+
+	return nil
 }
 
 func (m *KubeBootstrapTokenManager) initPrometheus() {
@@ -113,69 +140,164 @@ func (m *KubeBootstrapTokenManager) initPrometheus() {
 	)
 	prometheus.MustRegister(m.prometheus.syncCount)
 
+	m.prometheus.leader = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bootstraptoken_leader",
+			Help: "kube-bootstrap-token-manager leader status (1 if this replica is syncing tokens)",
+		},
+		[]string{},
+	)
+	prometheus.MustRegister(m.prometheus.leader)
+
+	m.prometheus.drift = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bootstraptoken_drift",
+			Help: "kube-bootstrap-token-manager drift between cloud provider token and bootstrap token secret",
+		},
+		[]string{"tokenID", "reason"},
+	)
+	prometheus.MustRegister(m.prometheus.drift)
+
+	m.prometheus.rotation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bootstraptoken_rotation_status",
+			Help: "kube-bootstrap-token-manager status of cloud provider rotation handler (eg. Azure VM Scale Set update) of last rotated token",
+		},
+		[]string{"tokenID"},
+	)
+	prometheus.MustRegister(m.prometheus.rotation)
+
+	m.prometheus.rotationTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "bootstraptoken_rotation_time",
+			Help: "kube-bootstrap-token-manager last finish time of cloud provider rotation handler",
+		},
+		[]string{},
+	)
+	prometheus.MustRegister(m.prometheus.rotationTime)
 }
 
 func (r *KubeBootstrapTokenManager) initK8s() {
 	var err error
-	var config *rest.Config
 
-	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
-		// KUBECONFIG
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-		if err != nil {
-			panic(err.Error())
-		}
-	} else {
-		// K8S in cluster
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-	}
-
-	r.k8sClient, err = kubernetes.NewForConfig(config)
+	r.k8sClient, err = kubeclient.NewClient(os.Getenv("KUBECONFIG"), "")
 	if err != nil {
 		panic(err.Error())
 	}
 }
 
-func (m *KubeBootstrapTokenManager) initCloudProvider() {
+func (m *KubeBootstrapTokenManager) initCloudProvider() (err error) {
 	m.Logger.Infof("using cloud provider \"%s\"", *m.Opts.CloudProvider.Provider)
-	m.cloudProvider = cloudprovider.NewCloudProvider(*m.Opts.CloudProvider.Provider)
-	m.cloudProvider.Init(m.ctx, m.Opts, m.Logger, m.UserAgent)
+	if len(m.Opts.CloudProvider.Mirror) > 0 {
+		m.Logger.Infof("mirroring token to cloud providers \"%s\"", strings.Join(m.Opts.CloudProvider.Mirror, "\", \""))
+		m.cloudProvider, err = cloudprovider.NewMirrorCloudProvider(*m.Opts.CloudProvider.Provider, m.Opts.CloudProvider.Mirror)
+	} else {
+		m.cloudProvider, err = cloudprovider.NewCloudProvider(*m.Opts.CloudProvider.Provider)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.cloudProvider.Init(m.ctx, m.Opts, m.Logger, m.UserAgent); err != nil {
+		return fmt.Errorf("unable to init cloud provider: %w", err)
+	}
+
+	return nil
 }
 
+// Start starts the sync loop in background, it's stopped when the root context is cancelled (see Wait)
 func (m *KubeBootstrapTokenManager) Start() {
+	m.wg.Add(1)
 	go func() {
-		if m.Opts.Sync.Full {
+		defer m.wg.Done()
+		if m.Opts.LeaderElection.Enabled {
+			m.runLeaderElection()
+		} else {
+			m.run(m.ctx)
+		}
+	}()
+}
+
+// Wait waits until the sync loop (including in-flight sync runs) is stopped
+func (m *KubeBootstrapTokenManager) Wait() {
+	m.wg.Wait()
+}
+
+// run starts sync loop until ctx is cancelled (eg. shutdown or leadership is lost)
+func (m *KubeBootstrapTokenManager) run(ctx context.Context) {
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.Opts.Sync.Time)
+	defer ticker.Stop()
+
+	// deleted or modified bootstrap token secrets are reconciled immediately
+	secretChanged := m.startSecretInformer(ctx)
+
+	// full sync on start and after changes of bootstrap token secrets (could also be previous tokens)
+	fullSync := m.Opts.Sync.Full
+	for {
+		// drift is exposed for tokens of this sync run only (eg. removed from cloud provider or not fetched without full sync)
+		m.prometheus.drift.Reset()
+
+		if fullSync {
 			m.Logger.Infof("starting full sync run")
-			if err := m.syncRunFull(); err != nil {
+			if err := m.dryRunPlan(ctx, m.syncRunFull); err != nil && ctx.Err() == nil {
 				m.Logger.Error(err.Error())
 			}
 		}
-		for {
-			m.Logger.Infof("starting sync run")
-			if err := m.syncRun(); err == nil {
-				m.prometheus.sync.WithLabelValues().Set(1)
-				m.prometheus.syncCount.WithLabelValues().Inc()
-				m.prometheus.syncTime.WithLabelValues().SetToCurrentTime()
-			} else {
-				m.Logger.Error(err.Error())
-				m.prometheus.sync.WithLabelValues().Set(0)
-			}
-			time.Sleep(m.Opts.Sync.Time)
+
+		m.Logger.Infof("starting sync run")
+		if err := m.dryRunPlan(ctx, m.syncRun); err == nil {
+			m.prometheus.sync.WithLabelValues().Set(1)
+			m.prometheus.syncCount.WithLabelValues().Inc()
+			m.prometheus.syncTime.WithLabelValues().SetToCurrentTime()
+		} else if ctx.Err() == nil {
+			m.Logger.Error(err.Error())
+			m.prometheus.sync.WithLabelValues().Set(0)
+		}
+
+		select {
+		case <-ctx.Done():
+			m.Logger.Info("stopping sync loop")
+			return
+		case <-ticker.C:
+			fullSync = false
+		case reason := <-secretChanged:
+			m.Logger.Info("bootstrap token secret was " + reason + ", starting reconciliation")
+			fullSync = m.Opts.Sync.Full
 		}
+	}
+}
+
+// dryRunPlan runs sync in dry run mode (if enabled) and logs the resulting plan
+func (m *KubeBootstrapTokenManager) dryRunPlan(ctx context.Context, sync func(ctx context.Context) error) error {
+	if !m.Opts.DryRun {
+		return sync(ctx)
+	}
+
+	m.plan = newReconcilePlan()
+	defer func() {
+		m.plan.log(m.Logger)
+		m.plan = nil
 	}()
+
+	return sync(ctx)
 }
 
-func (m *KubeBootstrapTokenManager) syncRunFull() error {
-	for _, token := range m.cloudProvider.FetchTokens() {
+func (m *KubeBootstrapTokenManager) syncRunFull(ctx context.Context) error {
+	tokens, err := m.cloudProvider.FetchTokens(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to fetch tokens from cloud provider: %w", err)
+	}
+
+	for _, token := range tokens {
 		contextLogger := m.Logger.With(slog.String("token", token.Id()))
 		contextLogger.Infof("found cloud token with id \"%s\" and expiration %s", token.Id(), token.ExpirationString())
 		if !m.checkTokenRenewal(token) {
 			contextLogger.Infof("valid cloud token, syncing to cluster")
 			// sync token
-			if err := m.createOrUpdateToken(token, false); err != nil {
+			if err := m.createOrUpdateToken(ctx, token, false); err != nil {
 				return err
 			}
 		}
@@ -184,25 +306,35 @@ func (m *KubeBootstrapTokenManager) syncRunFull() error {
 	return nil
 }
 
-func (m *KubeBootstrapTokenManager) syncRun() error {
-	if token := m.cloudProvider.FetchToken(); token != nil {
+func (m *KubeBootstrapTokenManager) syncRun(ctx context.Context) error {
+	token, err := m.cloudProvider.FetchToken(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to fetch token from cloud provider: %w", err)
+	}
+
+	if token != nil {
 		contextLogger := m.Logger.With(slog.String("token", token.Id()))
 		contextLogger.Infof("found cloud token with id \"%s\" and expiration %s", token.Id(), token.ExpirationString())
 		if m.checkTokenRenewal(token) {
 			contextLogger.Infof("token is not valid or going to expire, starting renewal of token")
-			if err := m.createNewToken(); err != nil {
+			if m.plan != nil {
+				m.plan.add(PLAN_ACTION_ROTATE, m.cloudProviderName(), token, fmt.Sprintf("token expiration %s is before renewal time (--sync.recreate-before=%s)", token.ExpirationString(), m.Opts.Sync.RecreateBefore), nil)
+			}
+			if err := m.createNewToken(ctx); err != nil {
 				return err
 			}
 		} else {
 			contextLogger.Infof("valid cloud token, syncing to cluster")
 			// sync token
-			if err := m.createOrUpdateToken(token, false); err != nil {
+			if err := m.createOrUpdateToken(ctx, token, false); err != nil {
 				return err
 			}
+
+			m.healCloudProvider(ctx, token)
 		}
 	} else {
 		m.Logger.Infof("no cloud token found, creating new one")
-		if err := m.createNewToken(); err != nil {
+		if err := m.createNewToken(ctx); err != nil {
 			return err
 		}
 	}
@@ -210,7 +342,7 @@ func (m *KubeBootstrapTokenManager) syncRun() error {
 	return nil
 }
 
-func (m *KubeBootstrapTokenManager) createNewToken() error {
+func (m *KubeBootstrapTokenManager) createNewToken(ctx context.Context) error {
 	token := bootstraptoken.NewBootstrapToken(
 		m.generateTokenId(),
 		m.generateTokenSecret(),
@@ -221,20 +353,32 @@ func (m *KubeBootstrapTokenManager) createNewToken() error {
 		token.SetExpirationTime(time.Now().Add(*m.Opts.BootstrapToken.Expiration))
 	}
 
-	if err := m.createOrUpdateToken(token, true); err != nil {
+	if err := m.createOrUpdateToken(ctx, token, true); err != nil {
 		return err
 	}
 
+	m.notifyTokenRotated(token)
+
 	return nil
 }
 
 // checks if token already exists, updates if needed otherwise creates token
-func (m *KubeBootstrapTokenManager) createOrUpdateToken(token *bootstraptoken.BootstrapToken, syncToCloud bool) error {
+func (m *KubeBootstrapTokenManager) createOrUpdateToken(ctx context.Context, token *bootstraptoken.BootstrapToken, syncToCloud bool) error {
 	contextLogger := m.Logger.With(slog.String("token", token.Id()))
 
 	resourceName := fmt.Sprintf(m.Opts.BootstrapToken.Name, token.Id())
 	resourceNs := m.Opts.BootstrapToken.Namespace
 
+	if m.plan != nil {
+		return m.planCreateOrUpdateToken(ctx, token, syncToCloud)
+	}
+
+	// changes of this call, needed for rollback if token can't be stored to cloud provider
+	var (
+		created  bool
+		previous *corev1.Secret
+	)
+
 	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
 		switch {
 		case errors.IsServerTimeout(err):
@@ -246,25 +390,53 @@ func (m *KubeBootstrapTokenManager) createOrUpdateToken(token *bootstraptoken.Bo
 		}
 		return false
 	}, func() error {
-		resource, err := m.k8sClient.CoreV1().Secrets(resourceNs).Get(m.ctx, resourceName, v1.GetOptions{})
+		created, previous = false, nil
+
+		resource, err := m.k8sClient.CoreV1().Secrets(resourceNs).Get(ctx, resourceName, v1.GetOptions{})
 		if err == nil {
 			// update
+			drift := m.detectTokenDrift(resource, token)
+			m.setDriftMetrics(token, drift)
+			if len(drift) > 0 {
+				contextLogger.Warnf("bootstrap token \"%s\" differs from cloud token: %s", resourceName, driftReasons(drift))
+				// new tokens are always written, otherwise cluster and cloud provider would diverge
+				if !m.repairDrift() && !syncToCloud {
+					contextLogger.Warnf("not repairing bootstrap token \"%s\" (--sync.drift=%s)", resourceName, m.Opts.Sync.Drift)
+					return nil
+				}
+			}
+
+			desired := m.updateTokenData(resource.DeepCopy(), token)
+			if changes := planSecretChanges(resource, desired); len(changes) == 0 && len(drift) == 0 {
+				contextLogger.Debugf("bootstrap token \"%s\" is up to date", resourceName)
+				return nil
+			}
+
 			contextLogger.Infof("updating existing bootstrap token \"%s\" with expiration %s", resourceName, token.ExpirationString())
-			resource = m.updateTokenData(resource, token)
-			if _, err := m.k8sClient.CoreV1().Secrets(resourceNs).Update(m.ctx, resource, v1.UpdateOptions{}); err != nil {
+			if _, err := m.k8sClient.CoreV1().Secrets(resourceNs).Update(ctx, desired, v1.UpdateOptions{}); err != nil {
 				return err
 			}
+			previous = resource
 		} else if errors.IsNotFound(err) {
 			// create
+			if !syncToCloud {
+				// existing cloud token, secret was removed from cluster
+				m.setDriftMetrics(token, m.detectTokenDrift(nil, token))
+				contextLogger.Warnf("bootstrap token \"%s\" not found in cluster", resourceName)
+			} else {
+				m.setDriftMetrics(token, nil)
+			}
+
 			resource = &corev1.Secret{}
 			resource.SetName(resourceName)
 			resource.SetNamespace(resourceNs)
 
 			contextLogger.Infof("creating new bootstrap token \"%s\" with expiration %s", resourceName, token.ExpirationString())
 			resource = m.updateTokenData(resource, token)
-			if _, err := m.k8sClient.CoreV1().Secrets(resourceNs).Create(m.ctx, resource, v1.CreateOptions{}); err != nil {
+			if _, err := m.k8sClient.CoreV1().Secrets(resourceNs).Create(ctx, resource, v1.CreateOptions{}); err != nil {
 				return err
 			}
+			created = true
 		} else {
 			// error
 			return err
@@ -277,7 +449,11 @@ func (m *KubeBootstrapTokenManager) createOrUpdateToken(token *bootstraptoken.Bo
 	}
 
 	if syncToCloud {
-		m.cloudProvider.StoreToken(token)
+		if err := m.cloudProvider.StoreToken(ctx, token); err != nil {
+			// token must not exist only in cluster (eg. shutdown while storing token), it would never be renewed
+			m.rollbackToken(ctx, contextLogger, resourceNs, resourceName, created, previous)
+			return fmt.Errorf("unable to store token to cloud provider: %w", err)
+		}
 	} else {
 		contextLogger.Debug("not syncing token to cloud, not needed")
 	}
@@ -292,6 +468,167 @@ func (m *KubeBootstrapTokenManager) createOrUpdateToken(token *bootstraptoken.Bo
 	return nil
 }
 
+// healCloudProvider stores the current token to cloud providers missing it (eg. mirror secondaries)
+func (m *KubeBootstrapTokenManager) healCloudProvider(ctx context.Context, token *bootstraptoken.BootstrapToken) {
+	healer, ok := m.cloudProvider.(cloudprovider.CloudProviderHealer)
+	if !ok {
+		return
+	}
+
+	if m.plan != nil {
+		for _, target := range healer.HealTargets(token) {
+			m.plan.add(PLAN_ACTION_HEAL, target, token, "cloud provider is missing current token", map[string]string{"token": PLAN_REDACTED})
+		}
+		return
+	}
+
+	if err := healer.Heal(ctx, token); err != nil {
+		m.Logger.Warn("unable to heal cloud providers, retrying on next sync run", slog.Any("error", err))
+	}
+}
+
+// notifyTokenRotated passes a new token to the rotation handler of the cloud provider (eg. Azure VM Scale Set update).
+// The handler runs in background as long running operations must not block the sync loop, a handler still running
+// for a previous token is cancelled. Failures are logged and exposed as bootstraptoken_rotation_status metric
+func (m *KubeBootstrapTokenManager) notifyTokenRotated(token *bootstraptoken.BootstrapToken) {
+	handler, ok := m.cloudProvider.(cloudprovider.CloudProviderRotationHandler)
+	if !ok || len(handler.RotationTargets()) == 0 {
+		return
+	}
+
+	if m.plan != nil {
+		for _, target := range handler.RotationTargets() {
+			m.plan.add(PLAN_ACTION_NOTIFY, target, token, "token was rotated", nil)
+		}
+		return
+	}
+
+	m.rotation.lock.Lock()
+	defer m.rotation.lock.Unlock()
+
+	if m.rotation.cancel != nil {
+		m.rotation.cancel()
+		<-m.rotation.done
+	}
+
+	// not bound to sync context, handler also finishes if leadership is lost (only stopped on shutdown)
+	ctx, cancel := context.WithCancel(m.ctx)
+	done := make(chan struct{})
+	m.rotation.cancel = cancel
+	m.rotation.done = done
+
+	contextLogger := m.Logger.With(slog.String("token", token.Id()))
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(done)
+		defer cancel()
+
+		contextLogger.Info("starting cloud provider rotation handler", slog.Any("targets", handler.RotationTargets()))
+		err := handler.TokenRotated(ctx, token)
+		if ctx.Err() != nil {
+			contextLogger.Warn("cloud provider rotation handler was cancelled", slog.Any("error", err))
+			return
+		}
+
+		m.prometheus.rotation.Reset()
+		if err != nil {
+			contextLogger.Error("cloud provider rotation handler failed", slog.Any("error", err))
+			m.prometheus.rotation.WithLabelValues(token.Id()).Set(0)
+		} else {
+			contextLogger.Info("cloud provider rotation handler finished")
+			m.prometheus.rotation.WithLabelValues(token.Id()).Set(1)
+		}
+		m.prometheus.rotationTime.WithLabelValues().SetToCurrentTime()
+	}()
+}
+
+// rollbackToken reverts the bootstrap token secret in cluster if the token couldn't be stored to the cloud provider:
+// a secret created by this sync is removed, an updated secret is restored to its previous state.
+// Runs with own context as the sync context might already be cancelled (shutdown or lost leadership)
+func (m *KubeBootstrapTokenManager) rollbackToken(ctx context.Context, logger *slogger.Logger, resourceNs, resourceName string, created bool, previous *corev1.Secret) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), TOKEN_ROLLBACK_TIMEOUT)
+	defer cancel()
+
+	switch {
+	case created:
+		logger.Warnf("removing bootstrap token \"%s\" from cluster, token was not stored to cloud provider", resourceName)
+		if err := m.k8sClient.CoreV1().Secrets(resourceNs).Delete(ctx, resourceName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			logger.Error(fmt.Sprintf("unable to remove bootstrap token \"%s\": %v", resourceName, err))
+		}
+	case previous != nil:
+		logger.Warnf("restoring bootstrap token \"%s\" in cluster, token was not stored to cloud provider", resourceName)
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			resource, err := m.k8sClient.CoreV1().Secrets(resourceNs).Get(ctx, resourceName, v1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			resource.Type = previous.Type
+			resource.Labels = previous.Labels
+			resource.Annotations = previous.Annotations
+			resource.Data = previous.Data
+			resource.StringData = nil
+
+			_, err = m.k8sClient.CoreV1().Secrets(resourceNs).Update(ctx, resource, v1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			logger.Error(fmt.Sprintf("unable to restore bootstrap token \"%s\": %v", resourceName, err))
+		}
+	}
+}
+
+// planCreateOrUpdateToken adds the changes of createOrUpdateToken to the dry run plan without applying them
+func (m *KubeBootstrapTokenManager) planCreateOrUpdateToken(ctx context.Context, token *bootstraptoken.BootstrapToken, syncToCloud bool) error {
+	contextLogger := m.Logger.With(slog.String("token", token.Id()))
+
+	resourceName := fmt.Sprintf(m.Opts.BootstrapToken.Name, token.Id())
+	resourceNs := m.Opts.BootstrapToken.Namespace
+	target := fmt.Sprintf("secret/%s/%s", resourceNs, resourceName)
+
+	resource, err := m.k8sClient.CoreV1().Secrets(resourceNs).Get(ctx, resourceName, v1.GetOptions{})
+	if err == nil {
+		changes := planSecretChanges(resource, m.updateTokenData(resource.DeepCopy(), token))
+		if drift := m.detectTokenDrift(resource, token); len(drift) > 0 {
+			m.setDriftMetrics(token, drift)
+			if m.repairDrift() || syncToCloud {
+				m.plan.add(PLAN_ACTION_UPDATE, target, token, "drift: "+driftReasons(drift), changes)
+			} else {
+				contextLogger.Warnf("bootstrap token \"%s\" differs from cloud token: %s (not repaired, --sync.drift=%s)", resourceName, driftReasons(drift), m.Opts.Sync.Drift)
+			}
+		} else if len(changes) > 0 {
+			m.setDriftMetrics(token, nil)
+			m.plan.add(PLAN_ACTION_UPDATE, target, token, planChangedKeys(changes), changes)
+		} else {
+			m.setDriftMetrics(token, nil)
+			contextLogger.Debugf("bootstrap token \"%s\" is up to date", resourceName)
+		}
+	} else if errors.IsNotFound(err) {
+		if !syncToCloud {
+			m.setDriftMetrics(token, m.detectTokenDrift(nil, token))
+		}
+
+		resource = &corev1.Secret{}
+		resource.SetName(resourceName)
+		resource.SetNamespace(resourceNs)
+		m.plan.add(PLAN_ACTION_CREATE, target, token, "bootstrap token not found", planSecretChanges(nil, m.updateTokenData(resource, token)))
+	} else {
+		return err
+	}
+
+	if syncToCloud {
+		m.plan.add(PLAN_ACTION_STORE, m.cloudProviderName(), token, "new token", map[string]string{"token": PLAN_REDACTED})
+	}
+
+	return nil
+}
+
+// cloudProviderName returns the name of the cloud provider (including mirrors)
+func (m *KubeBootstrapTokenManager) cloudProviderName() string {
+	return strings.Join(append([]string{*m.Opts.CloudProvider.Provider}, m.Opts.CloudProvider.Mirror...), ",")
+}
+
 // update kubernetes resource bootstrap token information
 func (m *KubeBootstrapTokenManager) updateTokenData(resource *corev1.Secret, token *bootstraptoken.BootstrapToken) *corev1.Secret {
 	resource.Type = corev1.SecretType(m.Opts.BootstrapToken.Type)
@@ -319,6 +656,9 @@ func (m *KubeBootstrapTokenManager) updateTokenData(resource *corev1.Secret, tok
 	resource.StringData["token-secret"] = token.Secret()
 	if token.ExpirationTime() != nil {
 		resource.StringData["expiration"] = token.ExpirationTime().UTC().Format(time.RFC3339)
+	} else {
+		// token without expiration, expiration must not be kept from previous data
+		delete(resource.Data, "expiration")
 	}
 	resource.StringData["usage-bootstrap-authentication"] = m.Opts.BootstrapToken.UsageBootstrapAuthentication
 	resource.StringData["usage-bootstrap-signing"] = m.Opts.BootstrapToken.UsageBootstrapSigning
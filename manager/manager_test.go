@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCreateOrUpdateTokenStore(t *testing.T) {
+	token := newTestToken("aaaaaa", "0123456789abcdef")
+	previous := newTestToken("aaaaaa", "fedcba9876543210")
+
+	testCases := []struct {
+		name     string
+		drift    string
+		existing bool
+		storeErr error
+	}{
+		{
+			name:  "new secret",
+			drift: SYNC_DRIFT_REPAIR,
+		},
+		{
+			name:     "new secret removed after store failure",
+			drift:    SYNC_DRIFT_REPAIR,
+			storeErr: errors.New("store failed"),
+		},
+		{
+			name:     "existing secret updated",
+			drift:    SYNC_DRIFT_REPAIR,
+			existing: true,
+		},
+		{
+			name:     "existing secret updated in report mode",
+			drift:    SYNC_DRIFT_REPORT,
+			existing: true,
+		},
+		{
+			name:     "existing secret restored after store failure",
+			drift:    SYNC_DRIFT_REPAIR,
+			existing: true,
+			storeErr: errors.New("store failed"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := context.Background()
+			cloudProvider := &fakeCloudProvider{storeErr: testCase.storeErr}
+
+			objects := []runtime.Object{}
+			existing := newTestSecret(newTestManager(testCase.drift, cloudProvider), previous)
+			if testCase.existing {
+				objects = append(objects, existing)
+			}
+
+			m := newTestManager(testCase.drift, cloudProvider, objects...)
+			err := m.createOrUpdateToken(ctx, token, true)
+			if testCase.storeErr != nil {
+				if !errors.Is(err, testCase.storeErr) {
+					t.Fatalf("expected store error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			resource, err := m.k8sClient.CoreV1().Secrets(testNamespace).Get(ctx, "bootstrap-token-aaaaaa", v1.GetOptions{})
+			switch {
+			case testCase.storeErr != nil && !testCase.existing:
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("expected created secret to be removed, got %v", err)
+				}
+			case testCase.storeErr != nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(resource.StringData) > 0 || !equality.Semantic.DeepEqual(resource.Data, existing.Data) || !equality.Semantic.DeepEqual(resource.Labels, existing.Labels) {
+					t.Fatalf("expected secret to be restored, got %v", resource)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resource.StringData["token-secret"] != token.Secret() {
+					t.Fatal("expected secret to contain new token")
+				}
+				if len(cloudProvider.tokens) != 1 || cloudProvider.tokens[0] != token {
+					t.Fatal("expected token to be stored to cloud provider")
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackTokenCancelledContext(t *testing.T) {
+	token := newTestToken("aaaaaa", "0123456789abcdef")
+	m := newTestManager(SYNC_DRIFT_REPAIR, &fakeCloudProvider{}, newTestSecret(newTestManager(SYNC_DRIFT_REPAIR, &fakeCloudProvider{}), token))
+
+	// rollback must also work if sync was cancelled (eg. shutdown while storing token)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.rollbackToken(ctx, m.Logger, testNamespace, "bootstrap-token-aaaaaa", true, nil)
+
+	if _, err := m.k8sClient.CoreV1().Secrets(testNamespace).Get(context.Background(), "bootstrap-token-aaaaaa", v1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected secret to be removed, got %v", err)
+	}
+}
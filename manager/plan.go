@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/webdevops/go-common/log/slogger"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/webdevops/kube-bootstrap-token-manager/bootstraptoken"
+)
+
+const (
+	PLAN_ACTION_ROTATE = "rotate"
+	PLAN_ACTION_CREATE = "create"
+	PLAN_ACTION_UPDATE = "update"
+	PLAN_ACTION_STORE  = "cloud-store"
+	PLAN_ACTION_HEAL   = "cloud-heal"
+	PLAN_ACTION_NOTIFY = "cloud-rotation"
+
+	PLAN_REDACTED = "<redacted>"
+)
+
+type (
+	// reconcilePlan collects all changes of a sync run in dry run mode (instead of applying them)
+	reconcilePlan struct {
+		Actions []planAction `json:"actions"`
+	}
+
+	planAction struct {
+		Action     string            `json:"action"`
+		Target     string            `json:"target"`
+		TokenId    string            `json:"tokenId"`
+		Expiration string            `json:"expiration"`
+		Reason     string            `json:"reason,omitempty"`
+		Changes    map[string]string `json:"changes,omitempty"`
+	}
+)
+
+func newReconcilePlan() *reconcilePlan {
+	return &reconcilePlan{
+		Actions: []planAction{},
+	}
+}
+
+func (p *reconcilePlan) add(action, target string, token *bootstraptoken.BootstrapToken, reason string, changes map[string]string) {
+	p.Actions = append(p.Actions, planAction{
+		Action:     action,
+		Target:     target,
+		TokenId:    token.Id(),
+		Expiration: token.ExpirationString(),
+		Reason:     reason,
+		Changes:    changes,
+	})
+}
+
+// log logs every action and the whole plan as JSON
+func (p *reconcilePlan) log(logger *slogger.Logger) {
+	if len(p.Actions) == 0 {
+		logger.Info("dry run plan: no changes")
+		return
+	}
+
+	for _, action := range p.Actions {
+		logger.Info(
+			"dry run plan: "+action.Action,
+			slog.String("target", action.Target),
+			slog.String("token", action.TokenId),
+			slog.String("expiration", action.Expiration),
+			slog.String("reason", action.Reason),
+			slog.Any("changes", action.Changes),
+		)
+	}
+
+	if planJson, err := json.Marshal(p); err == nil {
+		logger.Info("dry run plan", slog.String("plan", string(planJson)))
+	}
+}
+
+// planSecretChanges returns the (redacted) changes between the existing and the desired bootstrap token secret,
+// existing may be nil for new secrets
+func planSecretChanges(existing, desired *corev1.Secret) map[string]string {
+	changes := map[string]string{}
+
+	for key, value := range desired.StringData {
+		if existing != nil {
+			if existingValue, exists := existing.Data[key]; exists && string(existingValue) == value {
+				continue
+			}
+		}
+
+		if key == "token-secret" {
+			value = PLAN_REDACTED
+		}
+		changes["data."+key] = value
+	}
+
+	for key, value := range desired.Labels {
+		if existing != nil && existing.Labels[key] == value {
+			continue
+		}
+		changes["label."+key] = value
+	}
+
+	for key, value := range desired.Annotations {
+		if existing != nil && existing.Annotations[key] == value {
+			continue
+		}
+		changes["annotation."+key] = value
+	}
+
+	if existing == nil || existing.Type != desired.Type {
+		changes["type"] = string(desired.Type)
+	}
+
+	return changes
+}
+
+// planChangedKeys returns sorted keys of changes (for log messages)
+func planChangedKeys(changes map[string]string) string {
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
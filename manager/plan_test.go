@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPlanCreateOrUpdateToken(t *testing.T) {
+	token := newTestToken("aaaaaa", "0123456789abcdef")
+
+	testCases := []struct {
+		name        string
+		drift       string
+		syncToCloud bool
+		secret      func(resource *corev1.Secret)
+		expected    []string
+	}{
+		{
+			name:        "new token",
+			drift:       SYNC_DRIFT_REPAIR,
+			syncToCloud: true,
+			expected:    []string{PLAN_ACTION_CREATE, PLAN_ACTION_STORE},
+		},
+		{
+			name:     "missing secret",
+			drift:    SYNC_DRIFT_REPORT,
+			expected: []string{PLAN_ACTION_CREATE},
+		},
+		{
+			name:     "up to date",
+			drift:    SYNC_DRIFT_REPAIR,
+			secret:   func(resource *corev1.Secret) {},
+			expected: []string{},
+		},
+		{
+			name:  "changed label",
+			drift: SYNC_DRIFT_REPORT,
+			secret: func(resource *corev1.Secret) {
+				resource.Labels = nil
+			},
+			expected: []string{PLAN_ACTION_UPDATE},
+		},
+		{
+			name:  "drift repaired",
+			drift: SYNC_DRIFT_REPAIR,
+			secret: func(resource *corev1.Secret) {
+				resource.Data["token-secret"] = []byte("fedcba9876543210")
+			},
+			expected: []string{PLAN_ACTION_UPDATE},
+		},
+		{
+			name:  "drift reported",
+			drift: SYNC_DRIFT_REPORT,
+			secret: func(resource *corev1.Secret) {
+				resource.Data["token-secret"] = []byte("fedcba9876543210")
+			},
+			expected: []string{},
+		},
+		{
+			name:        "drift reported for new token",
+			drift:       SYNC_DRIFT_REPORT,
+			syncToCloud: true,
+			secret: func(resource *corev1.Secret) {
+				resource.Data["token-secret"] = []byte("fedcba9876543210")
+			},
+			expected: []string{PLAN_ACTION_UPDATE, PLAN_ACTION_STORE},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := context.Background()
+			cloudProvider := &fakeCloudProvider{}
+
+			objects := []runtime.Object{}
+			if testCase.secret != nil {
+				resource := newTestSecret(newTestManager(testCase.drift, cloudProvider), token)
+				testCase.secret(resource)
+				objects = append(objects, resource)
+			}
+
+			m := newTestManager(testCase.drift, cloudProvider, objects...)
+			m.plan = newReconcilePlan()
+			if err := m.createOrUpdateToken(ctx, token, testCase.syncToCloud); err != nil {
+				t.Fatal(err)
+			}
+
+			actions := []string{}
+			for _, action := range m.plan.Actions {
+				actions = append(actions, action.Action)
+				if action.Changes["data.token-secret"] != "" && action.Changes["data.token-secret"] != PLAN_REDACTED {
+					t.Fatalf("token secret must be redacted in plan, got %v", action.Changes)
+				}
+			}
+			if !slices.Equal(actions, testCase.expected) {
+				t.Fatalf("expected plan %v, got %v", testCase.expected, actions)
+			}
+
+			// dry run must not change anything
+			if len(cloudProvider.tokens) != 0 {
+				t.Fatal("dry run must not store token to cloud provider")
+			}
+			secretList, err := m.k8sClient.CoreV1().Secrets(testNamespace).List(ctx, v1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(secretList.Items) != len(objects) {
+				t.Fatalf("dry run must not create secrets, got %d secrets", len(secretList.Items))
+			}
+			for _, resource := range secretList.Items {
+				if len(resource.StringData) > 0 {
+					t.Fatal("dry run must not update secrets")
+				}
+			}
+		})
+	}
+}